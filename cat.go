@@ -2,16 +2,54 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/blinsay/ktk/producer"
 )
 
+var catFlags = flag.NewFlagSet("cat", flag.ContinueOnError)
+
+var (
+	catReplayTimestamps = catFlags.String("replay-timestamps", "", "send lines on the schedule given by this field or JSON path")
+	catSpeed            = catFlags.String("speed", "1x", "how fast to replay timestamps, as a multiplier like 2x")
+	catFollow           = catFlags.Bool("follow", false, "keep sending lines as they're appended to files matching the given globs")
+	catFollowInterval   = catFlags.Duration("follow-interval", 250*time.Millisecond, "how often to check followed files for new lines")
+	catOffsets          = catFlags.String("offsets", "", "where to save how far each followed file has been read. defaults to ~/.ktk/offsets/stream.json")
+	catSyslog           = catFlags.Bool("syslog", false, "accept syslog messages on --listen addresses")
+	catKeyFrom          = catFlags.String("key-from", "", "with --syslog, use the message's hostname or app as its partition key")
+	catHTTP             = catFlags.String("http", "", "accept records POSTed to /records at this address instead of reading files")
+	catHTTPMaxPending   = catFlags.Int("http-max-pending", 10000, "the most --http records to hold while they're sent before turning requests away")
+	catMultilineStart   = catFlags.String("multiline-start", "", "start a new record at every line matching this regexp, adding other lines to the record before")
+	catMultilineCont    = catFlags.String("multiline-continue", "", "add every line matching this regexp to the record before, starting a new record at other lines")
+	catJSONStream       = catFlags.Bool("json-stream", false, "read a stream of JSON values, sending each one as a record")
+	catMultilineMax     = catFlags.Int("multiline-max-bytes", maxRecordSize, "cut records assembled from several lines off at this size, and split longer lines")
+	catMultilineTimeout = catFlags.Duration("multiline-timeout", time.Second, "send an assembled record if its next line doesn't arrive within this long")
+)
+
+var catListen stringsFlag
+
+func init() {
+	catFlags.Var(&catListen, "listen", "accept messages on a udp://, tcp://, unix:// or unixgram:// address instead of reading files. may be repeated")
+}
+
+// How often messages from --listen and --http are sent when they're arriving too slowly
+// to fill a PutRecords request.
+const listenFlushInterval = 500 * time.Millisecond
+
 var catCommand = &Command{
 	Name:  "cat",
-	Usage: "cat stream [file...]",
+	Usage: "cat stream [file...] [flags]",
 	Short: "Send data to a Kinesis stream",
 	Description: `
 	Sends data to the specified Kinesis stream one line at a time. If the names of
@@ -20,8 +58,74 @@ var catCommand = &Command{
 	Cat sends data as fast as possible, using the first 256 characters of the
 	string as the partition key. Any throughput errors are automatically retried
 	until data is sent successfully.
+
+	With --replay-timestamps, each line is sent at the same offset from the
+	first line as the timestamp embedded in it, reproducing the timing of the
+	original traffic. The timestamp is read from either a whitespace separated
+	field, numbered from 1 (e.g. --replay-timestamps=2), or a path into a line
+	of JSON (e.g. --replay-timestamps=$.meta.ts). Timestamps may be RFC3339
+	strings or unix times in seconds or milliseconds. Lines without a timestamp
+	are sent right away. --speed speeds up or slows down the replay, e.g.
+	--speed=2x replays an hour of traffic in 30 minutes.
+
+	With --follow, cat works like tail -F on every file matching the globs given
+	as arguments, e.g. ktk cat my-stream --follow '/var/log/app/*.log', and
+	keeps sending lines as they're appended until it's interrupted. Files
+	that are rotated or truncated are followed through it, and new files that
+	match are picked up as they appear. How far each file has been read is
+	saved to --offsets once its lines have been sent, so a restarted cat
+	doesn't send lines twice or skip any. The first time cat follows a set of
+	files, with no offsets saved, it starts at the end of files that already
+	exist.
+
+	With --listen, cat accepts messages from other processes instead of reading
+	files, until it's interrupted. Addresses look like udp://:514,
+	tcp://:5140, unix:///run/ktk.sock or unixgram:///run/ktk.sock, and
+	--listen can be given more than once. Each datagram is a message, and
+	messages on stream sockets are separated by newlines. When cat falls
+	behind, it stops reading from stream sockets until it catches up.
+
+	With --syslog, messages are expected to be RFC 5424 or RFC 3164 syslog
+	messages, and stream sockets also accept octet counted messages. Messages
+	are sent as they were received. --key-from=hostname or --key-from=app
+	partitions them by the host or app that sent them.
+
+	With --http, cat accepts records POSTed to /records, e.g. --http=:8080,
+	until it's interrupted. The body can be a JSON array of records like
+	[{"key": "a-key", "data": "hello"}], sent with a Content-Type of
+	application/json, or anything else to send the whole body as one record.
+	Records without a key, or raw bodies without an X-Ktk-Partition-Key header,
+	are keyed like lines. cat responds once every record has been sent, with
+	the shard and sequence number of each one:
+
+	  {"records": [{"shard_id": "shardId-000000000001",
+	                "sequence_number": "49545115243490985018280067714973144582180062593244200961"}]}
+
+	If any record can't be sent, the response is a 502 with an error in place
+	of that record's shard and sequence number. Errors sending records don't
+	stop cat, so with --listen they're only logged.
+
+	If more than --http-max-pending records are waiting to be sent, requests
+	are turned away with a 429 until cat catches up. --http and --listen can be
+	used together.
+
+	Lines that belong together, like a stack trace or pretty-printed JSON, can
+	be sent as a single record. With --multiline-start, every line matching a
+	regexp starts a new record and other lines are added to the one before it,
+	e.g. --multiline-start='^\d{4}-\d{2}-\d{2} ' for logs that start every
+	message with a date. With --multiline-continue, it's the other way around,
+	e.g. --multiline-continue='^\s' for stack traces with indented frames. With
+	--json-stream, input is read as a series of JSON values, which don't need
+	to be one per line, and each value is sent as a record on a single line.
+	Records are cut off at --multiline-max-bytes, and a single line longer than
+	that is split into records of --multiline-max-bytes. JSON values longer
+	than --multiline-max-bytes are dropped instead of being cut off, since they
+	wouldn't be JSON anymore. A record is sent without waiting for the line
+	that would end it once it's been --multiline-timeout since its last line.
+	Multiline records work with files, stdin and --follow.
 	`,
-	Run: runCat,
+	Flags: catFlags,
+	Run:   runCat,
 }
 
 // Run the cat command with the given arguments.
@@ -37,20 +141,71 @@ func runCat(args []string) {
 	stream := args[0]
 	inputFiles := args[1:]
 
+	p := producer.New(stream, producer.WithConfig(awsConfig))
+	p.Debug = verbose
+
+	asm, err := newCatAssembler()
+	fatalOnErr(err)
+
+	if len(catListen) > 0 || *catHTTP != "" {
+		if !asm.passthrough() {
+			log.Fatalln("error: multiline records can't be used with --listen or --http")
+		}
+		if *catKeyFrom != "" && *catKeyFrom != "hostname" && *catKeyFrom != "app" {
+			log.Fatalf("error: --key-from must be hostname or app, got %q", *catKeyFrom)
+		}
+		if *catKeyFrom != "" && !*catSyslog {
+			log.Fatalln("error: --key-from needs --syslog")
+		}
+		listenAndSend(catListen, *catHTTP, p)
+		return
+	}
+
+	if *catFollow {
+		if len(inputFiles) == 0 {
+			log.Fatalln("error: --follow needs files to follow")
+		}
+		if *catReplayTimestamps != "" {
+			log.Fatalln("error: --replay-timestamps can't be used with --follow")
+		}
+		followFiles(stream, inputFiles, asm, p)
+		return
+	}
+
+	var extract timestampExtractor
+	var clock *replayClock
+	if *catReplayTimestamps != "" {
+		speed, err := parseSpeed(*catSpeed)
+		fatalOnErr(err)
+		extract, err = newTimestampExtractor(*catReplayTimestamps)
+		fatalOnErr(err)
+		clock = newReplayClock(speed)
+	}
+
 	reader := io.Reader(os.Stdin)
 	if len(inputFiles) > 0 {
 		reader = openFiles(inputFiles)
 	}
-	scanner := bufio.NewScanner(reader)
+	scanner := newLineScanner(reader)
 
-	p := producer.New(stream)
-	p.Debug = envBool(VERBOSE)
+	send := func(line string) {
+		if clock != nil {
+			if ts, ok := extract(line); ok {
+				fatalOnErr(clock.wait(ts, p.Flush))
+			}
+		}
 
-	for scanner.Scan() {
-		line := scanner.Text()
-		if len(line) > 0 {
-			fatalOnErr(p.PutString(line))
+		fatalOnErr(p.PutString(line))
+	}
+
+	if asm.passthrough() {
+		for scanner.Scan() {
+			for _, line := range asm.add(scanner.Text()) {
+				send(line)
+			}
 		}
+	} else {
+		assembleLines(scanner, asm, send)
 	}
 
 	if err := scanner.Err(); err != nil {
@@ -60,6 +215,180 @@ func runCat(args []string) {
 	fatalOnErr(p.Flush())
 }
 
+// Build an assembler from the multiline flags.
+func newCatAssembler() (*assembler, error) {
+	a := &assembler{json: *catJSONStream, maxBytes: *catMultilineMax}
+
+	modes := 0
+	if *catMultilineStart != "" {
+		re, err := regexp.Compile(*catMultilineStart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --multiline-start: %s", err)
+		}
+		a.start = re
+		modes++
+	}
+	if *catMultilineCont != "" {
+		re, err := regexp.Compile(*catMultilineCont)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --multiline-continue: %s", err)
+		}
+		a.cont = re
+		modes++
+	}
+	if *catJSONStream {
+		modes++
+	}
+
+	if modes > 1 {
+		return nil, errors.New("only one of --multiline-start, --multiline-continue and --json-stream can be used")
+	}
+	if a.maxBytes < 1 || a.maxBytes > maxRecordSize {
+		return nil, fmt.Errorf("--multiline-max-bytes must be between 1 and %d", maxRecordSize)
+	}
+	return a, nil
+}
+
+// The longest line cat reads. Lines longer than --multiline-max-bytes are
+// split into several records, so this has to leave room for lines well past
+// the largest record.
+const maxLineSize = 64 * 1024 * 1024
+
+// Return a Scanner that reads lines from r of up to maxLineSize bytes.
+func newLineScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	return scanner
+}
+
+// Put scanned lines together into records with asm and send them. A record
+// is sent early if the line after it takes longer than --multiline-timeout to
+// arrive.
+func assembleLines(scanner *bufio.Scanner, asm *assembler, send func(string)) {
+	lines := make(chan string)
+	go func() {
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	timeout := time.NewTimer(*catMultilineTimeout)
+	timeout.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				for _, record := range asm.flush() {
+					send(record)
+				}
+				return
+			}
+			for _, record := range asm.add(line) {
+				send(record)
+			}
+			if asm.pending() {
+				timeout.Reset(*catMultilineTimeout)
+			} else {
+				timeout.Stop()
+			}
+		case <-timeout.C:
+			for _, record := range asm.flush() {
+				send(record)
+			}
+		}
+	}
+}
+
+// Send lines from every file matching patterns as they're written, saving
+// offsets after every batch of lines is sent, until interrupted.
+func followFiles(stream string, patterns []string, asm *assembler, p *producer.Producer) {
+	path := *catOffsets
+	if path == "" {
+		home := os.Getenv("HOME")
+		if home == "" {
+			log.Fatalln("error: no home directory to keep offsets in. use --offsets")
+		}
+		path = filepath.Join(home, ".ktk", "offsets", stream+".json")
+	}
+
+	offsets, err := loadOffsets(path)
+	fatalOnErr(err)
+	fl := newFollower(patterns, offsets, asm.empty, *catMultilineTimeout)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	// lines are keyed like listened messages, so a long line's key isn't cut
+	// off in the middle of a rune
+	send := func(line string) error {
+		return p.Put(aws.String(partitionKey(line)), []byte(line))
+	}
+
+	ticker := time.NewTicker(*catFollowInterval)
+	defer ticker.Stop()
+	for {
+		fatalOnErr(fl.poll(send))
+		fatalOnErr(p.Flush())
+		fatalOnErr(fl.save())
+
+		select {
+		case <-ticker.C:
+		case <-interrupt:
+			return
+		}
+	}
+}
+
+// Send messages from every listen address and the HTTP endpoint until
+// interrupted.
+func listenAndSend(addrs []string, httpAddr string, p *producer.Producer) {
+	messages := make(chan listenedMessage, producer.MaxSendSize)
+
+	if httpAddr != "" {
+		server := &ingestServer{messages: messages, maxPending: *catHTTPMaxPending}
+		go func() {
+			log.Fatalln("error:", http.ListenAndServe(httpAddr, server))
+		}()
+	}
+
+	var listeners []*listener
+	for _, addr := range addrs {
+		l, err := newListener(addr, *catSyslog, *catKeyFrom, messages)
+		fatalOnErr(err)
+		listeners = append(listeners, l)
+		go l.serve()
+	}
+	defer func() {
+		for _, l := range listeners {
+			l.close()
+		}
+	}()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	ticker := time.NewTicker(listenFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case m := <-messages:
+			// records that fail are reported to their callbacks, so a failed
+			// send only fails the requests it was carrying
+			if err := p.PutCallback(aws.String(m.key), []byte(m.data), m.done); err != nil {
+				log.Printf("error: %s", err)
+			}
+		case <-ticker.C:
+			if err := p.Flush(); err != nil {
+				log.Printf("error: %s", err)
+			}
+		case <-interrupt:
+			fatalOnErr(p.Flush())
+			return
+		}
+	}
+}
+
 // NOTE: If this returns err the files aren't closed. That's kewl, the program
 // is about to exit anyway.
 func openFiles(filenames []string) io.Reader {
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/blinsay/ktk/consumer"
+	"github.com/blinsay/ktk/kcl"
+)
+
+var checkpointsFlags = flag.NewFlagSet("checkpoints", flag.ContinueOnError)
+
+var checkpointsSet stringsFlag
+
+func init() {
+	checkpointsFlags.Var(&checkpointsSet, "set", "set a shard's checkpoint with shard=seq, shard=trim-horizon or shard=latest. may be repeated")
+}
+
+var checkpointsCommand = &Command{
+	Name:  "checkpoints",
+	Usage: "checkpoints app-name [--set shard=seq|trim-horizon|latest]...",
+	Short: "Show or rewind a KCL application's checkpoints",
+	Description: `
+	Print every lease in the DynamoDB lease table of the Kinesis Client Library
+	application app-name, showing each shard's checkpoint, the worker that
+	holds its lease, and the lease counter.
+
+	With --set, change a shard's checkpoint before printing. The checkpoint can
+	be a sequence number, trim-horizon, or latest. Workers holding a changed
+	lease lose it, and whichever worker takes it next resumes from the new
+	checkpoint. Only shards that already have a lease can be changed. --set can
+	be given more than once.
+
+	Requests go to the DynamoDB endpoint for --region, or to
+	--dynamodb-endpoint-url if it's set.
+	`,
+	Flags: checkpointsFlags,
+	Run:   runCheckpoints,
+}
+
+// A flag that can be given more than once.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func runCheckpoints(args []string) {
+	if len(args) < 1 {
+		log.Fatalln("error: an application name is required")
+	}
+
+	table := kcl.New(args[0], dynamoDBConfig())
+
+	// check every --set before changing anything
+	checkpoints := make(map[string]string)
+	var shards []string
+	for _, set := range checkpointsSet {
+		shard, seq, err := parseCheckpoint(set)
+		fatalOnErr(err)
+		if _, ok := checkpoints[shard]; !ok {
+			shards = append(shards, shard)
+		}
+		checkpoints[shard] = seq
+	}
+
+	for _, shard := range shards {
+		fatalOnErr(table.SetCheckpoint(shard, checkpoints[shard]))
+		if verbose {
+			log.Printf("set %s to %s", shard, checkpoints[shard])
+		}
+	}
+
+	leases, err := table.Leases()
+	fatalOnErr(err)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "leaseKey\tcheckpoint\towner\tcounter\n")
+	for _, l := range leases {
+		owner := l.Owner
+		if owner == "" {
+			owner = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", l.ShardId, l.Checkpoint, owner, l.Counter)
+	}
+	w.Flush()
+}
+
+// Parse a shard=checkpoint pair. The checkpoint may be a sequence number,
+// trim-horizon or latest.
+func parseCheckpoint(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid checkpoint %q: expected shard=seq, shard=trim-horizon or shard=latest", s)
+	}
+
+	shard, seq := parts[0], parts[1]
+	switch seq {
+	case "trim-horizon":
+		return shard, *consumer.TRIM_HORIZON, nil
+	case "latest":
+		return shard, *consumer.LATEST, nil
+	}
+
+	for _, c := range seq {
+		if c < '0' || c > '9' {
+			return "", "", fmt.Errorf("invalid checkpoint %q: %q isn't a sequence number", s, seq)
+		}
+	}
+	return shard, seq, nil
+}
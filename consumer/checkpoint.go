@@ -0,0 +1,130 @@
+package consumer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The checkpoint recorded for a shard that has been read to the end. Matches
+// the sentinel the KCL uses.
+const SHARD_END = "SHARD_END"
+
+// A Checkpointer saves and restores a Consumer's position in each shard so that
+// consumption can resume where it left off.
+//
+// Checkpointers are called concurrently from multiple shard consumers.
+type Checkpointer interface {
+	// Return the last checkpointed sequence number for shard, SHARD_END if the
+	// shard was read to completion, or "" if there is no checkpoint.
+	Checkpoint(shard string) (string, error)
+	// Record that every record up to and including seq has been processed.
+	SetCheckpoint(shard, seq string) error
+}
+
+// An in-memory Checkpointer. Useful for tests and for consumers that only need
+// to remember their position for as long as the process lives.
+type MemoryCheckpointer struct {
+	sync.Mutex
+	checkpoints map[string]string
+}
+
+func NewMemoryCheckpointer() *MemoryCheckpointer {
+	return &MemoryCheckpointer{checkpoints: make(map[string]string)}
+}
+
+func (m *MemoryCheckpointer) Checkpoint(shard string) (string, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.checkpoints[shard], nil
+}
+
+func (m *MemoryCheckpointer) SetCheckpoint(shard, seq string) error {
+	m.Lock()
+	defer m.Unlock()
+	m.checkpoints[shard] = seq
+	return nil
+}
+
+// A Checkpointer that keeps checkpoints in a JSON file, mapping shard ids to
+// sequence numbers. The whole file is rewritten on every checkpoint, so this
+// is best suited to streams with a modest number of shards.
+type FileCheckpointer struct {
+	sync.Mutex
+
+	path        string
+	checkpoints map[string]string
+}
+
+// Load checkpoints from the file at path. A missing file is treated as having
+// no checkpoints and will be created on the first call to SetCheckpoint.
+func NewFileCheckpointer(path string) (*FileCheckpointer, error) {
+	f := &FileCheckpointer{
+		path:        path,
+		checkpoints: make(map[string]string),
+	}
+
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bs, &f.checkpoints); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileCheckpointer) Checkpoint(shard string) (string, error) {
+	f.Lock()
+	defer f.Unlock()
+	return f.checkpoints[shard], nil
+}
+
+func (f *FileCheckpointer) SetCheckpoint(shard, seq string) error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.checkpoints[shard] = seq
+	return f.save()
+}
+
+// Write checkpoints out atomically. Callers must hold the lock.
+func (f *FileCheckpointer) save() error {
+	bs, err := json.MarshalIndent(f.checkpoints, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(f.path, bs)
+}
+
+// WriteFileAtomic writes data to a temp file next to path and renames it into
+// place, so a crash never leaves a half-written file behind. The file is only
+// readable by the current user.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
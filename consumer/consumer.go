@@ -1,7 +1,10 @@
 package consumer
 
 import (
+	"context"
+	"errors"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -13,53 +16,169 @@ import (
 // for a stream. This func will be called concurrently from multiple goroutines.
 type Processor func([]*kinesis.Record)
 
-type kinesisClient interface {
+// Like a Processor, but also given the id of the shard the records came from.
+// Calls for a single shard are never concurrent.
+type ShardProcessor func(shard string, records []*kinesis.Record)
+
+// Like a ShardProcessor, but able to fail. A batch that returns an error is
+// retried with backoff until it succeeds, or until it's handed to a failure
+// handler, and the shard's checkpoint never moves past a batch that hasn't been
+// handled. ctx is cancelled when the shard consumer is stopped because its
+// lease was lost or the Consumer was closed.
+type BatchProcessor func(ctx context.Context, shard string, records []*kinesis.Record) error
+
+// Called with a batch that has failed processing. Returning nil gives up on
+// the batch and moves on to the rest of the shard. Returning an error keeps
+// retrying it.
+type FailureHandler func(shard string, records []*kinesis.Record, err error) error
+
+// The parts of the Kinesis API a Consumer uses. Satisfied by *kinesis.Kinesis
+// and *kinesistest.Kinesis.
+type KinesisClient interface {
 	DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error)
 	GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error)
 	GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error)
 }
 
-// A consumer consumes a Kinesis stream from LATEST on every shard. Consumers
-// should be created with Tail - the zero value is non-functional.
+// A consumer consumes a Kinesis stream from LATEST or TRIM_HORIZON on every
+// shard. Consumers should be created with Tail or Start - the zero value is
+// non-functional.
 //
-// Consumers are designed to be used in `ktk tail` where streams are consumed
-// until the process ends. This means they totally ignore checkpoints, can't
-// start anywhere but LATEST on every shard, and can't be shutdown cleanly.
+// Consumers are designed to be used in `ktk` commands where streams are
+// consumed until the process ends or Close is called. Progress is only
+// checkpointed if a Checkpointer is given with WithCheckpointer, or if shards
+// are divided between workers with WithLeases.
 type Consumer struct {
-	stream    *string
-	client    kinesisClient
-	processor Processor
+	stream       *string
+	from         *string
+	config       *aws.Config
+	client       KinesisClient
+	processor    BatchProcessor
+	checkpointer Checkpointer
+	manual       bool
+	hooks        ShardHooks
 
 	debug bool
 
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	failureAttempts int
+	failureHandler  FailureHandler
+
+	pollInterval    time.Duration
+	maxIdleInterval time.Duration
+	limit           int64
+	catchUp         bool
+
+	leaseStore   LeaseStore
+	workerId     string
+	leaseTimeout time.Duration
+	leases       *coordinator
+
+	runningLock sync.Mutex
+	running     map[string]*runningShard
+	closed      bool
+
 	complete   chan string
 	waiterFunc func() waiter
+
+	statsLock sync.Mutex
+	stats     map[string]*shardStats
+	now       func() time.Time
 }
 
 // Start a consumer at the given Stream's LATEST and process each shard with
 // processor.
 //
-// Each shard will be processed in an individual goroutine.
-func Tail(stream string, debug bool, processor Processor) error {
+// Each shard will be processed in an individual goroutine. The returned
+// Consumer can be used to check on progress with Stats.
+func Tail(stream string, debug bool, processor Processor, opts ...Option) (*Consumer, error) {
+	return Start(stream, LATEST, debug, processor, opts...)
+}
+
+// Start a consumer at either LATEST or TRIM_HORIZON and process each shard
+// with processor. When starting from TRIM_HORIZON, every shard still in the
+// stream's retention period is read, parents before their children.
+//
+// Shards with a checkpoint are read from just after the checkpoint instead.
+func Start(stream string, from *string, debug bool, processor Processor, opts ...Option) (*Consumer, error) {
+	return StartShards(stream, from, debug, func(_ string, records []*kinesis.Record) {
+		processor(records)
+	}, opts...)
+}
+
+// Start a consumer the same way as Start, processing each shard with a
+// ShardProcessor.
+func StartShards(stream string, from *string, debug bool, processor ShardProcessor, opts ...Option) (*Consumer, error) {
+	return StartBatches(stream, from, debug, func(_ context.Context, shard string, records []*kinesis.Record) error {
+		processor(shard, records)
+		return nil
+	}, opts...)
+}
+
+// Start a consumer the same way as Start, processing each shard with a
+// BatchProcessor. Records are delivered at least once: a batch that fails is
+// retried, and a batch that was being processed when the consumer stopped is
+// read again by whichever consumer picks up the shard next.
+func StartBatches(stream string, from *string, debug bool, processor BatchProcessor, opts ...Option) (*Consumer, error) {
 	c := &Consumer{
 		stream:    aws.String(stream),
-		client:    kinesis.New(nil),
+		from:      from,
 		processor: processor,
 
 		debug: debug,
 
+		pollInterval:    DefaultPollInterval,
+		maxIdleInterval: DefaultMaxIdleInterval,
+		catchUp:         true,
+		leaseTimeout:    DefaultLeaseTimeout,
+		retryBackoff:    DefaultRetryBackoff,
+		maxRetryBackoff: DefaultMaxRetryBackoff,
+
 		complete:   make(chan string),
 		waiterFunc: func() waiter { return &realWaiter{} },
+		now:        time.Now,
 	}
 
-	return c.tail()
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.maxIdleInterval < c.pollInterval {
+		c.maxIdleInterval = c.pollInterval
+	}
+	if c.maxRetryBackoff < c.retryBackoff {
+		c.maxRetryBackoff = c.retryBackoff
+	}
+
+	if c.client == nil {
+		c.client = kinesis.New(c.config)
+	}
+
+	if c.leaseStore != nil {
+		c.leases = newCoordinator(c, c.leaseStore, c.workerId, c.leaseTimeout)
+		c.checkpointer = c.leases
+	}
+
+	if err := c.tail(); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
-// Start consuming the stream from LATEST and pass every consumed record to
-// processor. Resharding will be handled automatically.
+// Start consuming the stream and pass every consumed record to processor.
+// Resharding will be handled automatically.
 //
 // Consumption and processing happens in multiple goroutines in the background.
 func (c *Consumer) tail() error {
+	if c.leases != nil {
+		if err := c.leases.step(); err != nil {
+			return err
+		}
+		go c.leases.run()
+		return nil
+	}
+
 	shards, err := c.listShards()
 	if err != nil {
 		return err
@@ -67,46 +186,345 @@ func (c *Consumer) tail() error {
 
 	go c.monitor()
 
-	for _, id := range withNoChildren(shards) {
-		c.startShardConsumer(id, LATEST, c.processor)
+	from, start := LATEST, withNoChildren(shards)
+	if c.from != nil && *c.from == *TRIM_HORIZON {
+		from, start = TRIM_HORIZON, withNoParents(shards)
+	}
+
+	for _, id := range start {
+		c.startShardConsumer(id, from, c.processor)
 	}
 
 	return nil
 }
 
+// An Option configures a Consumer.
+type Option func(*Consumer)
+
+// Checkpoint after every batch of records is processed, and resume each shard
+// from its last checkpoint.
+func WithCheckpointer(checkpointer Checkpointer) Option {
+	return func(c *Consumer) {
+		c.checkpointer = checkpointer
+	}
+}
+
+// Don't checkpoint after every batch. The processor decides when records are
+// done with and checkpoints them with Consumer.Checkpoint. Shards that are read
+// to the end are still checkpointed at SHARD_END.
+func WithManualCheckpoints() Option {
+	return func(c *Consumer) {
+		c.manual = true
+	}
+}
+
+// Functions called as each shard consumer starts and stops. Both are called
+// from the shard's goroutine, so calls for a shard never overlap with each
+// other or with calls to the processor.
+type ShardHooks struct {
+	// Called before any records are read from shard. from is the checkpoint
+	// the shard is resuming after, or LATEST or TRIM_HORIZON.
+	Start func(shard, from string)
+	// Called when the consumer stops reading shard. ended is true if the shard
+	// was read to the end, and false if it was stopped early because its
+	// lease was lost or the Consumer was closed. Shards that are read to the
+	// end are checkpointed at SHARD_END after Stop returns.
+	Stop func(shard string, ended bool)
+}
+
+// Call hooks as shard consumers start and stop.
+func WithShardHooks(hooks ShardHooks) Option {
+	return func(c *Consumer) {
+		c.hooks = hooks
+	}
+}
+
+// Create the Consumer's Kinesis client with the given AWS config instead of
+// the SDK defaults.
+func WithConfig(config *aws.Config) Option {
+	return func(c *Consumer) {
+		c.config = config
+	}
+}
+
+// Use the given Kinesis client instead of creating one. Takes precedence over
+// WithConfig.
+func WithClient(client KinesisClient) Option {
+	return func(c *Consumer) {
+		c.client = client
+	}
+}
+
+// Divide the stream's shards between every Consumer sharing store, each with a
+// unique worker id. Leases are taken from workers that stop renewing them,
+// rebalanced as workers come and go and as shards split and merge, and double
+// as checkpoints so a worker taking over a shard resumes where the last owner
+// left off. Replaces any Checkpointer.
+//
+// Starting from LATEST or TRIM_HORIZON only applies the first time a stream's
+// leases are created.
+func WithLeases(store LeaseStore, workerId string) Option {
+	return func(c *Consumer) {
+		c.leaseStore = store
+		c.workerId = workerId
+	}
+}
+
+// Take over leases that haven't been renewed in timeout. Leases are renewed a
+// few times per timeout. Defaults to DefaultLeaseTimeout.
+func WithLeaseTimeout(timeout time.Duration) Option {
+	return func(c *Consumer) {
+		c.leaseTimeout = timeout
+	}
+}
+
+// The default time between GetRecords calls on a shard that's caught up.
+const DefaultPollInterval = time.Second
+
+// The default longest time between GetRecords calls on an idle shard.
+const DefaultMaxIdleInterval = 5 * time.Second
+
+// Wait interval between GetRecords calls on a shard that has caught up to the
+// tip of the stream. Kinesis allows 5 reads per second per shard, shared
+// between every consumer of a stream.
+func WithPollInterval(interval time.Duration) Option {
+	return func(c *Consumer) {
+		c.pollInterval = interval
+	}
+}
+
+// While a shard is idle (caught up and getting no new records), double the
+// time between GetRecords calls after every empty response, up to max. A max
+// no greater than the poll interval disables idle backoff.
+func WithMaxIdleInterval(max time.Duration) Option {
+	return func(c *Consumer) {
+		c.maxIdleInterval = max
+	}
+}
+
+// Ask for at most limit records in each GetRecords call. 0 uses the Kinesis
+// default of 10,000.
+func WithLimit(limit int64) Option {
+	return func(c *Consumer) {
+		c.limit = limit
+	}
+}
+
+// Call GetRecords back-to-back, without waiting for the poll interval, while a
+// shard is behind the tip of the stream. Enabled by default.
+func WithCatchUp(enabled bool) Option {
+	return func(c *Consumer) {
+		c.catchUp = enabled
+	}
+}
+
+// The default wait before retrying a batch that failed processing.
+const DefaultRetryBackoff = 250 * time.Millisecond
+
+// The default longest wait between retries of a batch that keeps failing.
+const DefaultMaxRetryBackoff = 10 * time.Second
+
+// Wait initial before retrying a batch a BatchProcessor failed, doubling the
+// wait after every failure up to max.
+func WithRetryBackoff(initial, max time.Duration) Option {
+	return func(c *Consumer) {
+		c.retryBackoff = initial
+		c.maxRetryBackoff = max
+	}
+}
+
+// Hand a batch to handler once a BatchProcessor has failed it attempts times,
+// instead of retrying it forever. Use it to set aside records that can never
+// be processed, e.g. by writing them to a dead letter stream.
+func WithFailureHandler(attempts int, handler FailureHandler) Option {
+	return func(c *Consumer) {
+		c.failureAttempts = attempts
+		c.failureHandler = handler
+	}
+}
+
 var LATEST = aws.String(kinesis.ShardIteratorTypeLatest)
 var TRIM_HORIZON = aws.String(kinesis.ShardIteratorTypeTrimHorizon)
+var AFTER_SEQUENCE_NUMBER = aws.String(kinesis.ShardIteratorTypeAfterSequenceNumber)
+
+// A shard consumer's goroutine. stop asks it to exit after the batch it's
+// processing, cancelling the batch's context, and done is closed once it has.
+type runningShard struct {
+	stop     chan struct{}
+	done     chan struct{}
+	cancel   context.CancelFunc
+	stopOnce sync.Once
+}
 
-func (c *Consumer) startShardConsumer(shard string, iterType *string, processor Processor) {
-	s := &shardConsumer{
-		client:    c.client,
-		stream:    c.stream,
-		shard:     aws.String(shard),
-		debug:     c.debug,
-		processor: processor,
+func (r *runningShard) signal() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		r.cancel()
+	})
+}
+
+// Start consuming a shard in the background, unless it's already being
+// consumed or the Consumer has been closed.
+func (c *Consumer) startShardConsumer(shard string, iterType *string, processor BatchProcessor) {
+	c.runningLock.Lock()
+	defer c.runningLock.Unlock()
 
+	if c.running == nil {
+		c.running = make(map[string]*runningShard)
+	}
+	if c.closed || c.running[shard] != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runningShard{stop: make(chan struct{}), done: make(chan struct{}), cancel: cancel}
+	c.running[shard] = r
+
+	s := &shardConsumer{
+		client:       c.client,
+		stream:       c.stream,
+		shard:        aws.String(shard),
+		debug:        c.debug,
+		processor:    processor,
+		checkpointer: c.checkpointer,
+		manual:       c.manual,
+		hooks:        c.hooks,
+		stats:        c.statsFor(shard),
+
+		pollInterval:    c.pollInterval,
+		maxIdleInterval: c.maxIdleInterval,
+		limit:           c.limit,
+		catchUp:         c.catchUp,
+
+		retryBackoff:    c.retryBackoff,
+		maxRetryBackoff: c.maxRetryBackoff,
+		failureAttempts: c.failureAttempts,
+		failureHandler:  c.failureHandler,
+
+		ctx:      ctx,
 		waiter:   c.waiterFunc(),
+		stop:     r.stop,
 		complete: c.complete,
 	}
 
 	go func() {
-		s.init(iterType)
-		s.consume()
+		defer c.exited(shard, r)
+		defer cancel()
+
+		if ok, ended := s.init(iterType); ended || (ok && s.consume()) {
+			s.finish()
+			return
+		}
+		c.dropStats(shard)
 	}()
 }
 
+func (c *Consumer) exited(shard string, r *runningShard) {
+	c.runningLock.Lock()
+	defer c.runningLock.Unlock()
+
+	delete(c.running, shard)
+	close(r.done)
+}
+
+func (c *Consumer) isRunning(shard string) bool {
+	c.runningLock.Lock()
+	defer c.runningLock.Unlock()
+	return c.running[shard] != nil
+}
+
+// Ask a shard consumer to stop without waiting for it.
+func (c *Consumer) stopShard(shard string) {
+	c.runningLock.Lock()
+	defer c.runningLock.Unlock()
+
+	if r := c.running[shard]; r != nil {
+		r.signal()
+	}
+}
+
+// Stop reading a single shard, for when its records can't be processed. The
+// Stop hook is called as if the shard's lease had been lost. With leases, the
+// lease is given up once the shard has stopped, so any worker, including this
+// one, can take it and start the shard again from its checkpoint. Without
+// leases the shard isn't read again.
+func (c *Consumer) Release(shard string) {
+	c.runningLock.Lock()
+	r := c.running[shard]
+	c.runningLock.Unlock()
+
+	if r == nil {
+		return
+	}
+	r.signal()
+
+	if c.leases != nil {
+		go func() {
+			<-r.done
+			if err := c.leases.release(shard); err != nil {
+				log.Printf("error: releasing lease on %s: %s", shard, err)
+			}
+		}()
+	}
+}
+
+// Checkpoint shard at seq. Only needed with WithManualCheckpoints. Returns
+// ErrLeaseLost if the shard's lease has been taken by another worker.
+func (c *Consumer) Checkpoint(shard, seq string) error {
+	if c.checkpointer == nil {
+		return errNoCheckpointer
+	}
+	return c.checkpointer.SetCheckpoint(shard, seq)
+}
+
+var errNoCheckpointer = errors.New("consumer: no Checkpointer or leases to checkpoint with")
+
+// Stop consuming. Close waits for every shard to finish processing and
+// checkpointing the batch of records it's working on, so the processor must
+// keep running until Close returns. The context passed to a BatchProcessor is
+// cancelled, so a batch that's being retried is abandoned. With leases, every
+// lease this Consumer holds is then released so other workers can take over its
+// shards right away instead of waiting for the lease timeout.
+func (c *Consumer) Close() error {
+	c.runningLock.Lock()
+	c.closed = true
+	var running []*runningShard
+	for _, r := range c.running {
+		r.signal()
+		running = append(running, r)
+	}
+	c.runningLock.Unlock()
+
+	for _, r := range running {
+		<-r.done
+	}
+
+	if c.leases != nil {
+		return c.leases.close()
+	}
+	return nil
+}
+
+func (c *Consumer) log(fmt string, args ...interface{}) {
+	if c.debug {
+		log.Printf(fmt, args...)
+	}
+}
+
 // shard monitor
 
 func (c *Consumer) monitor() {
+	finished := make(map[string]bool)
 	for {
 		completeShard := <-c.complete
+		finished[completeShard] = true
 
 		shards, err := c.listShards()
 		maybePanic(err)
 
-		for _, s := range c.nextShards(completeShard, shards) {
+		for _, s := range nextShards(completeShard, finished, shards) {
 			c.startShardConsumer(*s.ShardId, TRIM_HORIZON, c.processor)
 		}
+		c.closeStats(completeShard)
 	}
 }
 
@@ -132,15 +550,32 @@ func (s *stubWaiter) wait(duration time.Duration) <-chan time.Time {
 // shard consumer
 
 type shardConsumer struct {
-	client    kinesisClient
-	stream    *string
-	shard     *string
-	processor Processor
-	debug     bool
+	client       KinesisClient
+	stream       *string
+	shard        *string
+	processor    BatchProcessor
+	checkpointer Checkpointer
+	manual       bool
+	hooks        ShardHooks
+	debug        bool
+	stats        *shardStats
+
+	pollInterval    time.Duration
+	maxIdleInterval time.Duration
+	limit           int64
+	catchUp         bool
+
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	failureAttempts int
+	failureHandler  FailureHandler
 
 	iterator *string
+	idleWait time.Duration
 
+	ctx      context.Context
 	waiter   waiter
+	stop     chan struct{}
 	complete chan string
 }
 
@@ -156,32 +591,114 @@ func (s *shardConsumer) log(fmt string, args ...interface{}) {
 	}
 }
 
-func (s *shardConsumer) init(iterType *string) {
-	s.log("%s: starting consumer at %s", *s.shard, *iterType)
-
-	resp, err := s.client.GetShardIterator(&kinesis.GetShardIteratorInput{
+// Get a shard iterator, starting after the shard's checkpoint if there is one
+// or at iterType if there isn't. Returns ok if the shard is ready to read.
+// Otherwise ended is true if the shard has already been checkpointed as read
+// to the end, and false if the shard's lease was lost or the consumer was
+// stopped first.
+func (s *shardConsumer) init(iterType *string) (ok, ended bool) {
+	input := &kinesis.GetShardIteratorInput{
 		StreamName:        s.stream,
 		ShardId:           s.shard,
 		ShardIteratorType: iterType,
-	})
+	}
+
+	if s.checkpointer != nil {
+		seq, loaded := s.loadCheckpoint()
+		if !loaded {
+			return false, false
+		}
+
+		switch seq {
+		case "":
+		case *LATEST, *TRIM_HORIZON:
+			input.ShardIteratorType = aws.String(seq)
+		case SHARD_END:
+			s.log("%s: already read to the end", *s.shard)
+			return false, true
+		default:
+			input.ShardIteratorType = AFTER_SEQUENCE_NUMBER
+			input.StartingSequenceNumber = aws.String(seq)
+		}
+	}
 
+	s.log("%s: starting consumer at %s", *s.shard, *input.ShardIteratorType)
+
+	resp, err := s.client.GetShardIterator(input)
 	maybePanic(err)
+
 	s.iterator = resp.ShardIterator
+	if s.hooks.Start != nil {
+		from := *input.ShardIteratorType
+		if input.StartingSequenceNumber != nil {
+			from = *input.StartingSequenceNumber
+		}
+		s.hooks.Start(*s.shard, from)
+	}
+	return true, false
+}
+
+// Load the shard's checkpoint, retrying with backoff if the checkpointer
+// fails. Returns false if the shard's lease was lost or the consumer was
+// stopped first.
+func (s *shardConsumer) loadCheckpoint() (string, bool) {
+	backoff := s.retryBackoff
+
+	for {
+		seq, err := s.checkpointer.Checkpoint(*s.shard)
+		if err == nil {
+			return seq, true
+		}
+		if err == ErrLeaseLost {
+			s.log("%s: lease lost, stopping", *s.shard)
+			return "", false
+		}
+
+		log.Printf("error: %s: loading checkpoint failed: %s. retrying in %dms", *s.shard, err, int64(backoff/time.Millisecond))
+		if !s.sleep(backoff) {
+			return "", false
+		}
+		backoff = maybeDouble(backoff, s.maxRetryBackoff)
+	}
 }
 
-func (s *shardConsumer) consume() {
+// Read the shard until it ends or the consumer is stopped, and checkpoint it
+// at SHARD_END if it ends. Returns true if the shard was read to the end.
+func (s *shardConsumer) consume() bool {
+	ended := s.read()
+	if s.hooks.Stop != nil {
+		s.hooks.Stop(*s.shard, ended)
+	}
+
+	if ended && s.checkpointer != nil {
+		return s.setCheckpoint(SHARD_END)
+	}
+	return ended
+}
+
+func (s *shardConsumer) read() bool {
 	waitTime := 250 * time.Millisecond
 	maxWaitTime := 10 * time.Second
 
+	s.idleWait = s.pollInterval
+
 	for {
-		resp, err := s.client.GetRecords(&kinesis.GetRecordsInput{
-			ShardIterator: s.iterator,
-		})
+		if s.stopped() {
+			return false
+		}
+
+		input := &kinesis.GetRecordsInput{ShardIterator: s.iterator}
+		if s.limit > 0 {
+			input.Limit = aws.Int64(s.limit)
+		}
+		resp, err := s.client.GetRecords(input)
 
 		if err != nil {
-			if throughputExceeded(err) {
+			if ThroughputExceeded(err) {
 				s.log("%s: throughput exceeded. backing off for %dms\n", *s.shard, int64(waitTime/time.Millisecond))
-				<-s.waiter.wait(waitTime)
+				if !s.sleep(waitTime) {
+					return false
+				}
 
 				waitTime = maybeDouble(waitTime, maxWaitTime)
 				continue
@@ -194,13 +711,128 @@ func (s *shardConsumer) consume() {
 
 		s.iterator = resp.NextShardIterator
 		s.log("%s: processing %d records\n", *s.shard, len(resp.Records))
-		s.processor(resp.Records)
+		if !s.process(resp.Records) || !s.checkpoint(resp.Records) {
+			return false
+		}
+		s.stats.update(resp)
 
 		if s.iterator == nil {
 			break
 		}
+
+		if delay := s.pollDelay(resp); delay > 0 && !s.sleep(delay) {
+			return false
+		}
+	}
+	return true
+}
+
+// Process a batch, retrying it with backoff until it succeeds or the failure
+// handler gives up on it. Returns false if the consumer is stopped first, with
+// the batch left unhandled.
+func (s *shardConsumer) process(records []*kinesis.Record) bool {
+	backoff := s.retryBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := s.processor(s.ctx, *s.shard, records)
+		if err == nil {
+			return true
+		}
+		if s.stopped() {
+			return false
+		}
+
+		if s.failureHandler != nil && attempt >= s.failureAttempts {
+			log.Printf("error: %s: processing failed %d times, handing %d records to the failure handler: %s", *s.shard, attempt, len(records), err)
+			if err = s.failureHandler(*s.shard, records, err); err == nil {
+				return true
+			}
+		}
+
+		log.Printf("error: %s: processing failed: %s. retrying in %dms", *s.shard, err, int64(backoff/time.Millisecond))
+		if !s.sleep(backoff) {
+			return false
+		}
+		backoff = maybeDouble(backoff, s.maxRetryBackoff)
+	}
+}
+
+func (s *shardConsumer) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait for d, returning false if the consumer is stopped first.
+func (s *shardConsumer) sleep(d time.Duration) bool {
+	select {
+	case <-s.waiter.wait(d):
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+// How long to wait before the next GetRecords call. Polls back-to-back while
+// the shard is behind, waits for the poll interval once it's caught up, and
+// backs off further for as long as it stays idle.
+func (s *shardConsumer) pollDelay(resp *kinesis.GetRecordsOutput) time.Duration {
+	behind := aws.Int64Value(resp.MillisBehindLatest) > 0
+
+	switch {
+	case behind && s.catchUp:
+		s.idleWait = s.pollInterval
+		return 0
+	case !behind && len(resp.Records) == 0:
+		wait := s.idleWait
+		s.idleWait = maybeDouble(s.idleWait, s.maxIdleInterval)
+		return wait
+	default:
+		s.idleWait = s.pollInterval
+		return s.pollInterval
+	}
+}
+
+// Checkpoint at the last of the given records. Returns false if the shard's
+// lease has been lost and the consumer should stop.
+func (s *shardConsumer) checkpoint(records []*kinesis.Record) bool {
+	if s.checkpointer == nil || s.manual || len(records) == 0 {
+		return true
+	}
+
+	return s.setCheckpoint(*records[len(records)-1].SequenceNumber)
+}
+
+// Checkpoint the shard at seq, retrying with backoff if the checkpointer
+// fails. Returns false if the shard's lease was lost or the consumer was
+// stopped first.
+func (s *shardConsumer) setCheckpoint(seq string) bool {
+	backoff := s.retryBackoff
+
+	for {
+		err := s.checkpointer.SetCheckpoint(*s.shard, seq)
+		if err == nil {
+			return true
+		}
+		if err == ErrLeaseLost {
+			s.log("%s: lease lost, stopping", *s.shard)
+			return false
+		}
+
+		log.Printf("error: %s: checkpointing at %s failed: %s. retrying in %dms", *s.shard, seq, err, int64(backoff/time.Millisecond))
+		if !s.sleep(backoff) {
+			return false
+		}
+		backoff = maybeDouble(backoff, s.maxRetryBackoff)
 	}
+}
 
+// Mark the shard as complete so that the Consumer can move on to its children.
+// The shard's stats are closed once its children have been started.
+func (s *shardConsumer) finish() {
 	s.complete <- *s.shard
 }
 
@@ -212,7 +844,9 @@ func maybeDouble(current, max time.Duration) time.Duration {
 	return next
 }
 
-func throughputExceeded(err error) bool {
+// ThroughputExceeded returns true if err is a Kinesis error for exceeding a
+// shard's provisioned throughput.
+func ThroughputExceeded(err error) bool {
 	if err == nil {
 		return false
 	}
@@ -227,13 +861,19 @@ func throughputExceeded(err error) bool {
 
 // getting and filtering shards
 
+// Return every shard in the stream, open or closed.
+func (c *Consumer) Shards() ([]*kinesis.Shard, error) {
+	return c.listShards()
+}
+
 func (c *Consumer) listShards() ([]*kinesis.Shard, error) {
 	var shards []*kinesis.Shard
-	for {
-		resp, err := c.client.DescribeStream(&kinesis.DescribeStreamInput{
-			StreamName: c.stream,
-		})
+	input := &kinesis.DescribeStreamInput{
+		StreamName: c.stream,
+	}
 
+	for {
+		resp, err := c.client.DescribeStream(input)
 		if err != nil {
 			return nil, err
 		}
@@ -242,9 +882,10 @@ func (c *Consumer) listShards() ([]*kinesis.Shard, error) {
 			shards = append(shards, shard)
 		}
 
-		if !*resp.StreamDescription.HasMoreShards {
+		if !*resp.StreamDescription.HasMoreShards || len(shards) == 0 {
 			break
 		}
+		input.ExclusiveStartShardId = shards[len(shards)-1].ShardId
 	}
 	return shards, nil
 }
@@ -271,10 +912,44 @@ func withNoChildren(shards []*kinesis.Shard) []string {
 	return shardIds
 }
 
-func (c *Consumer) nextShards(finished string, shards []*kinesis.Shard) []*kinesis.Shard {
+// Return the ids of every shard whose parents have aged out of the stream.
+func withNoParents(shards []*kinesis.Shard) []string {
+	exists := make(map[string]bool)
+	for _, s := range shards {
+		exists[*s.ShardId] = true
+	}
+
+	var shardIds []string
+	for _, s := range shards {
+		if s.ParentShardId != nil && exists[*s.ParentShardId] {
+			continue
+		}
+		if s.AdjacentParentShardId != nil && exists[*s.AdjacentParentShardId] {
+			continue
+		}
+		shardIds = append(shardIds, *s.ShardId)
+	}
+
+	return shardIds
+}
+
+// Return the children of the shard that just completed that are ready to be
+// read. A merged shard isn't ready until both of its parents are finished or
+// have aged out of the stream.
+func nextShards(completed string, finished map[string]bool, shards []*kinesis.Shard) []*kinesis.Shard {
+	exists := make(map[string]bool)
+	for _, s := range shards {
+		exists[*s.ShardId] = true
+	}
+	done := func(parent *string) bool {
+		return parent == nil || finished[*parent] || !exists[*parent]
+	}
+
 	var next []*kinesis.Shard
 	for _, s := range shards {
-		if s.ParentShardId != nil && finished == *s.ParentShardId {
+		isChild := (s.ParentShardId != nil && *s.ParentShardId == completed) ||
+			(s.AdjacentParentShardId != nil && *s.AdjacentParentShardId == completed)
+		if isChild && done(s.ParentShardId) && done(s.AdjacentParentShardId) {
 			next = append(next, s)
 		}
 	}
@@ -1,14 +1,23 @@
 package consumer
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/kinesistest"
 )
 
 var (
@@ -117,8 +126,530 @@ func TestConsume(t *testing.T) {
 	}
 }
 
+// test that a consumer with a checkpointer skips shards that were already read
+// to the end and checkpoints every shard it finishes.
+func TestCheckpoints(t *testing.T) {
+	descriptions := [][]shard{
+		{
+			{id: "shard-01", closed: true},
+			{id: "shard-02", parentOne: "shard-01"},
+			{id: "shard-03", parentOne: "shard-01"},
+		},
+	}
+	data := map[string][]string{
+		"shard-01": {"twinkle", "twinkle"},
+		"shard-02": {"hey", "there", "lil", "fella"},
+		"shard-03": {"nah"},
+	}
+
+	checkpointer := NewMemoryCheckpointer()
+	checkpointer.SetCheckpoint("shard-01", SHARD_END)
+
+	consumed := make(chan string)
+	c := consumerWith(descriptions, data, func(records []*kinesis.Record) {
+		for _, record := range records {
+			consumed <- string(record.Data)
+		}
+	})
+	c.from = TRIM_HORIZON
+	c.checkpointer = checkpointer
+
+	c.tail()
+	actualRecords := takeTimes(5, consumed)
+	waitForClosed(c, 3)
+
+	expectedRecords := []string{"fella", "hey", "lil", "nah", "there"}
+	sort.Sort(sort.StringSlice(actualRecords))
+	if !reflect.DeepEqual(actualRecords, expectedRecords) {
+		t.Errorf("expected records %v, got %v", expectedRecords, actualRecords)
+	}
+
+	for _, id := range []string{"shard-01", "shard-02", "shard-03"} {
+		if seq, _ := checkpointer.Checkpoint(id); seq != SHARD_END {
+			t.Errorf("expected %s to be checkpointed at SHARD_END, got %q", id, seq)
+		}
+	}
+}
+
+// test that a checkpointer that fails is retried instead of stopping the
+// consumer.
+func TestCheckpointErrorsRetried(t *testing.T) {
+	data := map[string][]string{
+		"shard-01": {"twinkle", "twinkle"},
+	}
+	checkpointer := &flakyCheckpointer{Checkpointer: NewMemoryCheckpointer(), failures: 2}
+
+	consumed := make(chan string)
+	c := consumerWith([][]shard{{{id: "shard-01", closed: true}}}, data, func(records []*kinesis.Record) {
+		for _, record := range records {
+			consumed <- string(record.Data)
+		}
+	})
+	c.from = TRIM_HORIZON
+	c.checkpointer = checkpointer
+
+	c.tail()
+	takeTimes(2, consumed)
+	waitForClosed(c, 1)
+
+	if seq, _ := checkpointer.Checkpoint("shard-01"); seq != SHARD_END {
+		t.Errorf("expected shard-01 to be checkpointed at SHARD_END, got %q", seq)
+	}
+}
+
+// test that a shard whose lease is lost before it starts reading is stopped
+// instead of bringing down the consumer.
+func TestLeaseLostBeforeStart(t *testing.T) {
+	data := map[string][]string{
+		"shard-01": {"twinkle", "twinkle"},
+	}
+
+	c := consumerWith([][]shard{{{id: "shard-01"}}}, data, func(records []*kinesis.Record) {
+		t.Errorf("expected no records, got %d", len(records))
+	})
+	c.checkpointer = lostLeases{}
+
+	c.tail()
+	deadline := time.Now().Add(time.Second)
+	for c.isRunning("shard-01") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if c.isRunning("shard-01") {
+		t.Fatal("expected shard-01 to stop")
+	}
+	if stats := c.Stats(); len(stats) != 0 {
+		t.Errorf("expected no stats for a shard that never started, got %+v", stats)
+	}
+}
+
+func TestFileCheckpointer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ktk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checkpoints.json")
+	checkpointer, err := NewFileCheckpointer(path)
+	if err != nil {
+		t.Fatalf("expected a missing file to be ok. got '%s'", err)
+	}
+
+	checkpointer.SetCheckpoint("shard-01", "123")
+	checkpointer.SetCheckpoint("shard-02", SHARD_END)
+
+	reloaded, err := NewFileCheckpointer(path)
+	if err != nil {
+		t.Fatalf("unexpected error reloading checkpoints: %s", err)
+	}
+
+	expected := map[string]string{"shard-01": "123", "shard-02": SHARD_END, "shard-03": ""}
+	for shard, seq := range expected {
+		if actual, _ := reloaded.Checkpoint(shard); actual != seq {
+			t.Errorf("expected %s to be checkpointed at %q, got %q", shard, seq, actual)
+		}
+	}
+}
+
+// test reading a resharded stream from a fake, in order, from the oldest
+// shards to the newest.
+func TestConsumeResharded(t *testing.T) {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(defaultStream), ShardCount: aws.Int64(2)})
+
+	putAll := func(from, to int) {
+		for i := from; i < to; i++ {
+			_, err := fake.PutRecord(&kinesis.PutRecordInput{
+				StreamName:   aws.String(defaultStream),
+				PartitionKey: aws.String(fmt.Sprintf("key-%d", i%5)),
+				Data:         []byte(fmt.Sprint(i)),
+			})
+			if err != nil {
+				t.Fatalf("unexpected error putting records: %s", err)
+			}
+		}
+	}
+
+	putAll(0, 20)
+	shards, _ := fake.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String(defaultStream)})
+	first := shards.StreamDescription.Shards[0]
+	start, _ := new(big.Int).SetString(*first.HashKeyRange.StartingHashKey, 10)
+	end, _ := new(big.Int).SetString(*first.HashKeyRange.EndingHashKey, 10)
+	mid := new(big.Int).Rsh(new(big.Int).Add(start, end), 1)
+	fake.SplitShard(&kinesis.SplitShardInput{
+		StreamName:         aws.String(defaultStream),
+		ShardToSplit:       first.ShardId,
+		NewStartingHashKey: aws.String(mid.String()),
+	})
+	putAll(20, 40)
+
+	consumed := make(chan *kinesis.Record, 40)
+	_, err := Start(defaultStream, TRIM_HORIZON, false, func(records []*kinesis.Record) {
+		for _, r := range records {
+			consumed <- r
+		}
+	}, WithClient(fake))
+	if err != nil {
+		t.Fatalf("unexpected error starting consumer: %s", err)
+	}
+
+	// records with the same key must arrive in the order they were put
+	last := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		var r *kinesis.Record
+		select {
+		case r = <-consumed:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after reading %d records", i)
+		}
+
+		n, _ := strconv.Atoi(string(r.Data))
+		if prev, ok := last[*r.PartitionKey]; ok && prev > n {
+			t.Errorf("%s: read record %d after %d", *r.PartitionKey, n, prev)
+		}
+		last[*r.PartitionKey] = n
+	}
+}
+
+func TestPollDelay(t *testing.T) {
+	s := &shardConsumer{pollInterval: time.Second, maxIdleInterval: 4 * time.Second, catchUp: true}
+	s.idleWait = s.pollInterval
+
+	behind := &kinesis.GetRecordsOutput{Records: makeRecords("a"), MillisBehindLatest: aws.Int64(1000)}
+	caughtUp := &kinesis.GetRecordsOutput{Records: makeRecords("a"), MillisBehindLatest: aws.Int64(0)}
+	idle := &kinesis.GetRecordsOutput{MillisBehindLatest: aws.Int64(0)}
+
+	steps := []struct {
+		resp     *kinesis.GetRecordsOutput
+		expected time.Duration
+	}{
+		{behind, 0},
+		{caughtUp, time.Second},
+		{idle, time.Second},
+		{idle, 2 * time.Second},
+		{idle, 4 * time.Second},
+		{idle, 4 * time.Second},
+		{caughtUp, time.Second},
+		{idle, time.Second},
+		{behind, 0},
+		{idle, time.Second},
+	}
+
+	for i, step := range steps {
+		if actual := s.pollDelay(step.resp); actual != step.expected {
+			t.Errorf("step %d: expected to wait %s, got %s", i, step.expected, actual)
+		}
+	}
+
+	s.catchUp = false
+	if actual := s.pollDelay(behind); actual != time.Second {
+		t.Errorf("expected to wait for the poll interval without catch-up, got %s", actual)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(defaultStream), ShardCount: aws.Int64(1)})
+	for i := 0; i < 10; i++ {
+		fake.PutRecord(&kinesis.PutRecordInput{
+			StreamName:   aws.String(defaultStream),
+			PartitionKey: aws.String(defaultPartitionKey),
+			Data:         []byte(fmt.Sprint(i)),
+		})
+	}
+
+	batches := make(chan int, 10)
+	_, err := Start(defaultStream, TRIM_HORIZON, false, func(records []*kinesis.Record) {
+		if len(records) > 0 {
+			batches <- len(records)
+		}
+	}, WithClient(fake), WithLimit(3), WithPollInterval(time.Millisecond))
+	if err != nil {
+		t.Fatalf("unexpected error starting consumer: %s", err)
+	}
+
+	for read := 0; read < 10; {
+		select {
+		case n := <-batches:
+			if n > 3 {
+				t.Errorf("expected batches of at most 3 records, got %d", n)
+			}
+			read += n
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after reading %d records", read)
+		}
+	}
+}
+
+// test that hooks are called around a shard's records, and that manual
+// checkpoints are the only checkpoints.
+func TestShardHooks(t *testing.T) {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(defaultStream), ShardCount: aws.Int64(1)})
+	for i := 0; i < 3; i++ {
+		fake.PutRecord(&kinesis.PutRecordInput{
+			StreamName:   aws.String(defaultStream),
+			PartitionKey: aws.String(defaultPartitionKey),
+			Data:         []byte(fmt.Sprint(i)),
+		})
+	}
+
+	var lock sync.Mutex
+	var events []string
+	event := func(e string) {
+		lock.Lock()
+		defer lock.Unlock()
+		events = append(events, e)
+	}
+
+	checkpointer := NewMemoryCheckpointer()
+	records := make(chan *kinesis.Record, 3)
+	start := func() *Consumer {
+		c, err := StartShards(defaultStream, TRIM_HORIZON, false, func(shard string, rs []*kinesis.Record) {
+			if len(rs) > 0 {
+				event("records")
+			}
+			for _, r := range rs {
+				records <- r
+			}
+		},
+			WithClient(fake),
+			WithCheckpointer(checkpointer),
+			WithManualCheckpoints(),
+			WithPollInterval(time.Millisecond),
+			WithShardHooks(ShardHooks{
+				Start: func(shard, from string) { event("start " + from) },
+				Stop:  func(shard string, ended bool) { event(fmt.Sprint("stop ", ended)) },
+			}),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error starting consumer: %s", err)
+		}
+		return c
+	}
+
+	c := start()
+	var last *kinesis.Record
+	for i := 0; i < 3; i++ {
+		select {
+		case last = <-records:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out after reading %d records", i)
+		}
+	}
+	if seq, _ := checkpointer.Checkpoint("shardId-000000000000"); seq != "" {
+		t.Errorf("expected no automatic checkpoints, got %s", seq)
+	}
+	if err := c.Checkpoint("shardId-000000000000", *last.SequenceNumber); err != nil {
+		t.Fatalf("unexpected error checkpointing: %s", err)
+	}
+	c.Close()
+
+	c = start()
+	time.Sleep(10 * time.Millisecond)
+	c.Close()
+
+	expected := []string{"start TRIM_HORIZON", "records", "stop false", "start " + *last.SequenceNumber, "stop false"}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
+
+// test that a failed batch is retried and only checkpointed once it succeeds.
+func TestBatchRetries(t *testing.T) {
+	fake := fakeWithRecords(3)
+	checkpointer := NewMemoryCheckpointer()
+
+	attempts := make(chan string, 10)
+	failures := 2
+	c, err := StartBatches(defaultStream, TRIM_HORIZON, false, func(ctx context.Context, shard string, rs []*kinesis.Record) error {
+		if len(rs) == 0 {
+			return nil
+		}
+		seq, _ := checkpointer.Checkpoint(shard)
+		attempts <- seq
+		if failures > 0 {
+			failures--
+			return errors.New("downstream unavailable")
+		}
+		return nil
+	},
+		WithClient(fake),
+		WithCheckpointer(checkpointer),
+		WithPollInterval(time.Millisecond),
+		WithRetryBackoff(time.Millisecond, 2*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error starting consumer: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case seq := <-attempts:
+			if seq != "" {
+				t.Errorf("expected no checkpoint before the batch succeeded, got %s on attempt %d", seq, i+1)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for attempt %d", i+1)
+		}
+	}
+	waitForCheckpoint(checkpointer, "shardId-000000000000")
+	c.Close()
+
+	if seq, _ := checkpointer.Checkpoint("shardId-000000000000"); seq == "" {
+		t.Errorf("expected a checkpoint after the batch succeeded")
+	}
+	if len(attempts) != 0 {
+		t.Errorf("expected the batch to stop being retried once it succeeded")
+	}
+}
+
+// test that a batch that keeps failing goes to the failure handler, and the
+// shard moves on.
+func TestFailureHandler(t *testing.T) {
+	fake := fakeWithRecords(3)
+	checkpointer := NewMemoryCheckpointer()
+
+	var lock sync.Mutex
+	attempts := 0
+	failed := make(chan []*kinesis.Record, 1)
+	c, err := StartBatches(defaultStream, TRIM_HORIZON, false, func(ctx context.Context, shard string, rs []*kinesis.Record) error {
+		if len(rs) == 0 {
+			return nil
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		return errors.New("bad records")
+	},
+		WithClient(fake),
+		WithCheckpointer(checkpointer),
+		WithPollInterval(time.Millisecond),
+		WithRetryBackoff(time.Millisecond, time.Millisecond),
+		WithFailureHandler(2, func(shard string, rs []*kinesis.Record, err error) error {
+			failed <- rs
+			return nil
+		}),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error starting consumer: %s", err)
+	}
+	defer c.Close()
+
+	var records []*kinesis.Record
+	select {
+	case records = <-failed:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the failure handler")
+	}
+	if len(records) != 3 {
+		t.Errorf("expected the failure handler to get 3 records, got %d", len(records))
+	}
+
+	lock.Lock()
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts before the failure handler, got %d", attempts)
+	}
+	lock.Unlock()
+
+	if seq := waitForCheckpoint(checkpointer, "shardId-000000000000"); seq != *records[2].SequenceNumber {
+		t.Errorf("expected a checkpoint past the failed batch, got %q", seq)
+	}
+}
+
+// test that closing a consumer cancels a batch that's being retried, and that
+// the batch isn't checkpointed.
+func TestCloseCancelsBatch(t *testing.T) {
+	fake := fakeWithRecords(1)
+	checkpointer := NewMemoryCheckpointer()
+
+	processing := make(chan struct{}, 1)
+	c, err := StartBatches(defaultStream, TRIM_HORIZON, false, func(ctx context.Context, shard string, rs []*kinesis.Record) error {
+		if len(rs) == 0 {
+			return nil
+		}
+		select {
+		case processing <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	},
+		WithClient(fake),
+		WithCheckpointer(checkpointer),
+		WithPollInterval(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error starting consumer: %s", err)
+	}
+
+	select {
+	case <-processing:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for the batch")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("expected Close to cancel the batch")
+	}
+
+	if seq, _ := checkpointer.Checkpoint("shardId-000000000000"); seq != "" {
+		t.Errorf("expected no checkpoint for a cancelled batch, got %s", seq)
+	}
+}
+
 // helpers
 
+// Wait for shard to be checkpointed and return the checkpoint.
+func waitForCheckpoint(checkpointer Checkpointer, shard string) string {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if seq, _ := checkpointer.Checkpoint(shard); seq != "" {
+			return seq
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return ""
+}
+
+// A single shard stream with n records in it.
+func fakeWithRecords(n int) *kinesistest.Kinesis {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(defaultStream), ShardCount: aws.Int64(1)})
+	for i := 0; i < n; i++ {
+		fake.PutRecord(&kinesis.PutRecordInput{
+			StreamName:   aws.String(defaultStream),
+			PartitionKey: aws.String(defaultPartitionKey),
+			Data:         []byte(fmt.Sprint(i)),
+		})
+	}
+	return fake
+}
+
+// Wait for n shards to be read to the end.
+func waitForClosed(c *Consumer, n int) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		closed := 0
+		for _, s := range c.Stats() {
+			if s.Closed {
+				closed++
+			}
+		}
+		if closed == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
 func getRecords(m map[string][]string) []string {
 	var records []string
 
@@ -139,10 +670,13 @@ func takeTimes(n int, ch chan string) []string {
 
 func consumerWith(descriptions [][]shard, data map[string][]string, processor Processor) *Consumer {
 	return &Consumer{
-		stream:     aws.String(defaultStream),
-		client:     &StubClient{describe: descriptions, records: data},
-		complete:   make(chan string),
-		processor:  processor,
+		stream:   aws.String(defaultStream),
+		client:   &StubClient{describe: descriptions, records: data},
+		complete: make(chan string),
+		processor: func(_ context.Context, _ string, records []*kinesis.Record) error {
+			processor(records)
+			return nil
+		},
 		waiterFunc: func() waiter { return &stubWaiter{} },
 	}
 }
@@ -254,3 +788,253 @@ func makeRecords(s string) []*kinesis.Record {
 		SequenceNumber: &defaultSequenceNumber,
 	}}
 }
+
+// test that consumers track per-shard stats as they read.
+func TestStats(t *testing.T) {
+	data := map[string][]string{
+		"shard-01": {"twinkle", "twinkle"},
+		"shard-02": {"nah"},
+	}
+
+	consumed := make(chan string)
+	c := consumerWith([][]shard{{{id: "shard-01"}, {id: "shard-02"}}}, data, func(records []*kinesis.Record) {
+		for _, record := range records {
+			consumed <- string(record.Data)
+		}
+	})
+
+	c.tail()
+	takeTimes(3, consumed)
+	waitForClosed(c, 2)
+
+	expected := []ShardStats{
+		{ShardId: "shard-01", MillisBehindLatest: 123, Records: 2, Bytes: 14, Closed: true},
+		{ShardId: "shard-02", MillisBehindLatest: 123, Records: 1, Bytes: 3, Closed: true},
+	}
+
+	stats := c.Stats()
+	for i := range stats {
+		if stats[i].LastRead.IsZero() {
+			t.Errorf("expected %s to have been read", stats[i].ShardId)
+		}
+		stats[i].RecordsPerSecond, stats[i].BytesPerSecond = 0, 0
+		stats[i].LastRead = time.Time{}
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf(`expected stats not equal to actual stats
+
+		actual:   %+v
+		expected: %+v`, stats, expected)
+	}
+}
+
+// test that rates only include samples from the rate window.
+func TestStatsRates(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newShardStats("shard-01", func() time.Time { return now })
+
+	s.update(&kinesis.GetRecordsOutput{Records: makeRecords("old")})
+	now = now.Add(rateWindow + time.Second)
+	s.update(&kinesis.GetRecordsOutput{Records: makeRecords("twinkle")})
+
+	snapshot := s.snapshot()
+	if snapshot.Records != 2 || snapshot.Bytes != 10 {
+		t.Errorf("expected 2 records and 10 bytes total, got %d and %d", snapshot.Records, snapshot.Bytes)
+	}
+
+	expectedRate := 7 / rateWindow.Seconds()
+	if snapshot.BytesPerSecond != expectedRate {
+		t.Errorf("expected %f bytes/s, got %f", expectedRate, snapshot.BytesPerSecond)
+	}
+}
+
+// test that a shard that's been read to the end keeps a consumer from being
+// caught up until it's moved on to the shard's children.
+func TestCaughtUp(t *testing.T) {
+	c := &Consumer{}
+	if c.CaughtUp() {
+		t.Error("expected a consumer with no shards not to be caught up")
+	}
+
+	iterator := aws.String("iterator")
+	parent := c.statsFor("shard-01")
+	parent.update(&kinesis.GetRecordsOutput{MillisBehindLatest: aws.Int64(0), NextShardIterator: iterator})
+	if !c.CaughtUp() {
+		t.Error("expected a consumer at the tip of the stream to be caught up")
+	}
+
+	parent.update(&kinesis.GetRecordsOutput{MillisBehindLatest: aws.Int64(0)})
+	if c.CaughtUp() {
+		t.Error("expected a shard that was read to the end not to be caught up")
+	}
+
+	child := c.statsFor("shard-02")
+	c.closeStats("shard-01")
+	if c.CaughtUp() {
+		t.Error("expected a child that hasn't been read not to be caught up")
+	}
+
+	child.update(&kinesis.GetRecordsOutput{MillisBehindLatest: aws.Int64(0), NextShardIterator: iterator})
+	if !c.CaughtUp() {
+		t.Error("expected a consumer to be caught up once the child was read")
+	}
+}
+
+// test that rates for a shard that just started are averaged over the time
+// it's been read for, not the whole window.
+func TestStatsRatesJustStarted(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newShardStats("shard-01", func() time.Time { return now })
+
+	now = now.Add(2 * time.Second)
+	s.update(&kinesis.GetRecordsOutput{Records: makeRecords("twinkle")})
+
+	snapshot := s.snapshot()
+	if snapshot.RecordsPerSecond != 0.5 {
+		t.Errorf("expected 0.5 records/s, got %f", snapshot.RecordsPerSecond)
+	}
+	if snapshot.BytesPerSecond != 3.5 {
+		t.Errorf("expected 3.5 bytes/s, got %f", snapshot.BytesPerSecond)
+	}
+}
+
+// test that a merged shard isn't read until both of its parents have been
+// read to the end.
+func TestConsumeMerge(t *testing.T) {
+	descriptions := [][]shard{
+		{
+			{id: "shard-01"},
+			{id: "shard-02"},
+		},
+		{
+			{id: "shard-01", closed: true},
+			{id: "shard-02", closed: true},
+			{id: "shard-03", parentOne: "shard-01", parentTwo: "shard-02"},
+		},
+	}
+	data := map[string][]string{
+		"shard-01": {"twinkle"},
+		"shard-02": {"hey", "there", "lil", "fella"},
+		"shard-03": {"nah"},
+	}
+
+	consumed := make(chan string)
+	c := consumerWith(descriptions, data, func(records []*kinesis.Record) {
+		for _, record := range records {
+			consumed <- string(record.Data)
+		}
+	})
+
+	c.tail()
+	actualRecords := takeTimes(6, consumed)
+	if last := actualRecords[len(actualRecords)-1]; last != "nah" {
+		t.Errorf("expected the merged shard to be read last, got records %v", actualRecords)
+	}
+}
+
+func TestNextShards(t *testing.T) {
+	shards := shardsToAws(
+		shard{id: "shard-01"},
+		shard{id: "shard-02"},
+		shard{id: "shard-03", parentOne: "shard-01"},
+		shard{id: "shard-04", parentOne: "shard-01"},
+		shard{id: "shard-05", parentOne: "shard-03", parentTwo: "shard-04"},
+		shard{id: "shard-06", parentOne: "shard-00", parentTwo: "shard-02"},
+	)
+
+	testCases := []struct {
+		name      string
+		completed string
+		finished  []string
+		expected  []string
+	}{
+		{
+			name:      "split",
+			completed: "shard-01",
+			expected:  []string{"shard-03", "shard-04"},
+		},
+		{
+			name:      "merge with one parent finished",
+			completed: "shard-03",
+			expected:  nil,
+		},
+		{
+			name:      "merge with both parents finished",
+			completed: "shard-04",
+			finished:  []string{"shard-03"},
+			expected:  []string{"shard-05"},
+		},
+		{
+			name:      "merge with a parent that aged out",
+			completed: "shard-02",
+			expected:  []string{"shard-06"},
+		},
+	}
+
+	for _, tc := range testCases {
+		finished := map[string]bool{tc.completed: true}
+		for _, id := range tc.finished {
+			finished[id] = true
+		}
+
+		var actual []string
+		for _, s := range nextShards(tc.completed, finished, shards) {
+			actual = append(actual, *s.ShardId)
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestWithNoParents(t *testing.T) {
+	shards := shardsToAws(
+		shard{id: "shard-01", parentOne: "shard-00"},
+		shard{id: "shard-02"},
+		shard{id: "shard-03", parentOne: "shard-01"},
+		shard{id: "shard-04", parentOne: "shard-01", parentTwo: "shard-02"},
+	)
+
+	expected := []string{"shard-01", "shard-02"}
+	if actual := withNoParents(shards); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+// A Checkpointer that fails its first few calls.
+type flakyCheckpointer struct {
+	Checkpointer
+
+	sync.Mutex
+	failures int
+}
+
+func (f *flakyCheckpointer) fail() error {
+	f.Lock()
+	defer f.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("checkpoints unavailable")
+	}
+	return nil
+}
+
+func (f *flakyCheckpointer) Checkpoint(shard string) (string, error) {
+	if err := f.fail(); err != nil {
+		return "", err
+	}
+	return f.Checkpointer.Checkpoint(shard)
+}
+
+func (f *flakyCheckpointer) SetCheckpoint(shard, seq string) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.Checkpointer.SetCheckpoint(shard, seq)
+}
+
+// A Checkpointer for a worker that holds no leases.
+type lostLeases struct{}
+
+func (lostLeases) Checkpoint(string) (string, error)  { return "", ErrLeaseLost }
+func (lostLeases) SetCheckpoint(string, string) error { return ErrLeaseLost }
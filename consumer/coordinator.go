@@ -0,0 +1,378 @@
+package consumer
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// The default time a lease can go without being renewed before other workers
+// decide its owner is gone and take it over.
+const DefaultLeaseTimeout = 10 * time.Second
+
+// A coordinator divides a stream's shards between every worker sharing a
+// LeaseStore. Every worker tries to hold an equal share of the shards that are
+// ready to be read, taking unowned and expired leases first and stealing from
+// the busiest worker if there aren't any.
+//
+// A coordinator is also the Consumer's Checkpointer. Checkpoints are written to
+// the shard's lease, and fail with ErrLeaseLost once another worker has taken
+// the lease.
+type coordinator struct {
+	sync.Mutex
+
+	consumer *Consumer
+	store    LeaseStore
+	worker   string
+	timeout  time.Duration
+
+	// Leases this worker holds, as they were last written.
+	held map[string]*Lease
+	// The last counter seen on every lease, and when it was first seen. A
+	// lease is expired once its counter hasn't changed for the timeout.
+	seen map[string]observation
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type observation struct {
+	counter int64
+	at      time.Time
+}
+
+func newCoordinator(c *Consumer, store LeaseStore, worker string, timeout time.Duration) *coordinator {
+	return &coordinator{
+		consumer: c,
+		store:    store,
+		worker:   worker,
+		timeout:  timeout,
+		held:     make(map[string]*Lease),
+		seen:     make(map[string]observation),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Renew and take leases a few times per timeout, and immediately after a shard
+// has been read to the end so its children can be picked up.
+func (co *coordinator) run() {
+	defer close(co.done)
+
+	var ended []string
+	for {
+		select {
+		case shard := <-co.consumer.complete:
+			co.finished(shard)
+			ended = append(ended, shard)
+		case <-time.After(co.timeout / 3):
+		case <-co.stop:
+			return
+		}
+
+		if err := co.step(); err != nil {
+			log.Printf("error: coordinating leases: %s", err)
+			continue
+		}
+
+		// shards that ended only count as closed once their children have had
+		// a chance to be picked up.
+		for _, shard := range ended {
+			co.consumer.closeStats(shard)
+		}
+		ended = nil
+	}
+}
+
+func (co *coordinator) step() error {
+	shards, err := co.consumer.listShards()
+	if err != nil {
+		return err
+	}
+
+	if err := co.sync(shards); err != nil {
+		return err
+	}
+
+	co.renew()
+
+	leases, err := co.store.Leases()
+	if err != nil {
+		return err
+	}
+	co.take(leases, shards)
+	return nil
+}
+
+// Create a lease for every shard that doesn't have one. When there are no
+// leases at all, the stream is new to this group of workers and leases start
+// at the Consumer's starting position: from TRIM_HORIZON every shard is read
+// from the start, children waiting on their parents, and from LATEST only the
+// open shards are read. Shards that appear later are new children, and are
+// read from the start.
+func (co *coordinator) sync(shards []*kinesis.Shard) error {
+	leases, err := co.store.Leases()
+	if err != nil {
+		return err
+	}
+
+	exists := make(map[string]bool)
+	for _, l := range leases {
+		exists[l.ShardId] = true
+	}
+
+	start := make(map[string]string)
+	switch {
+	case len(leases) > 0:
+	case co.consumer.from != nil && *co.consumer.from == *TRIM_HORIZON:
+		for _, s := range shards {
+			start[*s.ShardId] = *TRIM_HORIZON
+		}
+	default:
+		for _, id := range withNoChildren(shards) {
+			start[id] = *LATEST
+		}
+	}
+
+	for _, s := range shards {
+		if exists[*s.ShardId] {
+			continue
+		}
+
+		lease := &Lease{ShardId: *s.ShardId, Checkpoint: *TRIM_HORIZON}
+		if len(leases) == 0 {
+			lease.Checkpoint = SHARD_END
+			if from, ok := start[*s.ShardId]; ok {
+				lease.Checkpoint = from
+			}
+		}
+		if s.ParentShardId != nil {
+			lease.ParentShardIds = append(lease.ParentShardIds, *s.ParentShardId)
+		}
+		if s.AdjacentParentShardId != nil {
+			lease.ParentShardIds = append(lease.ParentShardIds, *s.AdjacentParentShardId)
+		}
+
+		if _, err := co.store.CreateLease(lease); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bump the counter on every lease this worker holds. Shards whose leases have
+// been taken by another worker are stopped.
+func (co *coordinator) renew() {
+	for _, shard := range co.leases() {
+		err := co.update(shard, func(*Lease) {})
+		switch err {
+		case nil:
+		case ErrLeaseLost:
+			co.consumer.log("%s: lease lost to another worker", shard)
+			co.consumer.stopShard(shard)
+		default:
+			log.Printf("error: renewing lease on %s: %s", shard, err)
+		}
+	}
+}
+
+// Take leases until this worker holds its share of the shards that are ready
+// to read. Shards are ready once every parent has been read to the end.
+func (co *coordinator) take(leases []*Lease, shards []*kinesis.Shard) {
+	co.Lock()
+	defer co.Unlock()
+
+	now := co.consumer.now()
+
+	open := make(map[string]bool)
+	for _, s := range shards {
+		open[*s.ShardId] = true
+	}
+
+	byShard := make(map[string]*Lease)
+	for _, l := range leases {
+		byShard[l.ShardId] = l
+
+		if o, ok := co.seen[l.ShardId]; !ok || o.counter != l.Counter {
+			co.seen[l.ShardId] = observation{l.Counter, now}
+		}
+	}
+
+	owned := map[string][]*Lease{co.worker: nil}
+	var ready, available []*Lease
+	for _, l := range leases {
+		if !open[l.ShardId] || l.Checkpoint == SHARD_END || !parentsFinished(l, byShard) {
+			continue
+		}
+		ready = append(ready, l)
+
+		switch {
+		case l.Owner == co.worker && co.held[l.ShardId] != nil:
+			owned[co.worker] = append(owned[co.worker], l)
+		case l.Owner == co.worker, l.Owner == "", now.Sub(co.seen[l.ShardId].at) >= co.timeout:
+			available = append(available, l)
+		default:
+			owned[l.Owner] = append(owned[l.Owner], l)
+		}
+	}
+
+	target := (len(ready) + len(owned) - 1) / len(owned)
+	needed := target - len(owned[co.worker])
+	if needed <= 0 {
+		return
+	}
+
+	for _, l := range available {
+		if needed == 0 {
+			return
+		}
+		if co.acquire(l) {
+			needed--
+		}
+	}
+	if len(available) > 0 {
+		return
+	}
+
+	// Nothing is free, so steal a single lease from the busiest worker if it
+	// has more than its share. Taking one at a time gives everyone else a
+	// chance to see the new balance before they steal too.
+	var busiest string
+	for worker, ls := range owned {
+		if worker == co.worker {
+			continue
+		}
+		if busiest == "" || len(ls) > len(owned[busiest]) || (len(ls) == len(owned[busiest]) && worker < busiest) {
+			busiest = worker
+		}
+	}
+	if busiest == "" {
+		return
+	}
+
+	most := len(owned[busiest])
+	if most > target || (most == target && needed > 1) {
+		co.acquire(owned[busiest][0])
+	}
+}
+
+func parentsFinished(l *Lease, leases map[string]*Lease) bool {
+	for _, id := range l.ParentShardIds {
+		if parent, ok := leases[id]; ok && parent.Checkpoint != SHARD_END {
+			return false
+		}
+	}
+	return true
+}
+
+// Take a lease and start consuming its shard. Returns false if another worker
+// got there first. Callers must hold the lock.
+func (co *coordinator) acquire(l *Lease) bool {
+	if co.consumer.isRunning(l.ShardId) {
+		return false
+	}
+
+	next := l.copy()
+	next.Owner = co.worker
+	next.Counter++
+
+	if err := co.store.UpdateLease(next, l.Counter); err != nil {
+		if err != ErrLeaseLost {
+			log.Printf("error: taking lease on %s: %s", l.ShardId, err)
+		}
+		return false
+	}
+
+	co.consumer.log("%s: took lease from %q", l.ShardId, l.Owner)
+	co.held[l.ShardId] = next
+	co.consumer.startShardConsumer(l.ShardId, TRIM_HORIZON, co.consumer.processor)
+	return true
+}
+
+// Apply fn to a held lease and write it back.
+func (co *coordinator) update(shard string, fn func(*Lease)) error {
+	co.Lock()
+	defer co.Unlock()
+
+	current, ok := co.held[shard]
+	if !ok {
+		return ErrLeaseLost
+	}
+
+	next := current.copy()
+	fn(next)
+	next.Counter++
+
+	if err := co.store.UpdateLease(next, current.Counter); err != nil {
+		if err == ErrLeaseLost {
+			delete(co.held, shard)
+		}
+		return err
+	}
+	co.held[shard] = next
+	return nil
+}
+
+// Stop renewing the lease on a shard that's been read to the end. The lease
+// stays checkpointed at SHARD_END so nobody reads it again.
+func (co *coordinator) finished(shard string) {
+	co.Lock()
+	defer co.Unlock()
+	delete(co.held, shard)
+}
+
+// Stop coordinating and give up every held lease, leaving the checkpoint
+// behind for the next owner.
+func (co *coordinator) close() error {
+	close(co.stop)
+	<-co.done
+
+	var firstErr error
+	for _, shard := range co.leases() {
+		if err := co.release(shard); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Give up a held lease, leaving the checkpoint behind for the next owner. A
+// lease that has already been lost is nothing to give up.
+func (co *coordinator) release(shard string) error {
+	err := co.update(shard, func(l *Lease) { l.Owner = "" })
+	co.finished(shard)
+
+	if err == ErrLeaseLost {
+		return nil
+	}
+	return err
+}
+
+func (co *coordinator) Checkpoint(shard string) (string, error) {
+	co.Lock()
+	defer co.Unlock()
+
+	l, ok := co.held[shard]
+	if !ok {
+		return "", ErrLeaseLost
+	}
+	return l.Checkpoint, nil
+}
+
+func (co *coordinator) SetCheckpoint(shard, seq string) error {
+	return co.update(shard, func(l *Lease) { l.Checkpoint = seq })
+}
+
+// Return the ids of the shards this worker holds leases on.
+func (co *coordinator) leases() []string {
+	co.Lock()
+	defer co.Unlock()
+
+	var shards []string
+	for shard := range co.held {
+		shards = append(shards, shard)
+	}
+	return shards
+}
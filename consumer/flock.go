@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package consumer
+
+import (
+	"os"
+	"syscall"
+)
+
+// Block until this process holds an exclusive lock on f. The lock is released
+// when f is closed, or when the process exits.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
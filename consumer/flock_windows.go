@@ -0,0 +1,16 @@
+package consumer
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoFileLocks = errors.New("file leases aren't supported on windows")
+
+func lockFile(f *os.File) error {
+	return errNoFileLocks
+}
+
+func unlockFile(f *os.File) error {
+	return errNoFileLocks
+}
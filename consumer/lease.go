@@ -0,0 +1,199 @@
+package consumer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Returned when a lease has been changed by another worker since it was last
+// read. The lease has either been stolen or taken over after it expired.
+var ErrLeaseLost = errors.New("lease lost")
+
+// A Lease gives a single worker the right to consume a shard and records how
+// far through the shard it's gotten. Leases mirror the KCL's lease table.
+type Lease struct {
+	ShardId string
+	// The worker that holds the lease, or "" if nobody does.
+	Owner string
+	// Incremented every time the lease changes. Workers renew their leases by
+	// bumping the counter, so a lease whose counter hasn't moved in a while
+	// belongs to a worker that's gone.
+	Counter int64
+	// A sequence number, SHARD_END, or LATEST or TRIM_HORIZON for a shard that
+	// hasn't been read from yet.
+	Checkpoint string
+	// The shards this shard was split or merged from. A shard isn't read until
+	// its parents have been read to the end.
+	ParentShardIds []string `json:",omitempty"`
+}
+
+func (l *Lease) copy() *Lease {
+	c := *l
+	c.ParentShardIds = append([]string(nil), l.ParentShardIds...)
+	return &c
+}
+
+// A LeaseStore is shared between every worker consuming a stream. Every change
+// is conditional on the lease's counter so that workers racing for the same
+// lease can't both win.
+//
+// LeaseStores are called concurrently from multiple goroutines.
+type LeaseStore interface {
+	// Return every lease.
+	Leases() ([]*Lease, error)
+	// Create a lease unless one already exists for its shard. Returns false if
+	// one did.
+	CreateLease(lease *Lease) (bool, error)
+	// Replace the lease for lease.ShardId if its counter is still counter.
+	// Returns ErrLeaseLost if it isn't.
+	UpdateLease(lease *Lease, counter int64) error
+}
+
+// An in-memory LeaseStore. Only useful for dividing a stream between
+// Consumers in the same process, and for tests.
+type MemoryLeaseStore struct {
+	sync.Mutex
+	leases map[string]*Lease
+}
+
+func NewMemoryLeaseStore() *MemoryLeaseStore {
+	return &MemoryLeaseStore{leases: make(map[string]*Lease)}
+}
+
+func (m *MemoryLeaseStore) Leases() ([]*Lease, error) {
+	m.Lock()
+	defer m.Unlock()
+	return sortedLeases(m.leases), nil
+}
+
+func (m *MemoryLeaseStore) CreateLease(lease *Lease) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	return createLease(m.leases, lease), nil
+}
+
+func (m *MemoryLeaseStore) UpdateLease(lease *Lease, counter int64) error {
+	m.Lock()
+	defer m.Unlock()
+	return updateLease(m.leases, lease, counter)
+}
+
+// A LeaseStore that keeps leases in a JSON file, for workers that share a
+// filesystem. Every change takes an exclusive lock on a second file next to it
+// (path + ".lock") so that processes never see each other's half-finished
+// writes.
+type FileLeaseStore struct {
+	sync.Mutex
+	path string
+}
+
+func NewFileLeaseStore(path string) *FileLeaseStore {
+	return &FileLeaseStore{path: path}
+}
+
+func (f *FileLeaseStore) Leases() ([]*Lease, error) {
+	var leases []*Lease
+	err := f.withLeases(func(m map[string]*Lease) (bool, error) {
+		leases = sortedLeases(m)
+		return false, nil
+	})
+	return leases, err
+}
+
+func (f *FileLeaseStore) CreateLease(lease *Lease) (bool, error) {
+	var created bool
+	err := f.withLeases(func(m map[string]*Lease) (bool, error) {
+		created = createLease(m, lease)
+		return created, nil
+	})
+	return created, err
+}
+
+func (f *FileLeaseStore) UpdateLease(lease *Lease, counter int64) error {
+	return f.withLeases(func(m map[string]*Lease) (bool, error) {
+		if err := updateLease(m, lease, counter); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// Lock the file, load every lease, and call fn. If fn returns true, save the
+// leases before unlocking.
+func (f *FileLeaseStore) withLeases(fn func(map[string]*Lease) (bool, error)) error {
+	f.Lock()
+	defer f.Unlock()
+
+	lock, err := os.OpenFile(f.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err := lockFile(lock); err != nil {
+		return err
+	}
+	defer unlockFile(lock)
+
+	leases := make(map[string]*Lease)
+	bs, err := ioutil.ReadFile(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(bs) > 0 {
+		if err := json.Unmarshal(bs, &leases); err != nil {
+			return err
+		}
+	}
+
+	changed, err := fn(leases)
+	if err != nil || !changed {
+		return err
+	}
+	return f.save(leases)
+}
+
+// Write leases out atomically. Callers must hold the file lock.
+func (f *FileLeaseStore) save(leases map[string]*Lease) error {
+	bs, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(f.path, bs)
+}
+
+func createLease(leases map[string]*Lease, lease *Lease) bool {
+	if _, ok := leases[lease.ShardId]; ok {
+		return false
+	}
+	leases[lease.ShardId] = lease.copy()
+	return true
+}
+
+func updateLease(leases map[string]*Lease, lease *Lease, counter int64) error {
+	current, ok := leases[lease.ShardId]
+	if !ok || current.Counter != counter {
+		return ErrLeaseLost
+	}
+	leases[lease.ShardId] = lease.copy()
+	return nil
+}
+
+func sortedLeases(leases map[string]*Lease) []*Lease {
+	sorted := make([]*Lease, 0, len(leases))
+	for _, l := range leases {
+		sorted = append(sorted, l.copy())
+	}
+	sort.Sort(byLeaseShardId(sorted))
+	return sorted
+}
+
+type byLeaseShardId []*Lease
+
+func (b byLeaseShardId) Len() int           { return len(b) }
+func (b byLeaseShardId) Less(i, j int) bool { return b[i].ShardId < b[j].ShardId }
+func (b byLeaseShardId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,308 @@
+package consumer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/kinesistest"
+)
+
+const testLeaseTimeout = 100 * time.Millisecond
+
+func TestLeaseStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ktk-leases")
+	if err != nil {
+		t.Fatalf("unexpected error creating temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stores := map[string]LeaseStore{
+		"memory": NewMemoryLeaseStore(),
+		"file":   NewFileLeaseStore(filepath.Join(dir, "leases.json")),
+	}
+
+	for name, store := range stores {
+		lease := &Lease{ShardId: "shard-1", Checkpoint: *LATEST}
+		if created, err := store.CreateLease(lease); !created || err != nil {
+			t.Fatalf("%s: expected to create a lease, got %v (%v)", name, created, err)
+		}
+		if created, err := store.CreateLease(lease); created || err != nil {
+			t.Errorf("%s: expected not to create a duplicate lease, got %v (%v)", name, created, err)
+		}
+
+		taken := &Lease{ShardId: "shard-1", Owner: "a", Counter: 1, Checkpoint: "123"}
+		if err := store.UpdateLease(taken, 0); err != nil {
+			t.Errorf("%s: unexpected error updating lease: %s", name, err)
+		}
+		if err := store.UpdateLease(&Lease{ShardId: "shard-1", Owner: "b", Counter: 1}, 0); err != ErrLeaseLost {
+			t.Errorf("%s: expected a stale update to fail with ErrLeaseLost, got %v", name, err)
+		}
+		if err := store.UpdateLease(&Lease{ShardId: "shard-2", Counter: 1}, 0); err != ErrLeaseLost {
+			t.Errorf("%s: expected updating a missing lease to fail with ErrLeaseLost, got %v", name, err)
+		}
+
+		store.CreateLease(&Lease{ShardId: "shard-0", Checkpoint: *TRIM_HORIZON})
+		leases, err := store.Leases()
+		if err != nil {
+			t.Fatalf("%s: unexpected error listing leases: %s", name, err)
+		}
+		expected := []*Lease{{ShardId: "shard-0", Checkpoint: *TRIM_HORIZON}, taken}
+		if !reflect.DeepEqual(leases, expected) {
+			t.Errorf("%s: expected %+v, got %+v", name, expected, leases)
+		}
+	}
+}
+
+// test that workers sharing a lease store split a stream's shards evenly, and
+// that a worker that closes hands its shards back.
+func TestLeasesDivideShards(t *testing.T) {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(defaultStream), ShardCount: aws.Int64(4)})
+	store := NewMemoryLeaseStore()
+
+	a := startWorker(t, fake, store, "a", func([]*kinesis.Record) {})
+	defer a.Close()
+	waitForOwners(t, store, map[string]int{"a": 4})
+
+	b := startWorker(t, fake, store, "b", func([]*kinesis.Record) {})
+	waitForOwners(t, store, map[string]int{"a": 2, "b": 2})
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("unexpected error closing worker: %s", err)
+	}
+	waitForOwners(t, store, map[string]int{"a": 4})
+}
+
+// test that leases held by a worker that stopped renewing them are taken over
+// once they've expired.
+func TestLeasesExpire(t *testing.T) {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(defaultStream), ShardCount: aws.Int64(2)})
+
+	store := NewMemoryLeaseStore()
+	for i := 0; i < 2; i++ {
+		store.CreateLease(&Lease{ShardId: fmt.Sprintf("shardId-%012d", i), Owner: "dead", Counter: 5, Checkpoint: *LATEST})
+	}
+
+	started := time.Now()
+	a := startWorker(t, fake, store, "a", func([]*kinesis.Record) {})
+	defer a.Close()
+
+	// until the leases expire, the dead worker looks alive and only has to give
+	// up its extra share
+	if owners := leaseOwners(store); !reflect.DeepEqual(owners, map[string]int{"a": 1, "dead": 1}) {
+		t.Errorf("expected a single lease to be stolen before they expire, got %v", owners)
+	}
+
+	waitForOwners(t, store, map[string]int{"a": 2})
+	if waited := time.Since(started); waited < testLeaseTimeout {
+		t.Errorf("expected leases to be taken after %s, took %s", testLeaseTimeout, waited)
+	}
+}
+
+// test that a worker taking over a shard picks up at the last owner's
+// checkpoint.
+func TestLeasesHandoff(t *testing.T) {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(defaultStream), ShardCount: aws.Int64(1)})
+	store := NewMemoryLeaseStore()
+
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			fake.PutRecord(&kinesis.PutRecordInput{
+				StreamName:   aws.String(defaultStream),
+				PartitionKey: aws.String(defaultPartitionKey),
+				Data:         []byte(fmt.Sprint(i)),
+			})
+		}
+	}
+
+	records := make(chan string, 20)
+	process := func(rs []*kinesis.Record) {
+		for _, r := range rs {
+			records <- string(r.Data)
+		}
+	}
+
+	put(0, 10)
+	a := startWorker(t, fake, store, "a", process)
+	readRecords(t, records, 0, 10)
+	if err := a.Close(); err != nil {
+		t.Fatalf("unexpected error closing worker: %s", err)
+	}
+
+	put(10, 20)
+	b := startWorker(t, fake, store, "b", process)
+	defer b.Close()
+	readRecords(t, records, 10, 20)
+
+	select {
+	case r := <-records:
+		t.Errorf("expected no records to be read twice, got %s", r)
+	case <-time.After(testLeaseTimeout):
+	}
+}
+
+// test that children of a split shard are read by whichever workers pick them
+// up, after their parent has been read to the end.
+func TestLeasesAfterSplit(t *testing.T) {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(defaultStream), ShardCount: aws.Int64(1)})
+	store := NewMemoryLeaseStore()
+
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			fake.PutRecord(&kinesis.PutRecordInput{
+				StreamName:   aws.String(defaultStream),
+				PartitionKey: aws.String(fmt.Sprintf("key-%d", i%5)),
+				Data:         []byte(fmt.Sprint(i)),
+			})
+		}
+	}
+
+	var lock sync.Mutex
+	last := make(map[string]int)
+	records := make(chan string, 40)
+	process := func(rs []*kinesis.Record) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		for _, r := range rs {
+			n, _ := strconv.Atoi(string(r.Data))
+			if prev, ok := last[*r.PartitionKey]; ok && prev > n {
+				t.Errorf("%s: read record %d after %d", *r.PartitionKey, n, prev)
+			}
+			last[*r.PartitionKey] = n
+			records <- string(r.Data)
+		}
+	}
+
+	put(0, 20)
+	a := startWorker(t, fake, store, "a", process)
+	defer a.Close()
+	b := startWorker(t, fake, store, "b", process)
+	defer b.Close()
+
+	mid := new(big.Int).Rsh(kinesistest.MaxHashKey, 1)
+	fake.SplitShard(&kinesis.SplitShardInput{
+		StreamName:         aws.String(defaultStream),
+		ShardToSplit:       aws.String("shardId-000000000000"),
+		NewStartingHashKey: aws.String(mid.String()),
+	})
+	put(20, 40)
+
+	readRecords(t, records, 0, 40)
+	waitForOwners(t, store, map[string]int{"a": 1, "b": 1})
+
+	leases, _ := store.Leases()
+	if leases[0].Checkpoint != SHARD_END {
+		t.Errorf("expected the parent to be checkpointed at the end, got %s", leases[0].Checkpoint)
+	}
+}
+
+// test that a worker starting from TRIM_HORIZON on a stream that has already
+// been resharded reads the parent and then its children.
+func TestLeasesSplitBeforeStart(t *testing.T) {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(defaultStream), ShardCount: aws.Int64(1)})
+	store := NewMemoryLeaseStore()
+
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			fake.PutRecord(&kinesis.PutRecordInput{
+				StreamName:   aws.String(defaultStream),
+				PartitionKey: aws.String(fmt.Sprintf("key-%d", i%5)),
+				Data:         []byte(fmt.Sprint(i)),
+			})
+		}
+	}
+
+	put(0, 10)
+	mid := new(big.Int).Rsh(kinesistest.MaxHashKey, 1)
+	fake.SplitShard(&kinesis.SplitShardInput{
+		StreamName:         aws.String(defaultStream),
+		ShardToSplit:       aws.String("shardId-000000000000"),
+		NewStartingHashKey: aws.String(mid.String()),
+	})
+	put(10, 20)
+
+	records := make(chan string, 20)
+	a := startWorker(t, fake, store, "a", func(rs []*kinesis.Record) {
+		for _, r := range rs {
+			records <- string(r.Data)
+		}
+	})
+	defer a.Close()
+
+	readRecords(t, records, 0, 20)
+	waitForOwners(t, store, map[string]int{"a": 2})
+}
+
+// helpers
+
+func startWorker(t *testing.T, fake *kinesistest.Kinesis, store LeaseStore, worker string, processor Processor) *Consumer {
+	c, err := Start(defaultStream, TRIM_HORIZON, false, processor,
+		WithClient(fake),
+		WithLeases(store, worker),
+		WithLeaseTimeout(testLeaseTimeout),
+		WithPollInterval(5*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error starting %s: %s", worker, err)
+	}
+	return c
+}
+
+// Count the open leases held by each worker.
+func leaseOwners(store LeaseStore) map[string]int {
+	leases, _ := store.Leases()
+
+	owners := make(map[string]int)
+	for _, l := range leases {
+		if l.Owner != "" && l.Checkpoint != SHARD_END {
+			owners[l.Owner]++
+		}
+	}
+	return owners
+}
+
+func waitForOwners(t *testing.T, store LeaseStore, expected map[string]int) {
+	deadline := time.Now().Add(20 * testLeaseTimeout)
+	for time.Now().Before(deadline) {
+		if reflect.DeepEqual(leaseOwners(store), expected) {
+			return
+		}
+		time.Sleep(testLeaseTimeout / 10)
+	}
+	t.Fatalf("expected leases to be held by %v, got %v", expected, leaseOwners(store))
+}
+
+// Read records until every record from..to has been seen.
+func readRecords(t *testing.T, records chan string, from, to int) {
+	expected := make(map[string]bool)
+	for i := from; i < to; i++ {
+		expected[fmt.Sprint(i)] = true
+	}
+
+	for len(expected) > 0 {
+		select {
+		case r := <-records:
+			if !expected[r] {
+				t.Errorf("unexpected record %s", r)
+			}
+			delete(expected, r)
+		case <-time.After(20 * testLeaseTimeout):
+			t.Fatalf("timed out waiting for records %v", expected)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package consumer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// The window that per-second rates are averaged over.
+const rateWindow = 10 * time.Second
+
+// A point-in-time snapshot of how a single shard consumer is doing.
+type ShardStats struct {
+	// The shard being consumed.
+	ShardId string
+	// MillisBehindLatest from the most recent GetRecords response.
+	MillisBehindLatest int64
+	// The age of the most recently read record, based on its approximate
+	// arrival time. Zero if no records have been read. This isn't lag: it keeps
+	// growing on a caught up shard that nothing is being written to. Use
+	// MillisBehindLatest for how far behind the shard is.
+	LastRecordAge time.Duration
+	// Records and bytes per second, averaged over the last few seconds.
+	RecordsPerSecond float64
+	BytesPerSecond   float64
+	// Total records and bytes read from the shard.
+	Records int64
+	Bytes   int64
+	// The time of the most recent GetRecords response. Zero if the shard
+	// hasn't been read from yet.
+	LastRead time.Time
+	// True once the shard has been read to the end and the Consumer has moved
+	// on to its children.
+	Closed bool
+}
+
+// A single GetRecords response, kept around to compute rates.
+type sample struct {
+	at      time.Time
+	records int64
+	bytes   int64
+}
+
+// Stats for a single shard. Updated by a shardConsumer and read by anyone
+// calling Consumer.Stats.
+type shardStats struct {
+	sync.Mutex
+
+	id                 string
+	millisBehindLatest int64
+	lastArrival        time.Time
+	lastRead           time.Time
+	records, bytes     int64
+	ended, closed      bool
+	samples            []sample
+	started            time.Time
+
+	now func() time.Time
+}
+
+func newShardStats(id string, now func() time.Time) *shardStats {
+	return &shardStats{id: id, now: now, started: now()}
+}
+
+func (s *shardStats) update(resp *kinesis.GetRecordsOutput) {
+	s.Lock()
+	defer s.Unlock()
+
+	if resp.MillisBehindLatest != nil {
+		s.millisBehindLatest = *resp.MillisBehindLatest
+	}
+
+	var bytes int64
+	for _, r := range resp.Records {
+		bytes += int64(len(r.Data))
+		if r.ApproximateArrivalTimestamp != nil {
+			s.lastArrival = *r.ApproximateArrivalTimestamp
+		}
+	}
+
+	s.ended = resp.NextShardIterator == nil
+	s.lastRead = s.now()
+	s.records += int64(len(resp.Records))
+	s.bytes += bytes
+	s.samples = append(s.samples, sample{s.lastRead, int64(len(resp.Records)), bytes})
+	s.trim()
+}
+
+func (s *shardStats) close() {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+}
+
+// Returns true if the shard has been read up to the tip of the stream. A shard
+// that has been read to the end isn't caught up until it's closed, since its
+// children may not have been started yet.
+func (s *shardStats) caughtUp() bool {
+	s.Lock()
+	defer s.Unlock()
+	return !s.ended && !s.lastRead.IsZero() && s.millisBehindLatest == 0
+}
+
+func (s *shardStats) isClosed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.closed
+}
+
+// Drop any samples that have fallen out of the rate window. Callers must hold
+// the lock.
+func (s *shardStats) trim() {
+	cutoff := s.now().Add(-rateWindow)
+
+	i := 0
+	for i < len(s.samples) && s.samples[i].at.Before(cutoff) {
+		i++
+	}
+	s.samples = s.samples[i:]
+}
+
+func (s *shardStats) snapshot() ShardStats {
+	s.Lock()
+	defer s.Unlock()
+
+	s.trim()
+
+	var records, bytes int64
+	for _, sample := range s.samples {
+		records += sample.records
+		bytes += sample.bytes
+	}
+
+	// a shard that started recently hasn't had a whole window to read in yet.
+	// rates are averaged over at least a second so they don't spike right
+	// after a shard starts.
+	window := s.now().Sub(s.started)
+	if window > rateWindow {
+		window = rateWindow
+	}
+	if window < time.Second {
+		window = time.Second
+	}
+	seconds := window.Seconds()
+
+	var age time.Duration
+	if !s.lastArrival.IsZero() {
+		age = s.now().Sub(s.lastArrival)
+	}
+
+	return ShardStats{
+		ShardId:            s.id,
+		MillisBehindLatest: s.millisBehindLatest,
+		LastRecordAge:      age,
+		RecordsPerSecond:   float64(records) / seconds,
+		BytesPerSecond:     float64(bytes) / seconds,
+		Records:            s.records,
+		Bytes:              s.bytes,
+		LastRead:           s.lastRead,
+		Closed:             s.closed,
+	}
+}
+
+// Return a snapshot of the stats for every shard this consumer has started
+// reading, sorted by shard id. Safe to call from any goroutine.
+func (c *Consumer) Stats() []ShardStats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	stats := make([]ShardStats, 0, len(c.stats))
+	for _, s := range c.stats {
+		stats = append(stats, s.snapshot())
+	}
+
+	sort.Sort(byShardId(stats))
+	return stats
+}
+
+// CaughtUp returns true if every open shard this consumer is reading has been
+// read up to the tip of the stream. Shards that are read to the end keep it
+// from being caught up until their children have been started, so a reshard
+// is never mistaken for the end of the stream. Safe to call from any
+// goroutine.
+func (c *Consumer) CaughtUp() bool {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	open := 0
+	for _, s := range c.stats {
+		if s.isClosed() {
+			continue
+		}
+		if !s.caughtUp() {
+			return false
+		}
+		open++
+	}
+	return open > 0
+}
+
+func (c *Consumer) statsFor(shard string) *shardStats {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+
+	if c.stats == nil {
+		c.stats = make(map[string]*shardStats)
+	}
+
+	now := c.now
+	if now == nil {
+		now = time.Now
+	}
+
+	s := newShardStats(shard, now)
+	c.stats[shard] = s
+	return s
+}
+
+// Mark a shard's stats closed once the Consumer has moved on to its children.
+func (c *Consumer) closeStats(shard string) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	if s, ok := c.stats[shard]; ok {
+		s.close()
+	}
+}
+
+// Forget a shard that this consumer stopped reading before the end.
+func (c *Consumer) dropStats(shard string) {
+	c.statsLock.Lock()
+	defer c.statsLock.Unlock()
+	delete(c.stats, shard)
+}
+
+type byShardId []ShardStats
+
+func (b byShardId) Len() int           { return len(b) }
+func (b byShardId) Less(i, j int) bool { return b[i].ShardId < b[j].ShardId }
+func (b byShardId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+	"github.com/blinsay/ktk/producer"
+)
+
+var cpFlags = flag.NewFlagSet("cp", flag.ContinueOnError)
+
+var (
+	cpFrom           = cpFlags.String("from", "trim-horizon", "where to start reading src: trim-horizon or latest")
+	cpUntil          = cpFlags.String("until", "", "don't copy records that arrived after this RFC3339 time")
+	cpFollow         = cpFlags.Bool("follow", false, "keep copying new records after catching up")
+	cpCheckpointFile = cpFlags.String("checkpoint", "", "save progress to this file and resume from it")
+	cpRate           = cpFlags.Float64("rate", 0, "the max records/s to write to dst. 0 is unlimited")
+	cpBandwidth      = cpFlags.Float64("bandwidth", 0, "the max bytes/s to write to dst. 0 is unlimited")
+)
+
+var cpCommand = &Command{
+	Name:  "cp",
+	Usage: "cp src dst [--from=trim-horizon] [--until=time] [--follow] [--checkpoint=file] [--rate=N] [--bandwidth=N]",
+	Short: "Copy data from one stream to another",
+	Description: `
+	Copy every record from the src stream to the dst stream, keeping each
+	record's partition key. --from may be trim-horizon or latest.
+
+	Without --follow, cp exits once it has copied everything up to the tip of
+	src. With --follow, cp keeps copying new records until it's killed. With
+	--until (an RFC3339 timestamp), records that arrived in src after that time
+	are not copied, and cp exits once it's caught up past that time.
+
+	With --checkpoint, progress through every shard of src is saved to the given
+	file after each batch of records is written to dst, and a later cp with the
+	same file resumes where the last one left off. Records may be copied more
+	than once if cp is interrupted.
+
+	--rate and --bandwidth limit the number of records and bytes per second
+	written to dst.
+
+	Explicit hash keys aren't returned when reading from Kinesis, so records are
+	distributed across dst's shards by partition key only.
+	`,
+	Flags: cpFlags,
+	Run:   runCp,
+}
+
+func runCp(args []string) {
+	if len(args) < 2 {
+		log.Fatalln("error: src and dst streams are both required")
+	}
+	src, dst := args[0], args[1]
+
+	start := consumer.TRIM_HORIZON
+	switch *cpFrom {
+	case "trim-horizon":
+	case "latest":
+		start = consumer.LATEST
+	default:
+		log.Fatalf("error: unknown starting position %q", *cpFrom)
+	}
+
+	var untilTime time.Time
+	if *cpUntil != "" {
+		t, err := time.Parse(time.RFC3339, *cpUntil)
+		fatalOnErr(err)
+		untilTime = t
+	}
+
+	opts := []consumer.Option{consumer.WithConfig(awsConfig)}
+	if *cpCheckpointFile != "" {
+		checkpointer, err := consumer.NewFileCheckpointer(*cpCheckpointFile)
+		fatalOnErr(err)
+		opts = append(opts, consumer.WithCheckpointer(checkpointer))
+	}
+
+	p := producer.New(dst, producer.WithConfig(awsConfig))
+	p.Debug = verbose
+
+	cp := &copier{
+		producer: p,
+		limiter:  newRateLimiter(*cpRate, *cpBandwidth),
+		until:    untilTime,
+	}
+
+	c, err := consumer.Start(src, start, verbose, cp.copy, opts...)
+	fatalOnErr(err)
+
+	for range time.Tick(time.Second) {
+		done := c.CaughtUp()
+		if *cpFollow {
+			done = done && !untilTime.IsZero() && time.Now().After(untilTime)
+		}
+		if done {
+			break
+		}
+	}
+
+	// let the batch that's being copied finish and be checkpointed
+	fatalOnErr(c.Close())
+	fatalOnErr(p.Flush())
+	log.Printf("copied %d records (%s) from %s to %s", cp.records, humanBytes(float64(cp.bytes)), src, dst)
+}
+
+// Copies batches of records to a Producer. Batches from multiple shards are
+// copied one at a time, and each batch is flushed before copy returns so that
+// it's safe to checkpoint afterwards.
+type copier struct {
+	sync.Mutex
+
+	producer *producer.Producer
+	limiter  *rateLimiter
+	until    time.Time
+
+	records, bytes int64
+}
+
+func (c *copier) copy(records []*kinesis.Record) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, r := range records {
+		if !c.until.IsZero() && r.ApproximateArrivalTimestamp != nil && r.ApproximateArrivalTimestamp.After(c.until) {
+			continue
+		}
+
+		c.limiter.wait(len(r.Data))
+		fatalOnErr(c.producer.Put(r.PartitionKey, r.Data))
+
+		c.records++
+		c.bytes += int64(len(r.Data))
+	}
+
+	fatalOnErr(c.producer.Flush())
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+	"github.com/blinsay/ktk/kinesistest"
+	"github.com/blinsay/ktk/producer"
+)
+
+// test that copying a stream that has been split only finishes once the
+// split's children have been copied too.
+func TestCopySplitStream(t *testing.T) {
+	fake := splitStream(t, 10)
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("copied"), ShardCount: aws.Int64(1)})
+
+	p := producer.New("copied", producer.WithClient(fake))
+	cp := &copier{producer: p, limiter: newRateLimiter(0, 0)}
+
+	c, err := consumer.Start(testStream, consumer.TRIM_HORIZON, false, cp.copy, consumer.WithClient(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCaughtUp(t, c)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if copied := len(fake.Records("copied")); copied != 20 {
+		t.Errorf("expected 20 records copied, got %d", copied)
+	}
+}
+
+// A single shard stream with n records in it that's then split in two, with n
+// more records written across the children.
+func splitStream(t *testing.T, n int) *kinesistest.Kinesis {
+	fake := fakeWithRecords(n)
+
+	desc, err := fake.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String(testStream)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fake.SplitShard(&kinesis.SplitShardInput{
+		StreamName:         aws.String(testStream),
+		ShardToSplit:       desc.StreamDescription.Shards[0].ShardId,
+		NewStartingHashKey: aws.String("170141183460469231731687303715884105728"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := n; i < 2*n; i++ {
+		fake.PutRecord(&kinesis.PutRecordInput{
+			StreamName:   aws.String(testStream),
+			PartitionKey: aws.String(fmt.Sprint(i)),
+			Data:         []byte(fmt.Sprint(i)),
+		})
+	}
+	return fake
+}
+
+func waitForCaughtUp(t *testing.T, c *consumer.Consumer) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !c.CaughtUp() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting to catch up: %+v", c.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+)
+
+var dumpFlags = flag.NewFlagSet("dump", flag.ContinueOnError)
+
+var (
+	dumpOut         = dumpFlags.String("out", "", "the directory to write files to")
+	dumpFrom        = dumpFlags.String("from", "trim-horizon", "where to start reading: trim-horizon or latest")
+	dumpFollow      = dumpFlags.Bool("follow", false, "keep dumping new records after catching up")
+	dumpMaxFileSize = dumpFlags.Int64("max-file-size", 64*1024*1024, "rotate files after they reach this many bytes")
+)
+
+var dumpCommand = &Command{
+	Name:  "dump",
+	Usage: "dump stream --out=dir [--from=trim-horizon] [--follow] [--max-file-size=64MB]",
+	Short: "Archive a stream to local files",
+	Description: `
+	Read every record from the given stream and write it to files in the --out
+	directory, one set of files per shard. --from may be trim-horizon or latest.
+	Without --follow, dump exits once it has read everything up to the tip of
+	the stream.
+
+	Files are named shard-id.NNNNNN.jsonl and are rotated once they grow past
+	--max-file-size bytes. Each line of a file is a JSON object describing a
+	single record:
+
+	  {"shard_id": "shardId-000000000000",
+	   "sequence_number": "49545115243490985018280067714973144582180062593244200961",
+	   "partition_key": "a-key",
+	   "arrival_time": "2016-01-02T15:04:05.999Z",
+	   "data": "aGVsbG8gd29ybGQ="}
+
+	data is base64 encoded. arrival_time is left out if Kinesis didn't report
+	one. Records appear in each file in the order they were read from the shard.
+
+	dump won't add to an earlier dump. If --out already has dump files in it,
+	dump exits without reading anything. Dump to a new directory instead.
+
+	Restore a dump with ktk load.
+	`,
+	Flags: dumpFlags,
+	Run:   runDump,
+}
+
+// A record in a dump file.
+type archivedRecord struct {
+	ShardId        string     `json:"shard_id"`
+	SequenceNumber string     `json:"sequence_number"`
+	PartitionKey   string     `json:"partition_key"`
+	ArrivalTime    *time.Time `json:"arrival_time,omitempty"`
+	Data           []byte     `json:"data"`
+}
+
+func runDump(args []string) {
+	if len(args) < 1 {
+		log.Fatalln("error: no stream name given")
+	}
+	if *dumpOut == "" {
+		log.Fatalln("error: --out is required")
+	}
+
+	start := consumer.TRIM_HORIZON
+	switch *dumpFrom {
+	case "trim-horizon":
+	case "latest":
+		start = consumer.LATEST
+	default:
+		log.Fatalf("error: unknown starting position %q", *dumpFrom)
+	}
+
+	fatalOnErr(os.MkdirAll(*dumpOut, 0755))
+	fatalOnErr(checkDumpDir(*dumpOut))
+
+	d := &dumper{
+		dir:         *dumpOut,
+		maxFileSize: *dumpMaxFileSize,
+		writers:     make(map[string]*shardWriter),
+	}
+
+	c, err := consumer.StartShards(args[0], start, verbose, d.dump, consumer.WithConfig(awsConfig))
+	fatalOnErr(err)
+
+	for range time.Tick(time.Second) {
+		if !*dumpFollow && c.CaughtUp() {
+			fatalOnErr(d.close())
+			return
+		}
+	}
+}
+
+// Return an error if dir already has dump files in it.
+func checkDumpDir(dir string) error {
+	names, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("%s already has dump files in it. dump to an empty directory", dir)
+	}
+	return nil
+}
+
+// Writes records to per-shard files. Holds a read lock while writing a batch
+// so that close can wait for every in-progress batch to finish.
+type dumper struct {
+	sync.RWMutex
+
+	dir         string
+	maxFileSize int64
+
+	writersLock sync.Mutex
+	writers     map[string]*shardWriter
+}
+
+func (d *dumper) dump(shard string, records []*kinesis.Record) {
+	d.RLock()
+	defer d.RUnlock()
+
+	w := d.writer(shard)
+	for _, r := range records {
+		fatalOnErr(w.write(&archivedRecord{
+			ShardId:        shard,
+			SequenceNumber: *r.SequenceNumber,
+			PartitionKey:   *r.PartitionKey,
+			ArrivalTime:    r.ApproximateArrivalTimestamp,
+			Data:           r.Data,
+		}))
+	}
+	fatalOnErr(w.flush())
+}
+
+func (d *dumper) writer(shard string) *shardWriter {
+	d.writersLock.Lock()
+	defer d.writersLock.Unlock()
+
+	w, ok := d.writers[shard]
+	if !ok {
+		w = &shardWriter{dir: d.dir, shard: shard, maxSize: d.maxFileSize}
+		d.writers[shard] = w
+	}
+	return w
+}
+
+// Wait for any in-progress batches and close every file.
+func (d *dumper) close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	for _, w := range d.writers {
+		if err := w.close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes records from a single shard to a series of rotated files. Only used
+// from one goroutine at a time.
+type shardWriter struct {
+	dir     string
+	shard   string
+	maxSize int64
+
+	index int
+	size  int64
+	file  *os.File
+	buf   *bufio.Writer
+}
+
+func (w *shardWriter) write(r *archivedRecord) error {
+	if w.file == nil || w.size >= w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	bs = append(bs, '\n')
+
+	n, err := w.buf.Write(bs)
+	w.size += int64(n)
+	return err
+}
+
+func (w *shardWriter) flush() error {
+	if w.buf == nil {
+		return nil
+	}
+	return w.buf.Flush()
+}
+
+// Close the current file, if any, and open the next one. Refuses to overwrite
+// an existing file.
+func (w *shardWriter) rotate() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+
+	name := filepath.Join(w.dir, fmt.Sprintf("%s.%06d.jsonl", w.shard, w.index))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	w.index++
+	w.size = 0
+	w.file = f
+	w.buf = bufio.NewWriter(f)
+	return nil
+}
+
+func (w *shardWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	err := w.file.Close()
+	w.file, w.buf = nil, nil
+	return err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+)
+
+// test that a dump can be loaded back, with shards merged by arrival time.
+func TestDumpAndLoad(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	d := &dumper{dir: dir, maxFileSize: 1024, writers: make(map[string]*shardWriter)}
+	d.dump("shard-01", []*kinesis.Record{
+		arrivedAt("a", 1, 1),
+		arrivedAt("c", 2, 3),
+	})
+	d.dump("shard-02", []*kinesis.Record{
+		arrivedAt("b", 1, 2),
+		arrivedAt("d", 2, 4),
+	})
+	if err := d.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var data []string
+	records, err := openDump(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer records.close()
+	for {
+		r, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, string(r.Data))
+	}
+
+	if expected := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(data, expected) {
+		t.Errorf("expected records %v, got %v", expected, data)
+	}
+}
+
+// test that dumping a stream that has been split only finishes once the
+// split's children have been dumped too.
+func TestDumpSplitStream(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	fake := splitStream(t, 10)
+	d := &dumper{dir: dir, maxFileSize: 1024 * 1024, writers: make(map[string]*shardWriter)}
+	c, err := consumer.StartShards(testStream, consumer.TRIM_HORIZON, false, d.dump, consumer.WithClient(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForCaughtUp(t, c)
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := openDump(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer records.close()
+
+	dumped := 0
+	for {
+		_, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		dumped++
+	}
+	if dumped != 20 {
+		t.Errorf("expected 20 records dumped, got %d", dumped)
+	}
+}
+
+// test that shard files are rotated once they grow past the max size, and
+// that rotating never overwrites a file.
+func TestShardWriterRotate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w := &shardWriter{dir: dir, shard: "shard-01", maxSize: 1}
+	for i := 0; i < 3; i++ {
+		if err := w.write(&archivedRecord{ShardId: "shard-01", Data: []byte("hello")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	expected := []string{
+		filepath.Join(dir, "shard-01.000000.jsonl"),
+		filepath.Join(dir, "shard-01.000001.jsonl"),
+		filepath.Join(dir, "shard-01.000002.jsonl"),
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected files %v, got %v", expected, names)
+	}
+
+	w = &shardWriter{dir: dir, shard: "shard-01", maxSize: 1}
+	if err := w.write(&archivedRecord{ShardId: "shard-01"}); err == nil {
+		t.Error("expected an error overwriting a dump file")
+	}
+}
+
+func TestCheckDumpDir(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	if err := checkDumpDir(dir); err != nil {
+		t.Errorf("expected an empty directory to be ok, got %s", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "shard-01.000000.jsonl"), nil, 0644)
+	if err := checkDumpDir(dir); err == nil {
+		t.Error("expected an error for a directory with a dump in it")
+	}
+}
+
+func TestParseSpeed(t *testing.T) {
+	testCases := []struct {
+		speed    string
+		expected float64
+		err      bool
+	}{
+		{speed: "max", expected: 0},
+		{speed: "1x", expected: 1},
+		{speed: "2.5x", expected: 2.5},
+		{speed: "3", expected: 3},
+		{speed: "0x", err: true},
+		{speed: "-1x", err: true},
+		{speed: "fast", err: true},
+	}
+
+	for _, tc := range testCases {
+		speed, err := parseSpeed(tc.speed)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: expected error to be %v, got %v", tc.speed, tc.err, err)
+			continue
+		}
+		if speed != tc.expected {
+			t.Errorf("%s: expected %f, got %f", tc.speed, tc.expected, speed)
+		}
+	}
+}
+
+// A record with the given data and sequence number that arrived at the given
+// second.
+func arrivedAt(data string, seq, second int64) *kinesis.Record {
+	arrival := time.Unix(second, 0).UTC()
+	return &kinesis.Record{
+		Data:                        []byte(data),
+		PartitionKey:                aws.String(data),
+		SequenceNumber:              aws.String(fmt.Sprint(seq)),
+		ApproximateArrivalTimestamp: &arrival,
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ktk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// A sink that pipes records to a shell command, one record per line on its
+// stdin. The command's stdout and stderr are passed through, and it runs with
+// KTK_SHARD_ID set to the shard the records came from.
+//
+// By default the command is run once per batch, and exiting non-zero fails the
+// batch. With perShard, one copy of the command is started for every shard and
+// kept running, and a batch has been sent once it's written to the command's
+// stdin.
+type execSink struct {
+	command  string
+	perShard bool
+
+	sync.Mutex
+	children map[string]*execChild
+}
+
+type execChild struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+func newExecSink(command string, perShard bool) *execSink {
+	return &execSink{command: command, perShard: perShard, children: make(map[string]*execChild)}
+}
+
+func (e *execSink) send(shard string, records []*kinesis.Record) error {
+	var buf bytes.Buffer
+	for _, r := range records {
+		buf.Write(r.Data)
+		buf.WriteByte('\n')
+	}
+
+	if !e.perShard {
+		cmd := e.cmd(shard)
+		cmd.Stdin = &buf
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %s: %s", shard, e.command, err)
+		}
+		return nil
+	}
+
+	child, err := e.child(shard)
+	if err != nil {
+		return err
+	}
+	if _, err := child.stdin.Write(buf.Bytes()); err != nil {
+		// the child has exited. start a new one for the retry
+		e.stop(shard)
+		return fmt.Errorf("%s: %s: %s", shard, e.command, err)
+	}
+	return nil
+}
+
+// Close a shard's long-running child and wait for it to exit.
+func (e *execSink) stop(shard string) {
+	e.Lock()
+	child := e.children[shard]
+	delete(e.children, shard)
+	e.Unlock()
+
+	if child == nil {
+		return
+	}
+	child.stdin.Close()
+	if err := child.cmd.Wait(); err != nil {
+		log.Printf("error: %s: %s: %s", shard, e.command, err)
+	}
+}
+
+// Return the shard's long-running child, starting it if it isn't running.
+func (e *execSink) child(shard string) (*execChild, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	if child := e.children[shard]; child != nil {
+		return child, nil
+	}
+
+	cmd := e.cmd(shard)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", shard, e.command, err)
+	}
+
+	child := &execChild{cmd: cmd, stdin: stdin}
+	e.children[shard] = child
+	return child, nil
+}
+
+func (e *execSink) cmd(shard string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", e.command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "KTK_SHARD_ID="+shard)
+	// keep children out of ktk's process group, so an interrupt from the
+	// terminal reaches ktk and children finish the records they've been given
+	cmd.SysProcAttr = childProcAttr()
+	return cmd
+}
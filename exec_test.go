@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test that a command that exits non-zero fails the batch, and that the batch
+// is sent again on retry.
+func TestExecSinkRetry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	marker := filepath.Join(dir, "failed")
+	// fail the first time, then write the shard id and records to out
+	command := fmt.Sprintf(`if [ ! -f %[1]s ]; then touch %[1]s; exit 1; fi; echo $KTK_SHARD_ID >> %[2]s; cat >> %[2]s`, marker, out)
+	e := newExecSink(command, false)
+
+	if err := e.send("shard-01", numberedRecords(1, 2)); err == nil {
+		t.Fatal("expected an error from a command that exited non-zero")
+	}
+	if err := e.send("shard-01", numberedRecords(1, 2)); err != nil {
+		t.Fatalf("unexpected error on retry: %s", err)
+	}
+
+	if expected, actual := []string{"shard-01", "1", "2"}, readLines(t, out); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected output %v, got %v", expected, actual)
+	}
+}
+
+// test that a per-shard command that exits fails the batch it was sent, and
+// that it's started again for the retry.
+func TestExecSinkPerShardRestart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "out")
+	e := newExecSink(fmt.Sprintf("head -n 1 >> %s", out), true)
+
+	if err := e.send("shard-01", numberedRecords(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// once head exits, writing to it fails
+	var err error
+	deadline := time.Now().Add(time.Second)
+	for err == nil && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+		err = e.send("shard-01", numberedRecords(2))
+	}
+	if err == nil {
+		t.Fatal("expected an error sending to a command that exited")
+	}
+
+	if err := e.send("shard-01", numberedRecords(3)); err != nil {
+		t.Fatalf("unexpected error on retry: %s", err)
+	}
+	e.stop("shard-01")
+
+	if expected, actual := []string{"1", "3"}, readLines(t, out); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected output %v, got %v", expected, actual)
+	}
+}
+
+func readLines(t *testing.T, path string) []string {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(bs)), "\n")
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blinsay/ktk/consumer"
+)
+
+// Follows every file matching a set of globs like tail -F, reading lines as
+// they're appended. Files that are renamed are followed to their new name if
+// it still matches, files that are truncated are read again from the start,
+// and files that stop matching are read to the end and closed. New files that
+// match are read from the start.
+//
+// How far each file has been read is kept in an offsetStore, so a restarted
+// follower picks up where the last one left off. The very first time files
+// are followed, with no offsets saved at all, files that already exist are
+// read from the end.
+//
+// Each file's lines are put back together into records by its own assembler.
+// A record that's still waiting for more lines is sent anyway once its last
+// line is timeout old.
+type follower struct {
+	patterns  []string
+	offsets   *offsetStore
+	files     map[string]*followedFile
+	fromStart bool
+
+	assembler func() *assembler
+	timeout   time.Duration
+}
+
+func newFollower(patterns []string, offsets *offsetStore, assembler func() *assembler, timeout time.Duration) *follower {
+	return &follower{
+		patterns:  patterns,
+		offsets:   offsets,
+		files:     make(map[string]*followedFile),
+		fromStart: len(offsets.offsets) > 0,
+		assembler: assembler,
+		timeout:   timeout,
+	}
+}
+
+// A file being followed. offset is the end of the last complete line read,
+// and partial holds anything read after that without a newline yet. saved is
+// the offset to resume from: the start of the lines the assembler is holding
+// on to, or offset if it isn't holding any.
+type followedFile struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	reader  *bufio.Reader
+	offset  int64
+	partial string
+
+	asm      *assembler
+	saved    int64
+	lastLine time.Time
+	timeout  time.Duration
+}
+
+// Read every new line from every matching file and pass it to send. Offsets
+// aren't saved until save is called, which should only be once every line has
+// been sent.
+func (fl *follower) poll(send func(line string) error) error {
+	matches, err := fl.glob()
+	if err != nil {
+		return err
+	}
+
+	// follow files that were renamed, and finish and close files that are gone
+	for path, f := range fl.files {
+		if info, ok := matches[path]; ok && os.SameFile(info, f.info) {
+			continue
+		}
+		delete(fl.files, path)
+
+		if renamed := sameFile(matches, f.info); renamed != "" && fl.files[renamed] == nil {
+			f.path = renamed
+			fl.files[renamed] = f
+			continue
+		}
+		if err := f.drain(send); err != nil {
+			return err
+		}
+		f.file.Close()
+	}
+
+	var paths []string
+	for path := range matches {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		f := fl.files[path]
+		if f == nil {
+			if f, err = fl.open(path); err != nil {
+				return err
+			}
+			if f == nil {
+				continue
+			}
+			fl.files[path] = f
+		}
+
+		if err := f.read(send); err != nil {
+			return err
+		}
+	}
+
+	fl.fromStart = true
+	return nil
+}
+
+// Save how far every file has been read, forgetting files that aren't being
+// followed anymore.
+func (fl *follower) save() error {
+	for path := range fl.offsets.offsets {
+		if fl.files[path] == nil {
+			fl.offsets.remove(path)
+		}
+	}
+	for path, f := range fl.files {
+		fl.offsets.set(path, fileOffset{Offset: f.saved, Inode: fileInode(f.info)})
+	}
+	return fl.offsets.save()
+}
+
+// Return every regular file matching the follower's patterns.
+func (fl *follower) glob() (map[string]os.FileInfo, error) {
+	matches := make(map[string]os.FileInfo)
+	for _, pattern := range fl.patterns {
+		paths, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			matches[path] = info
+		}
+	}
+	return matches, nil
+}
+
+// Open a newly matched file, starting from its saved offset if it has one.
+// Returns nil if the file disappeared before it could be opened.
+func (fl *follower) open(path string) (*followedFile, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var offset int64
+	if saved, ok := fl.offsets.find(path, fileInode(info)); ok {
+		offset = saved.Offset
+	} else if !fl.fromStart {
+		offset = info.Size()
+	}
+	if offset > info.Size() {
+		// truncated while nobody was watching
+		offset = 0
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &followedFile{
+		path:    path,
+		file:    file,
+		info:    info,
+		reader:  bufio.NewReader(file),
+		offset:  offset,
+		asm:     fl.assembler(),
+		saved:   offset,
+		timeout: fl.timeout,
+	}, nil
+}
+
+// Read and send every complete line appended to the file since the last read,
+// starting over if the file has been truncated.
+func (f *followedFile) read(send func(string) error) error {
+	if info, err := f.file.Stat(); err == nil && info.Size() < f.offset+int64(len(f.partial)) {
+		if err := f.flush(send); err != nil {
+			return err
+		}
+		if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		f.reader.Reset(f.file)
+		f.offset, f.saved, f.partial = 0, 0, ""
+	}
+
+	for {
+		data, err := f.reader.ReadString('\n')
+		if err == io.EOF {
+			f.partial += data
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		line := f.partial + data
+		f.partial = ""
+		if err := f.add(line, send); err != nil {
+			return err
+		}
+	}
+
+	if f.asm.pending() && time.Since(f.lastLine) >= f.timeout {
+		return f.flush(send)
+	}
+	return nil
+}
+
+// Read the rest of a file that's no longer being followed, including a last
+// line without a newline.
+func (f *followedFile) drain(send func(string) error) error {
+	if err := f.read(send); err != nil {
+		return err
+	}
+	if f.partial != "" {
+		line := f.partial
+		f.partial = ""
+		if err := f.add(line, send); err != nil {
+			return err
+		}
+	}
+	return f.flush(send)
+}
+
+// Pass a complete line to the file's assembler and send any records it
+// finishes.
+func (f *followedFile) add(line string, send func(string) error) error {
+	start := f.offset
+	f.offset += int64(len(line))
+
+	wasPending := f.asm.pending()
+	records := f.asm.add(strings.TrimRight(line, "\r\n"))
+	for _, record := range records {
+		if err := send(record); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case !f.asm.pending():
+		f.saved = f.offset
+	case !wasPending || len(records) > 0:
+		// this line starts the record the assembler is holding
+		f.saved = start
+	}
+	f.lastLine = time.Now()
+	return nil
+}
+
+// Send whatever the assembler is holding.
+func (f *followedFile) flush(send func(string) error) error {
+	for _, record := range f.asm.flush() {
+		if err := send(record); err != nil {
+			return err
+		}
+	}
+	f.saved = f.offset
+	return nil
+}
+
+// Return the path of the file in matches that's the same file as info, or ""
+// if there isn't one.
+func sameFile(matches map[string]os.FileInfo, info os.FileInfo) string {
+	for path, match := range matches {
+		if os.SameFile(match, info) {
+			return path
+		}
+	}
+	return ""
+}
+
+// How far a file has been read. The inode tells a file apart from whatever
+// replaces it after a rotation. It's always 0 on Windows.
+type fileOffset struct {
+	Offset int64  `json:"offset"`
+	Inode  uint64 `json:"inode"`
+}
+
+// Offsets for followed files, kept in a JSON file mapping paths to offsets.
+type offsetStore struct {
+	path    string
+	offsets map[string]fileOffset
+	changed bool
+}
+
+// Load offsets from path. A missing file has no offsets.
+func loadOffsets(path string) (*offsetStore, error) {
+	s := &offsetStore{path: path, offsets: make(map[string]fileOffset)}
+
+	bs, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(bs, &s.offsets); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Return the saved offset for a file, matching on inode if the file was
+// renamed while nothing was following it.
+func (s *offsetStore) find(path string, inode uint64) (fileOffset, bool) {
+	if o, ok := s.offsets[path]; ok && o.Inode == inode {
+		return o, true
+	}
+	if inode == 0 {
+		return fileOffset{}, false
+	}
+	for _, o := range s.offsets {
+		if o.Inode == inode {
+			return o, true
+		}
+	}
+	return fileOffset{}, false
+}
+
+func (s *offsetStore) set(path string, o fileOffset) {
+	if s.offsets[path] != o {
+		s.offsets[path] = o
+		s.changed = true
+	}
+}
+
+func (s *offsetStore) remove(path string) {
+	if _, ok := s.offsets[path]; ok {
+		delete(s.offsets, path)
+		s.changed = true
+	}
+}
+
+// Write the offsets out if they've changed, replacing the file atomically.
+func (s *offsetStore) save() error {
+	if !s.changed {
+		return nil
+	}
+
+	bs, err := json.MarshalIndent(s.offsets, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	if err := consumer.WriteFileAtomic(s.path, bs); err != nil {
+		return err
+	}
+
+	s.changed = false
+	return nil
+}
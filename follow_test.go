@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// test that lines appended to a followed file are sent as they're completed,
+// and that files that exist before the first poll are read from the end.
+func TestFollowAppends(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	appendTo(t, path, "old\n")
+
+	fl := testFollower(t, dir, filepath.Join(dir, "*.log"))
+	expectLines(t, fl, nil)
+
+	appendTo(t, path, "a\nb\n")
+	expectLines(t, fl, []string{"a", "b"})
+
+	appendTo(t, path, "partial")
+	expectLines(t, fl, nil)
+	appendTo(t, path, " line\n")
+	expectLines(t, fl, []string{"partial line"})
+
+	// a new file is read from the start
+	appendTo(t, filepath.Join(dir, "other.log"), "c\n")
+	expectLines(t, fl, []string{"c"})
+}
+
+// test that a truncated file is read again from the start.
+func TestFollowTruncate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	fl := testFollower(t, dir, filepath.Join(dir, "*.log"))
+	expectLines(t, fl, nil)
+	appendTo(t, path, "a\nb\n")
+	expectLines(t, fl, []string{"a", "b"})
+
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendTo(t, path, "c\n")
+	expectLines(t, fl, []string{"c"})
+}
+
+// test that a file that's renamed to a name that still matches is followed
+// without being read again, and that a file that's rotated out of the globs
+// is read to the end before a new file takes its place.
+func TestFollowRotate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	fl := testFollower(t, dir, filepath.Join(dir, "*.log"))
+	expectLines(t, fl, nil)
+	appendTo(t, path, "a\n")
+	expectLines(t, fl, []string{"a"})
+
+	renamed := filepath.Join(dir, "app-1.log")
+	appendTo(t, path, "b\n")
+	if err := os.Rename(path, renamed); err != nil {
+		t.Fatal(err)
+	}
+	appendTo(t, renamed, "c\n")
+	expectLines(t, fl, []string{"b", "c"})
+
+	appendTo(t, renamed, "d\n")
+	if err := os.Rename(renamed, filepath.Join(dir, "app-1.log.old")); err != nil {
+		t.Fatal(err)
+	}
+	appendTo(t, path, "e\n")
+	expectLines(t, fl, []string{"d", "e"})
+}
+
+// test that a follower started with saved offsets picks up where the last one
+// left off, including in a file that was rotated while nothing was following.
+func TestFollowResume(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	pattern := filepath.Join(dir, "*.log")
+	fl := testFollower(t, dir, pattern)
+	expectLines(t, fl, nil)
+	appendTo(t, path, "a\nb\n")
+	expectLines(t, fl, []string{"a", "b"})
+	if err := fl.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	appendTo(t, path, "c\n")
+	fl = testFollower(t, dir, pattern)
+	expectLines(t, fl, []string{"c"})
+	if err := fl.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	appendTo(t, path, "d\n")
+	if err := os.Rename(path, filepath.Join(dir, "app-1.log")); err != nil {
+		t.Fatal(err)
+	}
+	appendTo(t, path, "e\n")
+	fl = testFollower(t, dir, pattern)
+	expectLines(t, fl, []string{"d", "e"})
+}
+
+// test that a multiline record is sent once its last line is timeout old, and
+// that offsets aren't saved past a record that hasn't been sent.
+func TestFollowMultiline(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	offsets, err := loadOffsets(filepath.Join(dir, "offsets.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	offsets.offsets["unused"] = fileOffset{}
+	asm := &assembler{cont: regexp.MustCompile(`^\s`), maxBytes: 1024}
+	fl := newFollower([]string{filepath.Join(dir, "*.log")}, offsets, asm.empty, 20*time.Millisecond)
+
+	path := filepath.Join(dir, "app.log")
+	appendTo(t, path, "one\n  two\n")
+	expectLines(t, fl, nil)
+	fl.save()
+	if saved := offsets.offsets[path].Offset; saved != 0 {
+		t.Errorf("expected the unsent record not to be saved, got offset %d", saved)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	expectLines(t, fl, []string{"one\n  two"})
+}
+
+func testFollower(t *testing.T, dir, pattern string) *follower {
+	offsets, err := loadOffsets(filepath.Join(dir, "offsets.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newFollower([]string{pattern}, offsets, func() *assembler { return &assembler{} }, time.Second)
+}
+
+func appendTo(t *testing.T, path, data string) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Poll fl once and check the lines it sends.
+func expectLines(t *testing.T, fl *follower, expected []string) {
+	var lines []string
+	err := fl.poll(func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("expected lines %q, got %q", expected, lines)
+	}
+}
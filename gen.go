@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/blinsay/ktk/producer"
+)
+
+// The longest gen lets a record sit in the producer's buffer.
+const genLinger = 100 * time.Millisecond
+
+var genFlags = flag.NewFlagSet("gen", flag.ContinueOnError)
+
+var (
+	genRate     = genFlags.String("rate", "100/s", "records to send per second (N/s) or per minute (N/m)")
+	genSize     = genFlags.Int("size", 100, "the size of each random record in bytes")
+	genKeys     = genFlags.String("keys", "uniform:1000", "how to pick partition keys")
+	genTemplate = genFlags.String("template", "", "a template for generating records")
+	genDuration = genFlags.Duration("duration", time.Minute, "how long to generate load for")
+)
+
+var genCommand = &Command{
+	Name:  "gen",
+	Usage: "gen stream [--rate=100/s] [--size=100] [--keys=uniform:1000] [--template=tmpl] [--duration=1m]",
+	Short: "Generate synthetic load on a stream",
+	Description: `
+	Send generated records to the given stream at --rate records per second
+	(e.g. 500/s or 6000/m) for --duration, then report the achieved throughput,
+	how many records were throttled, and PutRecords latency percentiles.
+	Records are sent with the same producer as ktk cat.
+
+	Partition keys are chosen according to --keys:
+
+	  uniform:N        pick uniformly from N distinct keys
+	  zipf:S[:N]       pick from N (default 1000) keys with a Zipf distribution
+	                   with exponent S. S must be greater than 1
+	  sequential       use a new, increasing key for every record
+
+	By default each record is --size random letters. With --template, records
+	are generated from a Go text/template instead, which can use:
+
+	  {{.Seq}}         the record's sequence number in this run, from 0
+	  {{.Key}}         the record's partition key
+	  {{.Time}}        the current time as an RFC3339 timestamp
+	  {{.Unix}}        the current time in unix milliseconds
+	  {{.Random N}}    N random letters
+	`,
+	Flags: genFlags,
+	Run:   runGen,
+}
+
+func runGen(args []string) {
+	if len(args) < 1 {
+		log.Fatalln("error: no stream name given")
+	}
+
+	if *genSize < 1 {
+		log.Printf("error: --size must be at least 1, got %d", *genSize)
+		genFlags.Usage()
+		os.Exit(2)
+	}
+
+	rate, err := parseRate(*genRate)
+	fatalOnErr(err)
+
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	keys, err := newKeyGenerator(*genKeys, random)
+	fatalOnErr(err)
+
+	records := randomRecords(*genSize, random)
+	if *genTemplate != "" {
+		records, err = templateRecords(*genTemplate, random)
+		fatalOnErr(err)
+	}
+
+	stats := &genStats{}
+	p := producer.New(args[0], producer.WithConfig(awsConfig))
+	p.Debug = verbose
+	p.OnPut = stats.observe
+
+	limiter := newRateLimiter(rate, 0)
+	start := time.Now()
+	lastFlush := start
+
+	for seq := int64(0); time.Since(start) < *genDuration; seq++ {
+		limiter.wait(0)
+
+		key := keys()
+		data := records(seq, key)
+		fatalOnErr(p.Put(aws.String(key), data))
+		stats.records++
+		stats.bytes += int64(len(data))
+
+		if time.Since(lastFlush) > genLinger {
+			fatalOnErr(p.Flush())
+			lastFlush = time.Now()
+		}
+	}
+	fatalOnErr(p.Flush())
+
+	stats.print(time.Since(start))
+}
+
+// Parse a rate like 100/s or 6000/m into records per second. A bare number is
+// treated as per second.
+func parseRate(rate string) (float64, error) {
+	s, per := rate, time.Second
+	switch {
+	case strings.HasSuffix(s, "/s"):
+		s = strings.TrimSuffix(s, "/s")
+	case strings.HasSuffix(s, "/m"):
+		s, per = strings.TrimSuffix(s, "/m"), time.Minute
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid rate %q. use something like 100/s", rate)
+	}
+	return n / per.Seconds(), nil
+}
+
+// Returns the next partition key.
+type keyGenerator func() string
+
+func newKeyGenerator(spec string, random *rand.Rand) (keyGenerator, error) {
+	parts := strings.Split(spec, ":")
+
+	switch parts[0] {
+	case "sequential":
+		var next int64
+		return func() string {
+			next++
+			return strconv.FormatInt(next, 10)
+		}, nil
+	case "uniform":
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid key spec %q. use uniform:N", spec)
+		}
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid number of keys in %q", spec)
+		}
+		return func() string {
+			return "key-" + strconv.FormatInt(random.Int63n(n), 10)
+		}, nil
+	case "zipf":
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid key spec %q. use zipf:S or zipf:S:N", spec)
+		}
+		s, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || s <= 1 {
+			return nil, fmt.Errorf("invalid zipf exponent in %q. must be greater than 1", spec)
+		}
+		n := uint64(1000)
+		if len(parts) == 3 {
+			if n, err = strconv.ParseUint(parts[2], 10, 64); err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid number of keys in %q", spec)
+			}
+		}
+		zipf := rand.NewZipf(random, s, 1, n-1)
+		return func() string {
+			return "key-" + strconv.FormatUint(zipf.Uint64(), 10)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown key distribution %q", spec)
+}
+
+// Generates the data for the record with the given sequence number and key.
+type recordGenerator func(seq int64, key string) []byte
+
+func randomRecords(size int, random *rand.Rand) recordGenerator {
+	return func(int64, string) []byte {
+		return randomLetters(size, random)
+	}
+}
+
+func randomLetters(n int, random *rand.Rand) []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[random.Intn(len(letters))]
+	}
+	return b
+}
+
+// The data available to a --template.
+type templateRecord struct {
+	Seq  int64
+	Key  string
+	Time string
+	Unix int64
+
+	random *rand.Rand
+}
+
+func (t *templateRecord) Random(n int) string {
+	return string(randomLetters(n, t.random))
+}
+
+func templateRecords(text string, random *rand.Rand) (recordGenerator, error) {
+	tmpl, err := template.New("record").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(seq int64, key string) []byte {
+		now := time.Now()
+		var buf bytes.Buffer
+		fatalOnErr(tmpl.Execute(&buf, &templateRecord{
+			Seq:    seq,
+			Key:    key,
+			Time:   now.Format(time.RFC3339Nano),
+			Unix:   now.UnixNano() / int64(time.Millisecond),
+			random: random,
+		}))
+		return buf.Bytes()
+	}, nil
+}
+
+// Everything gen keeps track of while running.
+type genStats struct {
+	records, bytes    int64
+	puts, failedPuts  int64
+	failed, throttled int64
+	latencies         []time.Duration
+}
+
+func (g *genStats) observe(r producer.PutResult) {
+	g.puts++
+	if r.Err != nil {
+		g.failedPuts++
+	}
+	g.failed += int64(r.Failed)
+	g.throttled += int64(r.Throttled)
+	g.latencies = append(g.latencies, r.Latency)
+}
+
+func (g *genStats) print(elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	log.Printf("sent %d records (%s) in %s: %.1f records/s, %s/s",
+		g.records, humanBytes(float64(g.bytes)), elapsed, float64(g.records)/seconds, humanBytes(float64(g.bytes)/seconds))
+	log.Printf("%d PutRecords requests, %d failed", g.puts, g.failedPuts)
+	log.Printf("%d records retried, %d throttled (%.2f%%)", g.failed, g.throttled, percent(g.throttled, g.records))
+
+	if len(g.latencies) == 0 {
+		return
+	}
+
+	sort.Sort(durations(g.latencies))
+	log.Printf("latency: min %s, p50 %s, p90 %s, p99 %s, max %s",
+		g.latencies[0], percentile(g.latencies, 50), percentile(g.latencies, 90),
+		percentile(g.latencies, 99), g.latencies[len(g.latencies)-1])
+}
+
+// Return the pth percentile of a sorted, non-empty list of durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
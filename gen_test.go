@@ -0,0 +1,68 @@
+package main
+
+import (
+	"math/rand"
+	"regexp"
+	"testing"
+)
+
+func TestRandomRecords(t *testing.T) {
+	letters := regexp.MustCompile(`^[a-zA-Z]*$`)
+	records := randomRecords(100, rand.New(rand.NewSource(1)))
+
+	first, second := records(0, "key"), records(1, "key")
+	for _, r := range [][]byte{first, second} {
+		if len(r) != 100 {
+			t.Errorf("expected a 100 byte record, got %d bytes", len(r))
+		}
+		if !letters.Match(r) {
+			t.Errorf("expected only letters, got %q", r)
+		}
+	}
+	if string(first) == string(second) {
+		t.Errorf("expected different records, got %q twice", first)
+	}
+}
+
+func TestTemplateRecords(t *testing.T) {
+	records, err := templateRecords(`{"seq": {{.Seq}}, "key": "{{.Key}}", "id": "{{.Random 8}}", "at": {{.Unix}}}`, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := regexp.MustCompile(`^\{"seq": 7, "key": "key-3", "id": "[a-zA-Z]{8}", "at": \d+\}$`)
+	if actual := records(7, "key-3"); !expected.Match(actual) {
+		t.Errorf("expected a record matching %s, got %q", expected, actual)
+	}
+
+	if _, err := templateRecords(`{{.Seq`, rand.New(rand.NewSource(1))); err == nil {
+		t.Error("expected an error from an invalid template")
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	testCases := []struct {
+		rate     string
+		expected float64
+		err      bool
+	}{
+		{rate: "100/s", expected: 100},
+		{rate: "100", expected: 100},
+		{rate: "6000/m", expected: 100},
+		{rate: "0.5/s", expected: 0.5},
+		{rate: "0/s", err: true},
+		{rate: "-1/s", err: true},
+		{rate: "fast", err: true},
+	}
+
+	for _, tc := range testCases {
+		rate, err := parseRate(tc.rate)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: expected error to be %v, got %v", tc.rate, tc.err, err)
+			continue
+		}
+		if rate != tc.expected {
+			t.Errorf("%s: expected %f, got %f", tc.rate, tc.expected, rate)
+		}
+	}
+}
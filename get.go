@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+)
+
+// The most records a single GetRecords call can return.
+const maxGetRecordsLimit = 10000
+
+// How long to back off when GetRecords is throttled. Doubles on every retry
+// up to the max.
+var (
+	getRetryBackoff    = 200 * time.Millisecond
+	getMaxRetryBackoff = 5 * time.Second
+)
+
+var getFlags = flag.NewFlagSet("get", flag.ContinueOnError)
+
+var getNext = getFlags.Int("n", 0, "the number of records after the given record to print")
+
+var getCommand = &Command{
+	Name:  "get",
+	Usage: "get stream shard-id sequence-number [-n N]",
+	Short: "Print a specific record from a stream",
+	Description: `
+	Look up the record with the given sequence number in the given shard and
+	print it along with its metadata. With -n, the next N records in the shard
+	are printed as well.
+
+	Data that isn't valid UTF-8 is printed base64 encoded.
+	`,
+	Flags: getFlags,
+	Run:   runGet,
+}
+
+func runGet(args []string) {
+	if len(args) < 3 {
+		log.Fatalln("error: stream name, shard id and sequence number are all required")
+	}
+
+	stream, shard, seq := args[0], args[1], args[2]
+	k := kinesis.New(awsConfig)
+
+	iter, err := k.GetShardIterator(&kinesis.GetShardIteratorInput{
+		StreamName:             aws.String(stream),
+		ShardId:                aws.String(shard),
+		ShardIteratorType:      aws.String(kinesis.ShardIteratorTypeAtSequenceNumber),
+		StartingSequenceNumber: aws.String(seq),
+	})
+	fatalOnErr(err)
+
+	records, err := getRecords(k, iter.ShardIterator, *getNext+1)
+	fatalOnErr(err)
+
+	if len(records) == 0 || *records[0].SequenceNumber != seq {
+		log.Fatalf("error: no record with sequence number %s in %s", seq, shard)
+	}
+
+	for i, r := range records {
+		if i > 0 {
+			fmt.Println()
+		}
+		printRecord(shard, r)
+	}
+}
+
+// The part of the Kinesis API getRecords needs.
+type recordGetter interface {
+	GetRecords(*kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error)
+}
+
+// Read up to n records starting at iterator. Stops early if the end of the
+// shard or the tip of the stream is reached. Throttled reads are retried with
+// backoff.
+func getRecords(k recordGetter, iterator *string, n int) ([]*kinesis.Record, error) {
+	var records []*kinesis.Record
+
+	backoff := getRetryBackoff
+	for iterator != nil && len(records) < n {
+		limit := n - len(records)
+		if limit > maxGetRecordsLimit {
+			limit = maxGetRecordsLimit
+		}
+
+		resp, err := k.GetRecords(&kinesis.GetRecordsInput{
+			ShardIterator: iterator,
+			Limit:         aws.Int64(int64(limit)),
+		})
+		if consumer.ThroughputExceeded(err) {
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > getMaxRetryBackoff {
+				backoff = getMaxRetryBackoff
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		backoff = getRetryBackoff
+
+		records = append(records, resp.Records...)
+		iterator = resp.NextShardIterator
+
+		if len(resp.Records) == 0 && resp.MillisBehindLatest != nil && *resp.MillisBehindLatest == 0 {
+			break
+		}
+	}
+
+	return records, nil
+}
+
+func printRecord(shard string, r *kinesis.Record) {
+	fmt.Printf("shard:           %s\n", shard)
+	fmt.Printf("sequence number: %s\n", aws.StringValue(r.SequenceNumber))
+	fmt.Printf("partition key:   %s\n", aws.StringValue(r.PartitionKey))
+	if r.ApproximateArrivalTimestamp != nil {
+		fmt.Printf("arrival time:    %s\n", r.ApproximateArrivalTimestamp.Format(time.RFC3339Nano))
+	}
+	fmt.Printf("size:            %d\n", len(r.Data))
+
+	if utf8.Valid(r.Data) {
+		fmt.Printf("data:            %s\n", r.Data)
+	} else {
+		fmt.Printf("data (base64):   %s\n", base64.StdEncoding.EncodeToString(r.Data))
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/kinesistest"
+)
+
+const testStream = "test_stream"
+
+// A fake that rejects GetRecords limits Kinesis would reject.
+type strictLimits struct {
+	*kinesistest.Kinesis
+}
+
+func (s strictLimits) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	if aws.Int64Value(input.Limit) > maxGetRecordsLimit {
+		return nil, kinesistest.Error(kinesistest.InvalidArgument, "Limit must be less than or equal to 10000")
+	}
+	return s.Kinesis.GetRecords(input)
+}
+
+// test that asking for more records than fit in one GetRecords call reads
+// them over several calls.
+func TestGetRecordsLimit(t *testing.T) {
+	fake := fakeWithRecords(maxGetRecordsLimit + 5)
+
+	records, err := getRecords(strictLimits{fake}, trimHorizon(t, fake), maxGetRecordsLimit+2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != maxGetRecordsLimit+2 {
+		t.Fatalf("expected %d records, got %d", maxGetRecordsLimit+2, len(records))
+	}
+	if last := string(records[len(records)-1].Data); last != fmt.Sprint(maxGetRecordsLimit+1) {
+		t.Errorf("expected the last record to be %d, got %s", maxGetRecordsLimit+1, last)
+	}
+}
+
+// test that getRecords stops at the tip of the stream.
+func TestGetRecordsTip(t *testing.T) {
+	fake := fakeWithRecords(3)
+
+	records, err := getRecords(fake, trimHorizon(t, fake), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 {
+		t.Errorf("expected 3 records, got %d", len(records))
+	}
+}
+
+// test that throttled reads are retried.
+func TestGetRecordsThrottled(t *testing.T) {
+	defer func(backoff time.Duration) { getRetryBackoff = backoff }(getRetryBackoff)
+	getRetryBackoff = time.Millisecond
+
+	fake := fakeWithRecords(3)
+	iterator := trimHorizon(t, fake)
+
+	throttled := 0
+	fake.Fault = func(operation string) error {
+		if operation == "GetRecords" && throttled < 3 {
+			throttled++
+			return kinesistest.Error(kinesistest.ProvisionedThroughputExceeded, "slow down")
+		}
+		return nil
+	}
+
+	records, err := getRecords(fake, iterator, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || throttled != 3 {
+		t.Errorf("expected 3 records after 3 throttled reads, got %d records after %d", len(records), throttled)
+	}
+}
+
+// test that errors other than throttling aren't retried.
+func TestGetRecordsError(t *testing.T) {
+	fake := fakeWithRecords(3)
+	iterator := trimHorizon(t, fake)
+	fake.Fault = func(string) error { return kinesistest.Error(kinesistest.InternalFailure, "oops") }
+
+	if _, err := getRecords(fake, iterator, 3); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+// A single shard stream with n records in it, numbered from 0.
+func fakeWithRecords(n int) *kinesistest.Kinesis {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(testStream), ShardCount: aws.Int64(1)})
+	for i := 0; i < n; i++ {
+		fake.PutRecord(&kinesis.PutRecordInput{
+			StreamName:   aws.String(testStream),
+			PartitionKey: aws.String(fmt.Sprint(i)),
+			Data:         []byte(fmt.Sprint(i)),
+		})
+	}
+	return fake
+}
+
+// Return an iterator at the start of the first shard of the test stream.
+func trimHorizon(t *testing.T, fake *kinesistest.Kinesis) *string {
+	desc, err := fake.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String(testStream)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter, err := fake.GetShardIterator(&kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(testStream),
+		ShardId:           desc.StreamDescription.Shards[0].ShardId,
+		ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return iter.ShardIterator
+}
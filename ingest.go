@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/blinsay/ktk/producer"
+)
+
+// An HTTP endpoint for sending records. POST /records takes either a JSON
+// array of records, or a single record as the raw request body, and responds
+// once every record has been written with the shard and sequence number each
+// one was given.
+//
+// At most maxPending records can be waiting to be sent at once. Requests that
+// would go over are turned away with a 429.
+type ingestServer struct {
+	messages   chan<- listenedMessage
+	maxPending int
+
+	sync.Mutex
+	pending int
+}
+
+// A record in a JSON request. data may be a string, which is sent as is, or
+// any other JSON value, which is sent as JSON. key defaults to the start of
+// the data.
+type ingestRecord struct {
+	Key  *string         `json:"key"`
+	Data json.RawMessage `json:"data"`
+}
+
+// The outcome for each record in a request, in the same order.
+type ingestResult struct {
+	ShardId        string `json:"shard_id,omitempty"`
+	SequenceNumber string `json:"sequence_number,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+func (s *ingestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/records" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	messages, err := readIngestRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.reserve(len(messages)) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many records waiting to be sent", http.StatusTooManyRequests)
+		return
+	}
+
+	results := make([]ingestResult, len(messages))
+	var wg sync.WaitGroup
+	wg.Add(len(messages))
+	for i := range messages {
+		result := &results[i]
+		messages[i].done = func(d producer.Delivery) {
+			if d.Err != nil {
+				result.Error = d.Err.Error()
+			} else {
+				result.ShardId, result.SequenceNumber = d.ShardId, d.SequenceNumber
+			}
+			s.release(1)
+			wg.Done()
+		}
+		s.messages <- messages[i]
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Error != "" {
+			status = http.StatusBadGateway
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Records []ingestResult `json:"records"`
+	}{results})
+}
+
+func (s *ingestServer) reserve(n int) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pending+n > s.maxPending {
+		return false
+	}
+	s.pending += n
+	return true
+}
+
+func (s *ingestServer) release(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.pending -= n
+}
+
+// Read the records in a request. JSON requests are an array of records, and
+// anything else is a single record, keyed by the X-Ktk-Partition-Key header if
+// it's there.
+func readIngestRequest(r *http.Request) ([]listenedMessage, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		data, err := readLimited(r.Body, maxRecordSize)
+		if err != nil {
+			return nil, err
+		}
+		key := r.Header.Get("X-Ktk-Partition-Key")
+		if key == "" {
+			key = partitionKey(data)
+		}
+		m := listenedMessage{key: key, data: data}
+		return []listenedMessage{m}, validateMessage(0, m)
+	}
+
+	// a PutRecords request can carry up to 5MB
+	body, err := readLimited(r.Body, 5*maxRecordSize)
+	if err != nil {
+		return nil, err
+	}
+	var records []ingestRecord
+	if err := json.Unmarshal([]byte(body), &records); err != nil {
+		return nil, fmt.Errorf("expected a JSON array of records: %s", err)
+	}
+
+	messages := make([]listenedMessage, len(records))
+	for i, record := range records {
+		var data string
+		if err := json.Unmarshal(record.Data, &data); err != nil {
+			data = string(record.Data)
+		}
+
+		m := listenedMessage{data: data, key: partitionKey(data)}
+		if record.Key != nil {
+			m.key = *record.Key
+		}
+		if err := validateMessage(i, m); err != nil {
+			return nil, err
+		}
+		messages[i] = m
+	}
+	return messages, nil
+}
+
+func validateMessage(i int, m listenedMessage) error {
+	if len(m.data) > maxRecordSize {
+		return fmt.Errorf("record %d: data is longer than %d bytes", i, maxRecordSize)
+	}
+	if err := producer.Validate(aws.String(m.key), []byte(m.data)); err != nil {
+		return fmt.Errorf("record %d: %s", i, err)
+	}
+	return nil
+}
+
+// Read at most limit bytes from r.
+func readLimited(r io.Reader, limit int64) (string, error) {
+	bs, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(bs)) > limit {
+		return "", fmt.Errorf("request body is longer than %d bytes", limit)
+	}
+	return string(bs), nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blinsay/ktk/producer"
+)
+
+// Stand in for the producer, delivering every message it's sent with deliver.
+func fakeIngest(maxPending int, deliver func(m listenedMessage) producer.Delivery) (*ingestServer, chan listenedMessage) {
+	messages := make(chan listenedMessage)
+	go func() {
+		for m := range messages {
+			m.done(deliver(m))
+		}
+	}()
+	return &ingestServer{messages: messages, maxPending: maxPending}, messages
+}
+
+func postRecords(s *ingestServer, contentType, body string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/records", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func ingestResults(t *testing.T, w *httptest.ResponseRecorder) []ingestResult {
+	var resp struct {
+		Records []ingestResult `json:"records"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %q: %s", w.Body.String(), err)
+	}
+	return resp.Records
+}
+
+// test that a request gets every record's shard and sequence number once
+// they've all been sent.
+func TestIngestOK(t *testing.T) {
+	s, messages := fakeIngest(10, func(m listenedMessage) producer.Delivery {
+		return producer.Delivery{ShardId: "shard-" + m.key, SequenceNumber: m.data}
+	})
+	defer close(messages)
+
+	w := postRecords(s, "application/json", `[{"key": "01", "data": "hello"}, {"key": "02", "data": {"a": 1}}]`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	expected := []ingestResult{
+		{ShardId: "shard-01", SequenceNumber: "hello"},
+		{ShardId: "shard-02", SequenceNumber: `{"a": 1}`},
+	}
+	if actual := ingestResults(t, w); !reflect.DeepEqual(actual, expected) {
+		t.Errorf(`expected results not equal to actual results
+
+		actual:   %+v
+		expected: %+v`, actual, expected)
+	}
+	if pending := pendingCount(s); pending != 0 {
+		t.Errorf("expected nothing pending, got %d", pending)
+	}
+}
+
+// test that a raw body is sent as a single record keyed by its header.
+func TestIngestRaw(t *testing.T) {
+	var sent listenedMessage
+	s, messages := fakeIngest(10, func(m listenedMessage) producer.Delivery {
+		sent = m
+		return producer.Delivery{ShardId: "shard-01", SequenceNumber: "1"}
+	})
+	defer close(messages)
+
+	req, _ := http.NewRequest("POST", "/records", strings.NewReader("hello there"))
+	req.Header.Set("X-Ktk-Partition-Key", "a-key")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if sent.key != "a-key" || sent.data != "hello there" {
+		t.Errorf("expected hello there keyed by a-key, got %q keyed by %q", sent.data, sent.key)
+	}
+}
+
+// test that a record that fails to send fails the request with a 502, and
+// that the error is reported in place of the record's sequence number.
+func TestIngestFailed(t *testing.T) {
+	s, messages := fakeIngest(10, func(m listenedMessage) producer.Delivery {
+		if m.data == "bad" {
+			return producer.Delivery{Err: errors.New("throughput exceeded")}
+		}
+		return producer.Delivery{ShardId: "shard-01", SequenceNumber: "1"}
+	})
+	defer close(messages)
+
+	w := postRecords(s, "application/json", `[{"data": "good"}, {"data": "bad"}]`)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected a 502, got %d: %s", w.Code, w.Body.String())
+	}
+
+	expected := []ingestResult{
+		{ShardId: "shard-01", SequenceNumber: "1"},
+		{Error: "throughput exceeded"},
+	}
+	if actual := ingestResults(t, w); !reflect.DeepEqual(actual, expected) {
+		t.Errorf(`expected results not equal to actual results
+
+		actual:   %+v
+		expected: %+v`, actual, expected)
+	}
+	if pending := pendingCount(s); pending != 0 {
+		t.Errorf("expected nothing pending, got %d", pending)
+	}
+}
+
+// test that requests are turned away while too many records are waiting to be
+// sent, and that records stop counting as pending once they're sent.
+func TestIngestTooManyPending(t *testing.T) {
+	release := make(chan struct{})
+	s, messages := fakeIngest(3, func(m listenedMessage) producer.Delivery {
+		<-release
+		return producer.Delivery{ShardId: "shard-01", SequenceNumber: "1"}
+	})
+	defer close(messages)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- postRecords(s, "application/json", `[{"data": "a"}, {"data": "b"}]`)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && pendingCount(s) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if pending := pendingCount(s); pending != 2 {
+		t.Fatalf("expected 2 records pending, got %d", pending)
+	}
+
+	w := postRecords(s, "application/json", `[{"data": "c"}, {"data": "d"}]`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a 429, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+	if pending := pendingCount(s); pending != 2 {
+		t.Errorf("expected a turned away request not to count as pending, got %d", pending)
+	}
+
+	close(release)
+	if w := <-done; w.Code != http.StatusOK {
+		t.Errorf("expected the first request to succeed, got %d", w.Code)
+	}
+	if pending := pendingCount(s); pending != 0 {
+		t.Errorf("expected nothing pending, got %d", pending)
+	}
+
+	if w := postRecords(s, "application/json", `[{"data": "c"}, {"data": "d"}]`); w.Code != http.StatusOK {
+		t.Errorf("expected a 200 once the first request was done, got %d", w.Code)
+	}
+}
+
+func TestIngestInvalid(t *testing.T) {
+	s, messages := fakeIngest(10, func(m listenedMessage) producer.Delivery {
+		return producer.Delivery{}
+	})
+	defer close(messages)
+
+	testCases := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		expected int
+	}{
+		{name: "wrong path", method: "POST", path: "/", body: `[]`, expected: http.StatusNotFound},
+		{name: "wrong method", method: "GET", path: "/records", expected: http.StatusMethodNotAllowed},
+		{name: "not an array", method: "POST", path: "/records", body: `{"data": "a"}`, expected: http.StatusBadRequest},
+		{name: "empty key", method: "POST", path: "/records", body: `[{"key": "", "data": "a"}]`, expected: http.StatusBadRequest},
+		{name: "empty data", method: "POST", path: "/records", body: `[{"data": ""}]`, expected: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		req, _ := http.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+
+		if w.Code != tc.expected {
+			t.Errorf("%s: expected a %d, got %d", tc.name, tc.expected, w.Code)
+		}
+	}
+	if pending := pendingCount(s); pending != 0 {
+		t.Errorf("expected nothing pending, got %d", pending)
+	}
+}
+
+func pendingCount(s *ingestServer) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.pending
+}
@@ -0,0 +1,79 @@
+package kcl
+
+import (
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/blinsay/ktk/consumer"
+)
+
+// Leases are read and written with the legacy Expected and AttributeUpdates
+// parameters, which every DynamoDB stand-in supports.
+
+type item map[string]*dynamodb.AttributeValue
+
+func key(shard string) item {
+	return item{leaseKey: {S: aws.String(shard)}}
+}
+
+func number(n int64) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(n, 10))}
+}
+
+func toItem(lease *consumer.Lease) item {
+	i := item{
+		leaseKey:                     {S: aws.String(lease.ShardId)},
+		leaseCounter:                 number(lease.Counter),
+		checkpoint:                   {S: aws.String(lease.Checkpoint)},
+		checkpointSubSequenceNumber:  number(0),
+		ownerSwitchesSinceCheckpoint: number(0),
+	}
+	if lease.Owner != "" {
+		i[leaseOwner] = &dynamodb.AttributeValue{S: aws.String(lease.Owner)}
+	}
+	if len(lease.ParentShardIds) > 0 {
+		i[parentShardId] = &dynamodb.AttributeValue{SS: aws.StringSlice(lease.ParentShardIds)}
+	}
+	return i
+}
+
+func fromItem(i item) *consumer.Lease {
+	lease := &consumer.Lease{
+		ShardId:    i.str(leaseKey),
+		Owner:      i.str(leaseOwner),
+		Checkpoint: i.str(checkpoint),
+	}
+	lease.Counter, _ = strconv.ParseInt(i.num(leaseCounter), 10, 64)
+	if parents, ok := i[parentShardId]; ok {
+		lease.ParentShardIds = aws.StringValueSlice(parents.SS)
+	}
+	return lease
+}
+
+func (i item) str(name string) string {
+	if v, ok := i[name]; ok {
+		return aws.StringValue(v.S)
+	}
+	return ""
+}
+
+func (i item) num(name string) string {
+	if v, ok := i[name]; ok {
+		return aws.StringValue(v.N)
+	}
+	return ""
+}
+
+// Return true if err is DynamoDB rejecting a conditional write.
+func conditionFailed(err error) bool {
+	return errCode(err) == "ConditionalCheckFailedException"
+}
+
+func errCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return ""
+}
@@ -0,0 +1,283 @@
+// Package kcl reads and writes the DynamoDB lease tables that the Kinesis
+// Client Library keeps its checkpoints in.
+//
+// A KCL application keeps a lease for every shard in a table named after the
+// application. A Table is a consumer.Checkpointer that reads and writes those
+// checkpoints, and a consumer.LeaseStore that divides shards the same way KCL
+// workers do.
+package kcl
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/blinsay/ktk/consumer"
+)
+
+// The attributes of a KCL lease.
+const (
+	leaseKey                     = "leaseKey"
+	leaseOwner                   = "leaseOwner"
+	leaseCounter                 = "leaseCounter"
+	checkpoint                   = "checkpoint"
+	checkpointSubSequenceNumber  = "checkpointSubSequenceNumber"
+	ownerSwitchesSinceCheckpoint = "ownerSwitchesSinceCheckpoint"
+	parentShardId                = "parentShardId"
+)
+
+// A KCL application's lease table.
+type Table struct {
+	// The name of the table. The KCL names tables after the application.
+	Name string
+
+	// The DynamoDB client to send requests with. Required.
+	Client *dynamodb.DynamoDB
+
+	// What every lease looked like the last time it was read or written, so
+	// updates only touch the attributes that changed.
+	mu    sync.Mutex
+	known map[string]leaseState
+}
+
+// The parts of a lease an update might change.
+type leaseState struct {
+	counter    int64
+	owner      string
+	checkpoint string
+}
+
+// Return the lease table for the named application, using a DynamoDB client
+// created with config.
+func New(app string, config *aws.Config) *Table {
+	return &Table{Name: app, Client: dynamodb.New(config)}
+}
+
+// How often Create checks whether a new table is ready.
+var createPollInterval = time.Second
+
+// The capacity the KCL creates lease tables with.
+const tableCapacity = 10
+
+// Create the table the way the KCL does and wait for it to be ready. A table
+// that already exists is left alone.
+func (t *Table) Create() error {
+	_, err := t.Client.CreateTable(&dynamodb.CreateTableInput{
+		TableName:            aws.String(t.Name),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{{AttributeName: aws.String(leaseKey), AttributeType: aws.String("S")}},
+		KeySchema:            []*dynamodb.KeySchemaElement{{AttributeName: aws.String(leaseKey), KeyType: aws.String("HASH")}},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(tableCapacity),
+			WriteCapacityUnits: aws.Int64(tableCapacity),
+		},
+	})
+	if err != nil && errCode(err) != "ResourceInUseException" {
+		return err
+	}
+
+	for {
+		output, err := t.Client.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(t.Name)})
+		if err != nil {
+			return err
+		}
+		if output.Table != nil && aws.StringValue(output.Table.TableStatus) == "ACTIVE" {
+			return nil
+		}
+		time.Sleep(createPollInterval)
+	}
+}
+
+// Return every lease in the table, sorted by shard id.
+func (t *Table) Leases() ([]*consumer.Lease, error) {
+	var leases []*consumer.Lease
+
+	input := &dynamodb.ScanInput{TableName: aws.String(t.Name), ConsistentRead: aws.Bool(true)}
+	for {
+		output, err := t.Client.Scan(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, i := range output.Items {
+			lease := fromItem(i)
+			t.remember(lease)
+			leases = append(leases, lease)
+		}
+
+		if len(output.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = output.LastEvaluatedKey
+	}
+
+	sort.Sort(byShardId(leases))
+	return leases, nil
+}
+
+// Return the lease for a single shard, or nil if it doesn't have one.
+func (t *Table) Lease(shard string) (*consumer.Lease, error) {
+	output, err := t.Client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(t.Name),
+		Key:            key(shard),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || output.Item == nil {
+		return nil, err
+	}
+	lease := fromItem(output.Item)
+	t.remember(lease)
+	return lease, nil
+}
+
+// Create a lease, unless the shard already has one.
+func (t *Table) CreateLease(lease *consumer.Lease) (bool, error) {
+	_, err := t.Client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(t.Name),
+		Item:      toItem(lease),
+		Expected:  map[string]*dynamodb.ExpectedAttributeValue{leaseKey: {Exists: aws.Bool(false)}},
+	})
+
+	if conditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	t.remember(lease)
+	return true, nil
+}
+
+// Replace a lease's owner, counter and checkpoint if its counter is still
+// counter. Any other attributes the KCL keeps are left alone.
+//
+// The checkpoint is only written when it changes, so renewing or taking a
+// lease keeps the sub-sequence number a KCL worker checkpointed an aggregated
+// record at. Like the KCL, taking a lease from another owner counts an owner
+// switch, and a new checkpoint resets the count.
+func (t *Table) UpdateLease(lease *consumer.Lease, counter int64) error {
+	previous, ok := t.recall(lease.ShardId, counter)
+	if !ok {
+		current, err := t.Lease(lease.ShardId)
+		if err != nil {
+			return err
+		}
+		if current == nil || current.Counter != counter {
+			return consumer.ErrLeaseLost
+		}
+		previous = stateOf(current)
+	}
+
+	updates := map[string]*dynamodb.AttributeValueUpdate{
+		leaseCounter: put(number(lease.Counter)),
+		leaseOwner:   {Action: aws.String("DELETE")},
+	}
+	if lease.Owner != "" {
+		updates[leaseOwner] = put(&dynamodb.AttributeValue{S: aws.String(lease.Owner)})
+	}
+	switch {
+	case lease.Checkpoint != previous.checkpoint:
+		updates[checkpoint] = put(&dynamodb.AttributeValue{S: aws.String(lease.Checkpoint)})
+		updates[checkpointSubSequenceNumber] = put(number(0))
+		updates[ownerSwitchesSinceCheckpoint] = put(number(0))
+	case lease.Owner != "" && previous.owner != "" && lease.Owner != previous.owner:
+		updates[ownerSwitchesSinceCheckpoint] = add(number(1))
+	}
+
+	_, err := t.Client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(t.Name),
+		Key:              key(lease.ShardId),
+		AttributeUpdates: updates,
+		Expected:         map[string]*dynamodb.ExpectedAttributeValue{leaseCounter: {Value: number(counter)}},
+	})
+
+	if conditionFailed(err) {
+		t.forget(lease.ShardId)
+		return consumer.ErrLeaseLost
+	}
+	if err != nil {
+		return err
+	}
+	t.remember(lease)
+	return nil
+}
+
+// Return the shard's checkpoint, or "" if it doesn't have a lease.
+func (t *Table) Checkpoint(shard string) (string, error) {
+	lease, err := t.Lease(shard)
+	if err != nil || lease == nil {
+		return "", err
+	}
+	return lease.Checkpoint, nil
+}
+
+// Set the checkpoint on the shard's lease. Shards without a lease are an error,
+// so a mistyped shard id doesn't add a lease for a shard that doesn't exist.
+//
+// The lease's counter is bumped as well, so a KCL worker holding the lease
+// loses it instead of overwriting the new checkpoint. The next worker to take
+// the lease starts from the new checkpoint.
+func (t *Table) SetCheckpoint(shard, seq string) error {
+	t.forget(shard)
+	_, err := t.Client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(t.Name),
+		Key:       key(shard),
+		AttributeUpdates: map[string]*dynamodb.AttributeValueUpdate{
+			checkpoint:                   put(&dynamodb.AttributeValue{S: aws.String(seq)}),
+			checkpointSubSequenceNumber:  put(number(0)),
+			ownerSwitchesSinceCheckpoint: put(number(0)),
+			leaseCounter:                 add(number(1)),
+		},
+		Expected: map[string]*dynamodb.ExpectedAttributeValue{leaseKey: {Value: &dynamodb.AttributeValue{S: aws.String(shard)}}},
+	})
+
+	if conditionFailed(err) {
+		return fmt.Errorf("no such shard: %s has no lease in %s", shard, t.Name)
+	}
+	return err
+}
+
+func (t *Table) remember(lease *consumer.Lease) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.known == nil {
+		t.known = make(map[string]leaseState)
+	}
+	t.known[lease.ShardId] = stateOf(lease)
+}
+
+func (t *Table) forget(shard string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.known, shard)
+}
+
+// Return what the lease on shard looked like at counter, if it's known.
+func (t *Table) recall(shard string, counter int64) (leaseState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.known[shard]
+	return state, ok && state.counter == counter
+}
+
+func stateOf(lease *consumer.Lease) leaseState {
+	return leaseState{counter: lease.Counter, owner: lease.Owner, checkpoint: lease.Checkpoint}
+}
+
+func put(value *dynamodb.AttributeValue) *dynamodb.AttributeValueUpdate {
+	return &dynamodb.AttributeValueUpdate{Action: aws.String("PUT"), Value: value}
+}
+
+func add(value *dynamodb.AttributeValue) *dynamodb.AttributeValueUpdate {
+	return &dynamodb.AttributeValueUpdate{Action: aws.String("ADD"), Value: value}
+}
+
+type byShardId []*consumer.Lease
+
+func (b byShardId) Len() int           { return len(b) }
+func (b byShardId) Less(i, j int) bool { return b[i].ShardId < b[j].ShardId }
+func (b byShardId) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,422 @@
+package kcl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+	"github.com/blinsay/ktk/kinesistest"
+)
+
+const testTable = "test-app"
+
+// A local stand-in for DynamoDB that keeps a single table in memory and
+// understands the requests a Table makes. Scans return two items at a time so
+// that pagination gets exercised.
+type fakeDynamoDB struct {
+	*httptest.Server
+
+	sync.Mutex
+	created   bool
+	describes int
+	items     map[string]item
+}
+
+// Start a stand-in with the test table already created.
+func newFakeDynamoDB() *fakeDynamoDB {
+	f := &fakeDynamoDB{created: true, describes: 1, items: make(map[string]item)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeDynamoDB) serve(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=KEY/") {
+		writeError(w, "UnrecognizedClientException", "bad credentials")
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	var input struct {
+		TableName         string
+		Key               item
+		Item              item
+		ExclusiveStartKey item
+		Expected          map[string]*dynamodb.ExpectedAttributeValue
+		AttributeUpdates  map[string]*dynamodb.AttributeValueUpdate
+	}
+	json.Unmarshal(body, &input)
+
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	if operation == "CreateTable" && !f.created {
+		f.created = true
+		json.NewEncoder(w).Encode(struct{}{})
+		return
+	}
+	if input.TableName != testTable || !f.created {
+		writeError(w, "ResourceNotFoundException", "Requested resource not found")
+		return
+	}
+
+	var output interface{} = struct{}{}
+	switch operation {
+	case "CreateTable":
+		writeError(w, "ResourceInUseException", "Table already exists: "+input.TableName)
+		return
+	case "DescribeTable":
+		// new tables take a single describe to become active
+		status := "ACTIVE"
+		if f.describes == 0 {
+			status = "CREATING"
+		}
+		f.describes++
+		output = map[string]interface{}{"Table": map[string]string{"TableStatus": status}}
+	case "Scan":
+		var keys []string
+		for k := range f.items {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		start := 0
+		if input.ExclusiveStartKey != nil {
+			start = sort.SearchStrings(keys, input.ExclusiveStartKey.str(leaseKey)) + 1
+		}
+		end := start + 2
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		items := []item{}
+		for _, k := range keys[start:end] {
+			items = append(items, f.items[k])
+		}
+		scan := map[string]interface{}{"Items": items}
+		if end < len(keys) {
+			scan["LastEvaluatedKey"] = key(keys[end-1])
+		}
+		output = scan
+	case "GetItem":
+		output = map[string]interface{}{"Item": f.items[input.Key.str(leaseKey)]}
+	case "PutItem":
+		k := input.Item.str(leaseKey)
+		if !f.matches(f.items[k], input.Expected) {
+			writeError(w, "ConditionalCheckFailedException", "The conditional request failed")
+			return
+		}
+		f.items[k] = input.Item
+	case "UpdateItem":
+		k := input.Key.str(leaseKey)
+		current := f.items[k]
+		if !f.matches(current, input.Expected) {
+			writeError(w, "ConditionalCheckFailedException", "The conditional request failed")
+			return
+		}
+
+		updated := item{leaseKey: input.Key[leaseKey]}
+		for name, v := range current {
+			updated[name] = v
+		}
+		for name, u := range input.AttributeUpdates {
+			switch aws.StringValue(u.Action) {
+			case "PUT":
+				updated[name] = u.Value
+			case "DELETE":
+				delete(updated, name)
+			case "ADD":
+				n, _ := strconv.ParseInt(updated.num(name), 10, 64)
+				delta, _ := strconv.ParseInt(aws.StringValue(u.Value.N), 10, 64)
+				updated[name] = number(n + delta)
+			}
+		}
+		f.items[k] = updated
+	default:
+		writeError(w, "UnknownOperationException", "")
+		return
+	}
+
+	json.NewEncoder(w).Encode(output)
+}
+
+func (f *fakeDynamoDB) matches(i item, expected map[string]*dynamodb.ExpectedAttributeValue) bool {
+	for name, e := range expected {
+		v, exists := i[name]
+		if e.Exists != nil && *e.Exists != exists {
+			return false
+		}
+		if e.Value != nil && (!exists || !reflect.DeepEqual(v, e.Value)) {
+			return false
+		}
+	}
+	return true
+}
+
+func writeError(w http.ResponseWriter, code, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `{"__type":"com.amazonaws.dynamodb.v20120810#%s","message":%q}`, code, message)
+}
+
+func testTableAt(endpoint string) *Table {
+	return New(testTable, aws.NewConfig().
+		WithCredentials(credentials.NewStaticCredentials("KEY", "secret", "")).
+		WithRegion("us-east-1").
+		WithEndpoint(endpoint))
+}
+
+func TestCheckpoints(t *testing.T) {
+	dynamo := newFakeDynamoDB()
+	defer dynamo.Close()
+	table := testTableAt(dynamo.URL)
+
+	if seq, err := table.Checkpoint("shardId-000000000000"); seq != "" || err != nil {
+		t.Errorf("expected no checkpoint for a shard without a lease, got %q (%v)", seq, err)
+	}
+
+	table.CreateLease(&consumer.Lease{ShardId: "shardId-000000000000", Checkpoint: *consumer.TRIM_HORIZON})
+	if err := table.SetCheckpoint("shardId-000000000000", "1234"); err != nil {
+		t.Fatalf("unexpected error setting a checkpoint: %s", err)
+	}
+	if seq, err := table.Checkpoint("shardId-000000000000"); seq != "1234" || err != nil {
+		t.Errorf("expected to read back the checkpoint, got %q (%v)", seq, err)
+	}
+}
+
+// test that setting a checkpoint on a lease a KCL worker holds takes the lease
+// away from it, and leaves the rest of the lease alone.
+func TestSetCheckpointOnHeldLease(t *testing.T) {
+	dynamo := newFakeDynamoDB()
+	defer dynamo.Close()
+	table := testTableAt(dynamo.URL)
+
+	held := &consumer.Lease{ShardId: "shardId-000000000001", Owner: "kcl-worker", Counter: 5, Checkpoint: "1000", ParentShardIds: []string{"shardId-000000000000"}}
+	if created, err := table.CreateLease(held); !created || err != nil {
+		t.Fatalf("expected to create a lease, got %v (%v)", created, err)
+	}
+	dynamo.items[held.ShardId]["pendingCheckpoint"] = &dynamodb.AttributeValue{S: aws.String("1001")}
+
+	if err := table.SetCheckpoint(held.ShardId, *consumer.TRIM_HORIZON); err != nil {
+		t.Fatalf("unexpected error setting a checkpoint: %s", err)
+	}
+
+	lease, err := table.Lease(held.ShardId)
+	if err != nil {
+		t.Fatalf("unexpected error reading lease: %s", err)
+	}
+	expected := &consumer.Lease{ShardId: held.ShardId, Owner: "kcl-worker", Counter: 6, Checkpoint: "TRIM_HORIZON", ParentShardIds: held.ParentShardIds}
+	if !reflect.DeepEqual(lease, expected) {
+		t.Errorf("expected %+v, got %+v", expected, lease)
+	}
+	if dynamo.items[held.ShardId].str("pendingCheckpoint") != "1001" {
+		t.Errorf("expected attributes ktk doesn't know about to be kept")
+	}
+
+	held.Checkpoint = "2000"
+	if err := table.UpdateLease(held, 5); err != consumer.ErrLeaseLost {
+		t.Errorf("expected the old owner to have lost the lease, got %v", err)
+	}
+}
+
+// test that setting a checkpoint on a shard without a lease fails instead of
+// creating one.
+func TestSetCheckpointWithoutLease(t *testing.T) {
+	dynamo := newFakeDynamoDB()
+	defer dynamo.Close()
+	table := testTableAt(dynamo.URL)
+
+	err := table.SetCheckpoint("shardId-00000000000", "1234")
+	if err == nil || !strings.Contains(err.Error(), "no such shard") {
+		t.Errorf("expected a no such shard error, got %v", err)
+	}
+	if len(dynamo.items) != 0 {
+		t.Errorf("expected no leases to be created, got %v", dynamo.items)
+	}
+}
+
+func TestLeaseStore(t *testing.T) {
+	dynamo := newFakeDynamoDB()
+	defer dynamo.Close()
+	table := testTableAt(dynamo.URL)
+
+	for i := 4; i >= 0; i-- {
+		if _, err := table.CreateLease(&consumer.Lease{ShardId: fmt.Sprintf("shardId-%012d", i), Checkpoint: *consumer.LATEST}); err != nil {
+			t.Fatalf("unexpected error creating lease: %s", err)
+		}
+	}
+	if created, err := table.CreateLease(&consumer.Lease{ShardId: "shardId-000000000000"}); created || err != nil {
+		t.Errorf("expected not to create a duplicate lease, got %v (%v)", created, err)
+	}
+
+	taken := &consumer.Lease{ShardId: "shardId-000000000002", Owner: "a", Counter: 1, Checkpoint: "123"}
+	if err := table.UpdateLease(taken, 0); err != nil {
+		t.Fatalf("unexpected error updating lease: %s", err)
+	}
+	released := &consumer.Lease{ShardId: "shardId-000000000002", Counter: 2, Checkpoint: "123"}
+	if err := table.UpdateLease(released, 1); err != nil {
+		t.Fatalf("unexpected error updating lease: %s", err)
+	}
+
+	leases, err := table.Leases()
+	if err != nil {
+		t.Fatalf("unexpected error listing leases: %s", err)
+	}
+	if len(leases) != 5 {
+		t.Fatalf("expected 5 leases, got %d", len(leases))
+	}
+	for i, l := range leases {
+		if expected := fmt.Sprintf("shardId-%012d", i); l.ShardId != expected {
+			t.Errorf("expected lease %d to be %s, got %s", i, expected, l.ShardId)
+		}
+	}
+	if !reflect.DeepEqual(leases[2], released) {
+		t.Errorf("expected %+v, got %+v", released, leases[2])
+	}
+}
+
+// test that renewing and taking a lease leaves a KCL worker's checkpoint
+// alone, and that taking a lease from another owner counts an owner switch the
+// way the KCL does.
+func TestUpdateLeaseKeepsCheckpoint(t *testing.T) {
+	dynamo := newFakeDynamoDB()
+	defer dynamo.Close()
+	table := testTableAt(dynamo.URL)
+
+	shard := "shardId-000000000000"
+	table.CreateLease(&consumer.Lease{ShardId: shard, Owner: "kcl-worker", Counter: 3, Checkpoint: "1000"})
+	dynamo.items[shard][checkpointSubSequenceNumber] = number(7)
+
+	updates := []struct {
+		lease         *consumer.Lease
+		subSequence   string
+		ownerSwitches string
+		name          string
+	}{
+		{&consumer.Lease{ShardId: shard, Owner: "a", Counter: 4, Checkpoint: "1000"}, "7", "1", "taken"},
+		{&consumer.Lease{ShardId: shard, Owner: "a", Counter: 5, Checkpoint: "1000"}, "7", "1", "renewed"},
+		{&consumer.Lease{ShardId: shard, Counter: 6, Checkpoint: "1000"}, "7", "1", "released"},
+		{&consumer.Lease{ShardId: shard, Owner: "b", Counter: 7, Checkpoint: "1000"}, "7", "1", "taken after release"},
+		{&consumer.Lease{ShardId: shard, Owner: "b", Counter: 8, Checkpoint: "2000"}, "0", "0", "checkpointed"},
+	}
+
+	for _, u := range updates {
+		if err := table.UpdateLease(u.lease, u.lease.Counter-1); err != nil {
+			t.Fatalf("%s: unexpected error updating lease: %s", u.name, err)
+		}
+
+		i := dynamo.items[shard]
+		if actual := i.num(checkpointSubSequenceNumber); actual != u.subSequence {
+			t.Errorf("%s: expected sub-sequence number %s, got %s", u.name, u.subSequence, actual)
+		}
+		if actual := i.num(ownerSwitchesSinceCheckpoint); actual != u.ownerSwitches {
+			t.Errorf("%s: expected %s owner switches, got %s", u.name, u.ownerSwitches, actual)
+		}
+		if actual := i.str(checkpoint); actual != u.lease.Checkpoint {
+			t.Errorf("%s: expected checkpoint %s, got %s", u.name, u.lease.Checkpoint, actual)
+		}
+	}
+}
+
+// test that a Table that hasn't seen a lease yet reads it before updating it.
+func TestUpdateUnseenLease(t *testing.T) {
+	dynamo := newFakeDynamoDB()
+	defer dynamo.Close()
+
+	shard := "shardId-000000000000"
+	testTableAt(dynamo.URL).CreateLease(&consumer.Lease{ShardId: shard, Owner: "kcl-worker", Counter: 3, Checkpoint: "1000"})
+	dynamo.items[shard][checkpointSubSequenceNumber] = number(7)
+
+	table := testTableAt(dynamo.URL)
+	if err := table.UpdateLease(&consumer.Lease{ShardId: shard, Owner: "a", Counter: 3, Checkpoint: "1000"}, 2); err != consumer.ErrLeaseLost {
+		t.Errorf("expected a stale update to fail with ErrLeaseLost, got %v", err)
+	}
+	if err := table.UpdateLease(&consumer.Lease{ShardId: shard, Owner: "a", Counter: 4, Checkpoint: "1000"}, 3); err != nil {
+		t.Fatalf("unexpected error updating lease: %s", err)
+	}
+	if actual := dynamo.items[shard].num(checkpointSubSequenceNumber); actual != "7" {
+		t.Errorf("expected the sub-sequence number to be kept, got %s", actual)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dynamo := newFakeDynamoDB()
+	defer dynamo.Close()
+	dynamo.created, dynamo.describes = false, 0
+	createPollInterval = time.Millisecond
+
+	table := testTableAt(dynamo.URL)
+	if err := table.Create(); err != nil {
+		t.Fatalf("unexpected error creating table: %s", err)
+	}
+	if dynamo.describes != 2 {
+		t.Errorf("expected to wait for the table to become active")
+	}
+
+	if err := table.Create(); err != nil {
+		t.Errorf("expected creating an existing table to succeed, got %s", err)
+	}
+	if _, err := table.Leases(); err != nil {
+		t.Errorf("unexpected error reading a new table: %s", err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	dynamo := newFakeDynamoDB()
+	defer dynamo.Close()
+
+	table := testTableAt(dynamo.URL)
+	table.Name = "missing"
+
+	_, err := table.Leases()
+	if failure, ok := err.(awserr.RequestFailure); !ok || failure.Code() != "ResourceNotFoundException" || failure.StatusCode() != 400 {
+		t.Errorf("expected a ResourceNotFoundException, got %v", err)
+	}
+}
+
+// test that ktk consumers can divide a stream using a lease table.
+func TestConsumeWithLeases(t *testing.T) {
+	dynamo := newFakeDynamoDB()
+	defer dynamo.Close()
+	table := testTableAt(dynamo.URL)
+
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String("stream"), ShardCount: aws.Int64(2)})
+
+	for _, id := range []string{"a", "b"} {
+		c, err := consumer.Start("stream", consumer.TRIM_HORIZON, false, func([]*kinesis.Record) {},
+			consumer.WithClient(fake),
+			consumer.WithLeases(table, id),
+			consumer.WithLeaseTimeout(100*time.Millisecond),
+		)
+		if err != nil {
+			t.Fatalf("unexpected error starting consumer: %s", err)
+		}
+		defer c.Close()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		leases, _ := table.Leases()
+		if len(leases) == 2 && leases[0].Owner != "" && leases[1].Owner != "" && leases[0].Owner != leases[1].Owner {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	leases, _ := table.Leases()
+	t.Errorf("expected each worker to hold a lease, got %+v %+v", leases[0], leases[1])
+}
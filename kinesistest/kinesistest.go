@@ -0,0 +1,734 @@
+// Package kinesistest provides an in-memory fake of the Kinesis API for tests.
+//
+// A Kinesis has the same methods as the SDK's *kinesis.Kinesis for creating,
+// describing and resharding streams, putting and getting records, and tagging
+// streams, so it can be passed to producer.WithClient and consumer.WithClient
+// or anywhere else a Kinesis client interface is used.
+//
+// Streams behave like the real thing as far as a client can tell: records are
+// routed to shards by the MD5 hash of their partition key, sequence numbers
+// increase monotonically across a stream, shard iterators support every
+// iterator type, and splitting or merging shards closes the parents and
+// creates children. Streams are ACTIVE as soon as they're created and records
+// are never trimmed.
+//
+// Failures can be injected with PutFault and Fault.
+package kinesistest
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Error codes returned by the fake. They match the codes Kinesis uses.
+const (
+	ResourceNotFound              = "ResourceNotFoundException"
+	ResourceInUse                 = "ResourceInUseException"
+	InvalidArgument               = "InvalidArgumentException"
+	ProvisionedThroughputExceeded = "ProvisionedThroughputExceededException"
+	InternalFailure               = "InternalFailure"
+)
+
+// The largest hash key. Hash keys are 128 bit unsigned integers.
+var MaxHashKey = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 128), big.NewInt(1))
+
+// The default number of records returned by GetRecords.
+const defaultGetRecordsLimit = 10000
+
+// A Kinesis is an in-memory fake of the Kinesis API. The zero value is not
+// usable; create one with New. A Kinesis is safe to use from multiple
+// goroutines.
+type Kinesis struct {
+	// If set, called with the stream and shard every record written with
+	// PutRecord or PutRecords is routed to. Returning a non-empty error code
+	// (e.g. ProvisionedThroughputExceeded) fails the record instead of writing
+	// it. For PutRecord, the whole request fails.
+	PutFault func(stream, shard string) string
+
+	// If set, called with the name of every operation (e.g. "GetRecords")
+	// before it runs. Returning an error fails the operation with that error.
+	// Use Error to create errors that look like they came from Kinesis.
+	Fault func(operation string) error
+
+	// Returns the time records arrive at. Defaults to time.Now.
+	Now func() time.Time
+
+	mu      sync.Mutex
+	streams map[string]*stream
+}
+
+type stream struct {
+	name    string
+	shards  []*shard
+	tags    map[string]string
+	lastSeq int64
+}
+
+type shard struct {
+	id                 string
+	parent, adjacent   string
+	startHash, endHash *big.Int
+	startSeq, endSeq   int64
+	closed             bool
+	records            []*kinesis.Record
+	sequenceNumbers    []int64
+}
+
+// Create an empty fake.
+func New() *Kinesis {
+	return &Kinesis{Now: time.Now, streams: make(map[string]*stream)}
+}
+
+// Create an error with the given code and message, like the errors the SDK
+// returns for failed requests.
+func Error(code, message string) error {
+	status := http.StatusBadRequest
+	if code == InternalFailure {
+		status = http.StatusInternalServerError
+	}
+	return awserr.NewRequestFailure(awserr.New(code, message, nil), status, "")
+}
+
+func (k *Kinesis) fault(operation string) error {
+	if k.Fault == nil {
+		return nil
+	}
+	return k.Fault(operation)
+}
+
+func (k *Kinesis) now() time.Time {
+	if k.Now == nil {
+		return time.Now()
+	}
+	return k.Now()
+}
+
+func (k *Kinesis) stream(name *string) (*stream, error) {
+	s, ok := k.streams[aws.StringValue(name)]
+	if !ok {
+		return nil, Error(ResourceNotFound, fmt.Sprintf("Stream %s not found", aws.StringValue(name)))
+	}
+	return s, nil
+}
+
+func (s *stream) shard(id *string) (*shard, error) {
+	for _, sh := range s.shards {
+		if sh.id == aws.StringValue(id) {
+			return sh, nil
+		}
+	}
+	return nil, Error(ResourceNotFound, fmt.Sprintf("Shard %s in stream %s not found", aws.StringValue(id), s.name))
+}
+
+func (s *stream) newShard(parent, adjacent string, start, end *big.Int) *shard {
+	sh := &shard{
+		id:        fmt.Sprintf("shardId-%012d", len(s.shards)),
+		parent:    parent,
+		adjacent:  adjacent,
+		startHash: start,
+		endHash:   end,
+		startSeq:  s.lastSeq + 1,
+	}
+	s.shards = append(s.shards, sh)
+	return sh
+}
+
+// Route a record to the open shard that owns its hash key.
+func (s *stream) route(partitionKey, explicitHashKey *string) (*shard, error) {
+	var hash *big.Int
+	if explicitHashKey != nil {
+		h, ok := new(big.Int).SetString(*explicitHashKey, 10)
+		if !ok || h.Sign() < 0 || h.Cmp(MaxHashKey) > 0 {
+			return nil, Error(InvalidArgument, fmt.Sprintf("Invalid ExplicitHashKey %s", *explicitHashKey))
+		}
+		hash = h
+	} else {
+		hash = HashKey(aws.StringValue(partitionKey))
+	}
+
+	for _, sh := range s.shards {
+		if !sh.closed && sh.startHash.Cmp(hash) <= 0 && hash.Cmp(sh.endHash) <= 0 {
+			return sh, nil
+		}
+	}
+	return nil, Error(InternalFailure, "no open shard for hash key "+hash.String())
+}
+
+// Return the hash key Kinesis uses to route a partition key: its MD5 hash as
+// a 128 bit unsigned integer.
+func HashKey(partitionKey string) *big.Int {
+	sum := md5.Sum([]byte(partitionKey))
+	return new(big.Int).SetBytes(sum[:])
+}
+
+// Sequence numbers are formatted as 56 digit decimal strings, like the ones
+// Kinesis hands out, so that they sort the same way as strings and numbers.
+func formatSequenceNumber(seq int64) string {
+	return fmt.Sprintf("4955%052d", seq)
+}
+
+func parseSequenceNumber(s string) (int64, error) {
+	if len(s) != 56 || !strings.HasPrefix(s, "4955") {
+		return 0, Error(InvalidArgument, fmt.Sprintf("Invalid sequence number %s", s))
+	}
+	seq, err := strconv.ParseInt(s[4:], 10, 64)
+	if err != nil {
+		return 0, Error(InvalidArgument, fmt.Sprintf("Invalid sequence number %s", s))
+	}
+	return seq, nil
+}
+
+func (s *stream) put(sh *shard, partitionKey *string, data []byte, at time.Time) string {
+	s.lastSeq++
+	seq := formatSequenceNumber(s.lastSeq)
+	arrival := at
+
+	sh.records = append(sh.records, &kinesis.Record{
+		ApproximateArrivalTimestamp: &arrival,
+		Data:                        append([]byte{}, data...),
+		PartitionKey:                aws.String(aws.StringValue(partitionKey)),
+		SequenceNumber:              aws.String(seq),
+	})
+	sh.sequenceNumbers = append(sh.sequenceNumbers, s.lastSeq)
+	return seq
+}
+
+func (k *Kinesis) CreateStream(input *kinesis.CreateStreamInput) (*kinesis.CreateStreamOutput, error) {
+	if err := k.fault("CreateStream"); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	name := aws.StringValue(input.StreamName)
+	if name == "" {
+		return nil, Error(InvalidArgument, "StreamName is required")
+	}
+	if _, ok := k.streams[name]; ok {
+		return nil, Error(ResourceInUse, fmt.Sprintf("Stream %s already exists", name))
+	}
+
+	count := aws.Int64Value(input.ShardCount)
+	if count < 1 {
+		return nil, Error(InvalidArgument, "ShardCount must be at least 1")
+	}
+
+	s := &stream{name: name, tags: make(map[string]string)}
+
+	// split the hash key space evenly, giving the last shard any remainder
+	width := new(big.Int).Div(new(big.Int).Add(MaxHashKey, big.NewInt(1)), big.NewInt(count))
+	for i := int64(0); i < count; i++ {
+		start := new(big.Int).Mul(width, big.NewInt(i))
+		end := new(big.Int).Sub(new(big.Int).Add(start, width), big.NewInt(1))
+		if i == count-1 {
+			end = new(big.Int).Set(MaxHashKey)
+		}
+		s.newShard("", "", start, end)
+	}
+
+	k.streams[name] = s
+	return &kinesis.CreateStreamOutput{}, nil
+}
+
+func (k *Kinesis) DeleteStream(input *kinesis.DeleteStreamInput) (*kinesis.DeleteStreamOutput, error) {
+	if err := k.fault("DeleteStream"); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, err := k.stream(input.StreamName); err != nil {
+		return nil, err
+	}
+	delete(k.streams, *input.StreamName)
+	return &kinesis.DeleteStreamOutput{}, nil
+}
+
+func (k *Kinesis) ListStreams(input *kinesis.ListStreamsInput) (*kinesis.ListStreamsOutput, error) {
+	if err := k.fault("ListStreams"); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var names []string
+	for name := range k.streams {
+		if input.ExclusiveStartStreamName == nil || name > *input.ExclusiveStartStreamName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	more := false
+	if limit := int(aws.Int64Value(input.Limit)); limit > 0 && len(names) > limit {
+		names, more = names[:limit], true
+	}
+
+	return &kinesis.ListStreamsOutput{
+		StreamNames:    aws.StringSlice(names),
+		HasMoreStreams: aws.Bool(more),
+	}, nil
+}
+
+func (k *Kinesis) DescribeStream(input *kinesis.DescribeStreamInput) (*kinesis.DescribeStreamOutput, error) {
+	if err := k.fault("DescribeStream"); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, err := k.stream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	var shards []*kinesis.Shard
+	for _, sh := range s.shards {
+		if input.ExclusiveStartShardId == nil || sh.id > *input.ExclusiveStartShardId {
+			shards = append(shards, sh.describe())
+		}
+	}
+
+	more := false
+	if limit := int(aws.Int64Value(input.Limit)); limit > 0 && len(shards) > limit {
+		shards, more = shards[:limit], true
+	}
+
+	return &kinesis.DescribeStreamOutput{
+		StreamDescription: &kinesis.StreamDescription{
+			StreamName:    aws.String(s.name),
+			StreamARN:     aws.String("arn:aws:kinesis:us-east-1:000000000000:stream/" + s.name),
+			StreamStatus:  aws.String(kinesis.StreamStatusActive),
+			Shards:        shards,
+			HasMoreShards: aws.Bool(more),
+		},
+	}, nil
+}
+
+func (sh *shard) describe() *kinesis.Shard {
+	d := &kinesis.Shard{
+		ShardId: aws.String(sh.id),
+		HashKeyRange: &kinesis.HashKeyRange{
+			StartingHashKey: aws.String(sh.startHash.String()),
+			EndingHashKey:   aws.String(sh.endHash.String()),
+		},
+		SequenceNumberRange: &kinesis.SequenceNumberRange{
+			StartingSequenceNumber: aws.String(formatSequenceNumber(sh.startSeq)),
+		},
+	}
+	if sh.parent != "" {
+		d.ParentShardId = aws.String(sh.parent)
+	}
+	if sh.adjacent != "" {
+		d.AdjacentParentShardId = aws.String(sh.adjacent)
+	}
+	if sh.closed {
+		d.SequenceNumberRange.EndingSequenceNumber = aws.String(formatSequenceNumber(sh.endSeq))
+	}
+	return d
+}
+
+func (k *Kinesis) PutRecord(input *kinesis.PutRecordInput) (*kinesis.PutRecordOutput, error) {
+	if err := k.fault("PutRecord"); err != nil {
+		return nil, err
+	}
+	if err := validateRecord(input.PartitionKey, input.Data); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, err := k.stream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	sh, err := s.route(input.PartitionKey, input.ExplicitHashKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.PutFault != nil {
+		if code := k.PutFault(s.name, sh.id); code != "" {
+			return nil, Error(code, "injected failure")
+		}
+	}
+
+	seq := s.put(sh, input.PartitionKey, input.Data, k.now())
+	return &kinesis.PutRecordOutput{ShardId: aws.String(sh.id), SequenceNumber: aws.String(seq)}, nil
+}
+
+func (k *Kinesis) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+	if err := k.fault("PutRecords"); err != nil {
+		return nil, err
+	}
+	if len(input.Records) == 0 || len(input.Records) > 500 {
+		return nil, Error(InvalidArgument, "PutRecords takes between 1 and 500 records")
+	}
+	for _, r := range input.Records {
+		if err := validateRecord(r.PartitionKey, r.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, err := k.stream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	now := k.now()
+	output := &kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+	for _, r := range input.Records {
+		sh, err := s.route(r.PartitionKey, r.ExplicitHashKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if k.PutFault != nil {
+			if code := k.PutFault(s.name, sh.id); code != "" {
+				*output.FailedRecordCount++
+				output.Records = append(output.Records, &kinesis.PutRecordsResultEntry{
+					ErrorCode:    aws.String(code),
+					ErrorMessage: aws.String("injected failure"),
+				})
+				continue
+			}
+		}
+
+		seq := s.put(sh, r.PartitionKey, r.Data, now)
+		output.Records = append(output.Records, &kinesis.PutRecordsResultEntry{
+			ShardId:        aws.String(sh.id),
+			SequenceNumber: aws.String(seq),
+		})
+	}
+	return output, nil
+}
+
+func validateRecord(partitionKey *string, data []byte) error {
+	if n := len(aws.StringValue(partitionKey)); n < 1 || n > 256 {
+		return Error(InvalidArgument, "PartitionKey must be between 1 and 256 characters")
+	}
+	if len(data) > 1024*1024 {
+		return Error(InvalidArgument, "Data must be at most 1MB")
+	}
+	return nil
+}
+
+// The position a shard iterator points at.
+type iterator struct {
+	Stream string `json:"stream"`
+	Shard  string `json:"shard"`
+	// The index of the next record to read.
+	Index int `json:"index"`
+}
+
+func encodeIterator(it iterator) *string {
+	bs, _ := json.Marshal(it)
+	return aws.String(base64.StdEncoding.EncodeToString(bs))
+}
+
+func decodeIterator(s string) (iterator, error) {
+	var it iterator
+	bs, err := base64.StdEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(bs, &it)
+	}
+	if err != nil {
+		return it, Error(InvalidArgument, "Invalid ShardIterator")
+	}
+	return it, nil
+}
+
+func (k *Kinesis) GetShardIterator(input *kinesis.GetShardIteratorInput) (*kinesis.GetShardIteratorOutput, error) {
+	if err := k.fault("GetShardIterator"); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, err := k.stream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	sh, err := s.shard(input.ShardId)
+	if err != nil {
+		return nil, err
+	}
+
+	it := iterator{Stream: s.name, Shard: sh.id}
+	switch aws.StringValue(input.ShardIteratorType) {
+	case kinesis.ShardIteratorTypeTrimHorizon:
+	case kinesis.ShardIteratorTypeLatest:
+		it.Index = len(sh.records)
+	case kinesis.ShardIteratorTypeAtSequenceNumber, kinesis.ShardIteratorTypeAfterSequenceNumber:
+		seq, err := parseSequenceNumber(aws.StringValue(input.StartingSequenceNumber))
+		if err != nil {
+			return nil, err
+		}
+		if seq < sh.startSeq || (sh.closed && seq > sh.endSeq) {
+			return nil, Error(InvalidArgument, fmt.Sprintf("StartingSequenceNumber %s is not in shard %s", *input.StartingSequenceNumber, sh.id))
+		}
+
+		// the index of the first record at or after seq
+		it.Index = sort.Search(len(sh.sequenceNumbers), func(i int) bool { return sh.sequenceNumbers[i] >= seq })
+		if *input.ShardIteratorType == kinesis.ShardIteratorTypeAfterSequenceNumber &&
+			it.Index < len(sh.sequenceNumbers) && sh.sequenceNumbers[it.Index] == seq {
+			it.Index++
+		}
+	default:
+		return nil, Error(InvalidArgument, fmt.Sprintf("Invalid ShardIteratorType %s", aws.StringValue(input.ShardIteratorType)))
+	}
+
+	return &kinesis.GetShardIteratorOutput{ShardIterator: encodeIterator(it)}, nil
+}
+
+func (k *Kinesis) GetRecords(input *kinesis.GetRecordsInput) (*kinesis.GetRecordsOutput, error) {
+	if err := k.fault("GetRecords"); err != nil {
+		return nil, err
+	}
+
+	it, err := decodeIterator(aws.StringValue(input.ShardIterator))
+	if err != nil {
+		return nil, err
+	}
+
+	limit := int(aws.Int64Value(input.Limit))
+	if limit < 1 || limit > defaultGetRecordsLimit {
+		limit = defaultGetRecordsLimit
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, ok := k.streams[it.Stream]
+	if !ok {
+		return nil, Error(ResourceNotFound, fmt.Sprintf("Stream %s not found", it.Stream))
+	}
+	sh, err := s.shard(aws.String(it.Shard))
+	if err != nil {
+		return nil, err
+	}
+
+	end := it.Index + limit
+	if end > len(sh.records) {
+		end = len(sh.records)
+	}
+
+	records := make([]*kinesis.Record, 0, end-it.Index)
+	for _, r := range sh.records[it.Index:end] {
+		copied := *r
+		records = append(records, &copied)
+	}
+
+	var behind int64
+	if end < len(sh.records) {
+		behind = int64(k.now().Sub(*sh.records[end].ApproximateArrivalTimestamp) / time.Millisecond)
+		if behind < 0 {
+			behind = 0
+		}
+	}
+
+	output := &kinesis.GetRecordsOutput{
+		Records:            records,
+		MillisBehindLatest: aws.Int64(behind),
+	}
+
+	// closed shards stop returning iterators once they've been read to the end
+	if !sh.closed || end < len(sh.records) {
+		output.NextShardIterator = encodeIterator(iterator{Stream: s.name, Shard: sh.id, Index: end})
+	}
+	return output, nil
+}
+
+func (k *Kinesis) SplitShard(input *kinesis.SplitShardInput) (*kinesis.SplitShardOutput, error) {
+	if err := k.fault("SplitShard"); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, err := k.stream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := s.shard(input.ShardToSplit)
+	if err != nil {
+		return nil, err
+	}
+	if parent.closed {
+		return nil, Error(ResourceInUse, fmt.Sprintf("Shard %s is closed", parent.id))
+	}
+
+	split, ok := new(big.Int).SetString(aws.StringValue(input.NewStartingHashKey), 10)
+	if !ok || split.Cmp(parent.startHash) <= 0 || split.Cmp(parent.endHash) > 0 {
+		return nil, Error(InvalidArgument, fmt.Sprintf("NewStartingHashKey %s is not inside shard %s", aws.StringValue(input.NewStartingHashKey), parent.id))
+	}
+
+	s.close(parent)
+	s.newShard(parent.id, "", parent.startHash, new(big.Int).Sub(split, big.NewInt(1)))
+	s.newShard(parent.id, "", split, parent.endHash)
+	return &kinesis.SplitShardOutput{}, nil
+}
+
+func (k *Kinesis) MergeShards(input *kinesis.MergeShardsInput) (*kinesis.MergeShardsOutput, error) {
+	if err := k.fault("MergeShards"); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, err := k.stream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	first, err := s.shard(input.ShardToMerge)
+	if err != nil {
+		return nil, err
+	}
+	second, err := s.shard(input.AdjacentShardToMerge)
+	if err != nil {
+		return nil, err
+	}
+	if first.closed || second.closed {
+		return nil, Error(ResourceInUse, "Can't merge closed shards")
+	}
+
+	lower, upper := first, second
+	if upper.startHash.Cmp(lower.startHash) < 0 {
+		lower, upper = upper, lower
+	}
+	if new(big.Int).Add(lower.endHash, big.NewInt(1)).Cmp(upper.startHash) != 0 {
+		return nil, Error(InvalidArgument, fmt.Sprintf("Shards %s and %s are not adjacent", first.id, second.id))
+	}
+
+	s.close(first)
+	s.close(second)
+	s.newShard(first.id, second.id, lower.startHash, upper.endHash)
+	return &kinesis.MergeShardsOutput{}, nil
+}
+
+func (s *stream) close(sh *shard) {
+	sh.closed = true
+	sh.endSeq = s.lastSeq
+	if len(sh.sequenceNumbers) > 0 {
+		sh.endSeq = sh.sequenceNumbers[len(sh.sequenceNumbers)-1]
+	}
+}
+
+func (k *Kinesis) AddTagsToStream(input *kinesis.AddTagsToStreamInput) (*kinesis.AddTagsToStreamOutput, error) {
+	if err := k.fault("AddTagsToStream"); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, err := k.stream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range input.Tags {
+		s.tags[key] = aws.StringValue(value)
+	}
+	return &kinesis.AddTagsToStreamOutput{}, nil
+}
+
+func (k *Kinesis) RemoveTagsFromStream(input *kinesis.RemoveTagsFromStreamInput) (*kinesis.RemoveTagsFromStreamOutput, error) {
+	if err := k.fault("RemoveTagsFromStream"); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, err := k.stream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range input.TagKeys {
+		delete(s.tags, aws.StringValue(key))
+	}
+	return &kinesis.RemoveTagsFromStreamOutput{}, nil
+}
+
+func (k *Kinesis) ListTagsForStream(input *kinesis.ListTagsForStreamInput) (*kinesis.ListTagsForStreamOutput, error) {
+	if err := k.fault("ListTagsForStream"); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, err := k.stream(input.StreamName)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for key := range s.tags {
+		if input.ExclusiveStartTagKey == nil || key > *input.ExclusiveStartTagKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	more := false
+	if limit := int(aws.Int64Value(input.Limit)); limit > 0 && len(keys) > limit {
+		keys, more = keys[:limit], true
+	}
+
+	tags := make([]*kinesis.Tag, len(keys))
+	for i, key := range keys {
+		tags[i] = &kinesis.Tag{Key: aws.String(key), Value: aws.String(s.tags[key])}
+	}
+	return &kinesis.ListTagsForStreamOutput{Tags: tags, HasMoreTags: aws.Bool(more)}, nil
+}
+
+// Return every record in stream, in the order they were written. Returns nil
+// if the stream doesn't exist.
+func (k *Kinesis) Records(stream string) []*kinesis.Record {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	s, ok := k.streams[stream]
+	if !ok {
+		return nil
+	}
+
+	var records []*kinesis.Record
+	for _, sh := range s.shards {
+		records = append(records, sh.records...)
+	}
+	sort.Sort(bySequenceNumber(records))
+	return records
+}
+
+type bySequenceNumber []*kinesis.Record
+
+func (b bySequenceNumber) Len() int           { return len(b) }
+func (b bySequenceNumber) Less(i, j int) bool { return *b[i].SequenceNumber < *b[j].SequenceNumber }
+func (b bySequenceNumber) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
@@ -0,0 +1,345 @@
+package kinesistest
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const testStream = "test"
+
+func withStream(t *testing.T, shards int64) *Kinesis {
+	k := New()
+	_, err := k.CreateStream(&kinesis.CreateStreamInput{
+		StreamName: aws.String(testStream),
+		ShardCount: aws.Int64(shards),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error creating stream: %s", err)
+	}
+	return k
+}
+
+func describe(t *testing.T, k *Kinesis) []*kinesis.Shard {
+	resp, err := k.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String(testStream)})
+	if err != nil {
+		t.Fatalf("unexpected error describing stream: %s", err)
+	}
+	return resp.StreamDescription.Shards
+}
+
+func put(t *testing.T, k *Kinesis, key, data string) *kinesis.PutRecordOutput {
+	resp, err := k.PutRecord(&kinesis.PutRecordInput{
+		StreamName:   aws.String(testStream),
+		PartitionKey: aws.String(key),
+		Data:         []byte(data),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting record: %s", err)
+	}
+	return resp
+}
+
+func shardIterator(t *testing.T, k *Kinesis, shard, iterType, seq string) *string {
+	input := &kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(testStream),
+		ShardId:           aws.String(shard),
+		ShardIteratorType: aws.String(iterType),
+	}
+	if seq != "" {
+		input.StartingSequenceNumber = aws.String(seq)
+	}
+
+	resp, err := k.GetShardIterator(input)
+	if err != nil {
+		t.Fatalf("unexpected error getting %s iterator: %s", iterType, err)
+	}
+	return resp.ShardIterator
+}
+
+func readAll(t *testing.T, k *Kinesis, iter *string) ([]string, *string) {
+	resp, err := k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iter})
+	if err != nil {
+		t.Fatalf("unexpected error getting records: %s", err)
+	}
+
+	var data []string
+	for _, r := range resp.Records {
+		data = append(data, string(r.Data))
+	}
+	return data, resp.NextShardIterator
+}
+
+func errCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return ""
+}
+
+func TestCreateStreamHashRanges(t *testing.T) {
+	k := withStream(t, 3)
+	shards := describe(t, k)
+
+	if len(shards) != 3 {
+		t.Fatalf("expected 3 shards, got %d", len(shards))
+	}
+
+	next := big.NewInt(0)
+	for _, s := range shards {
+		start, _ := new(big.Int).SetString(*s.HashKeyRange.StartingHashKey, 10)
+		end, _ := new(big.Int).SetString(*s.HashKeyRange.EndingHashKey, 10)
+		if start.Cmp(next) != 0 {
+			t.Errorf("%s: expected hash range to start at %s, got %s", *s.ShardId, next, start)
+		}
+		next = new(big.Int).Add(end, big.NewInt(1))
+	}
+	if last := new(big.Int).Sub(next, big.NewInt(1)); last.Cmp(MaxHashKey) != 0 {
+		t.Errorf("expected hash ranges to cover every key. last key is %s", last)
+	}
+
+	if _, err := k.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(testStream), ShardCount: aws.Int64(1)}); errCode(err) != ResourceInUse {
+		t.Errorf("expected creating a duplicate stream to fail with %s, got %v", ResourceInUse, err)
+	}
+}
+
+func TestPutRoutesByHashKey(t *testing.T) {
+	k := withStream(t, 4)
+	shards := describe(t, k)
+
+	var last string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		resp := put(t, k, key, key)
+
+		hash := HashKey(key)
+		for _, s := range shards {
+			if *s.ShardId != *resp.ShardId {
+				continue
+			}
+			start, _ := new(big.Int).SetString(*s.HashKeyRange.StartingHashKey, 10)
+			end, _ := new(big.Int).SetString(*s.HashKeyRange.EndingHashKey, 10)
+			if hash.Cmp(start) < 0 || hash.Cmp(end) > 0 {
+				t.Errorf("%s was routed to %s, which doesn't own its hash key", key, *s.ShardId)
+			}
+		}
+
+		if *resp.SequenceNumber <= last {
+			t.Errorf("expected sequence numbers to increase. got %s after %s", *resp.SequenceNumber, last)
+		}
+		last = *resp.SequenceNumber
+	}
+
+	if records := k.Records(testStream); len(records) != 100 {
+		t.Errorf("expected 100 records, got %d", len(records))
+	}
+}
+
+func TestIteratorTypes(t *testing.T) {
+	k := withStream(t, 1)
+	var seqs []string
+	for _, data := range []string{"a", "b", "c"} {
+		seqs = append(seqs, *put(t, k, "key", data).SequenceNumber)
+	}
+
+	shard := "shardId-000000000000"
+	testCases := []struct {
+		iterType string
+		seq      string
+		expected []string
+	}{
+		{kinesis.ShardIteratorTypeTrimHorizon, "", []string{"a", "b", "c"}},
+		{kinesis.ShardIteratorTypeLatest, "", nil},
+		{kinesis.ShardIteratorTypeAtSequenceNumber, seqs[1], []string{"b", "c"}},
+		{kinesis.ShardIteratorTypeAfterSequenceNumber, seqs[1], []string{"c"}},
+	}
+
+	for _, tc := range testCases {
+		data, next := readAll(t, k, shardIterator(t, k, shard, tc.iterType, tc.seq))
+		if fmt.Sprint(data) != fmt.Sprint(tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.iterType, tc.expected, data)
+		}
+		if next == nil {
+			t.Errorf("%s: expected an open shard to return a next iterator", tc.iterType)
+		}
+	}
+
+	// iterators keep reading new records
+	_, next := readAll(t, k, shardIterator(t, k, shard, kinesis.ShardIteratorTypeLatest, ""))
+	put(t, k, "key", "d")
+	if data, _ := readAll(t, k, next); fmt.Sprint(data) != "[d]" {
+		t.Errorf("expected to read a new record from LATEST, got %v", data)
+	}
+}
+
+func TestGetRecordsLimit(t *testing.T) {
+	k := withStream(t, 1)
+	for i := 0; i < 5; i++ {
+		put(t, k, "key", fmt.Sprint(i))
+	}
+
+	resp, err := k.GetRecords(&kinesis.GetRecordsInput{
+		ShardIterator: shardIterator(t, k, "shardId-000000000000", kinesis.ShardIteratorTypeTrimHorizon, ""),
+		Limit:         aws.Int64(2),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(resp.Records) != 2 {
+		t.Errorf("expected 2 records, got %d", len(resp.Records))
+	}
+
+	data, _ := readAll(t, k, resp.NextShardIterator)
+	if fmt.Sprint(data) != "[2 3 4]" {
+		t.Errorf("expected the rest of the records, got %v", data)
+	}
+}
+
+func TestSplitAndMerge(t *testing.T) {
+	k := withStream(t, 1)
+	put(t, k, "key", "before")
+
+	parent := "shardId-000000000000"
+	iter := shardIterator(t, k, parent, kinesis.ShardIteratorTypeTrimHorizon, "")
+
+	half := new(big.Int).Rsh(MaxHashKey, 1)
+	_, err := k.SplitShard(&kinesis.SplitShardInput{
+		StreamName:         aws.String(testStream),
+		ShardToSplit:       aws.String(parent),
+		NewStartingHashKey: aws.String(half.String()),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error splitting: %s", err)
+	}
+
+	shards := describe(t, k)
+	if len(shards) != 3 {
+		t.Fatalf("expected a parent and two children, got %d shards", len(shards))
+	}
+	if shards[0].SequenceNumberRange.EndingSequenceNumber == nil {
+		t.Errorf("expected the parent to be closed")
+	}
+	for _, child := range shards[1:] {
+		if aws.StringValue(child.ParentShardId) != parent {
+			t.Errorf("expected %s to have parent %s, got %v", *child.ShardId, parent, child.ParentShardId)
+		}
+	}
+
+	// reading the parent to the end returns no next iterator
+	data, next := readAll(t, k, iter)
+	if fmt.Sprint(data) != "[before]" || next != nil {
+		t.Errorf("expected to read the parent to the end. got %v with next iterator %v", data, next)
+	}
+
+	// new records go to the children
+	if resp := put(t, k, "key", "after"); *resp.ShardId == parent {
+		t.Errorf("expected a record put after the split to go to a child")
+	}
+
+	_, err = k.MergeShards(&kinesis.MergeShardsInput{
+		StreamName:           aws.String(testStream),
+		ShardToMerge:         shards[1].ShardId,
+		AdjacentShardToMerge: shards[2].ShardId,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error merging: %s", err)
+	}
+
+	shards = describe(t, k)
+	merged := shards[len(shards)-1]
+	if *merged.ParentShardId != "shardId-000000000001" || *merged.AdjacentParentShardId != "shardId-000000000002" {
+		t.Errorf("unexpected parents for merged shard: %s", merged)
+	}
+	if *merged.HashKeyRange.StartingHashKey != "0" || *merged.HashKeyRange.EndingHashKey != MaxHashKey.String() {
+		t.Errorf("expected the merged shard to cover every key: %s", merged)
+	}
+
+	_, err = k.MergeShards(&kinesis.MergeShardsInput{
+		StreamName:           aws.String(testStream),
+		ShardToMerge:         shards[1].ShardId,
+		AdjacentShardToMerge: shards[2].ShardId,
+	})
+	if errCode(err) != ResourceInUse {
+		t.Errorf("expected merging closed shards to fail with %s, got %v", ResourceInUse, err)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	k := withStream(t, 2)
+	k.PutFault = func(stream, shard string) string {
+		if shard == "shardId-000000000000" {
+			return ProvisionedThroughputExceeded
+		}
+		return ""
+	}
+
+	var entries []*kinesis.PutRecordsRequestEntry
+	for i := 0; i < 20; i++ {
+		entries = append(entries, &kinesis.PutRecordsRequestEntry{
+			PartitionKey: aws.String(fmt.Sprintf("key-%d", i)),
+			Data:         []byte("data"),
+		})
+	}
+
+	resp, err := k.PutRecords(&kinesis.PutRecordsInput{StreamName: aws.String(testStream), Records: entries})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	failed := 0
+	for _, r := range resp.Records {
+		if aws.StringValue(r.ErrorCode) == ProvisionedThroughputExceeded {
+			failed++
+		}
+	}
+	if failed == 0 || int64(failed) != *resp.FailedRecordCount {
+		t.Errorf("expected FailedRecordCount %d to match %d failed records", *resp.FailedRecordCount, failed)
+	}
+	if written := len(k.Records(testStream)); written != len(entries)-failed {
+		t.Errorf("expected %d records to be written, got %d", len(entries)-failed, written)
+	}
+
+	k.Fault = func(op string) error {
+		if op == "GetRecords" {
+			return Error(ProvisionedThroughputExceeded, "slow down")
+		}
+		return nil
+	}
+	_, err = k.GetRecords(&kinesis.GetRecordsInput{
+		ShardIterator: shardIterator(t, k, "shardId-000000000001", kinesis.ShardIteratorTypeTrimHorizon, ""),
+	})
+	if errCode(err) != ProvisionedThroughputExceeded {
+		t.Errorf("expected an injected error, got %v", err)
+	}
+}
+
+func TestMillisBehindLatest(t *testing.T) {
+	now := time.Unix(1000, 0)
+	k := withStream(t, 1)
+	k.Now = func() time.Time { return now }
+
+	put(t, k, "key", "a")
+	put(t, k, "key", "b")
+	now = now.Add(5 * time.Second)
+
+	resp, err := k.GetRecords(&kinesis.GetRecordsInput{
+		ShardIterator: shardIterator(t, k, "shardId-000000000000", kinesis.ShardIteratorTypeTrimHorizon, ""),
+		Limit:         aws.Int64(1),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if *resp.MillisBehindLatest != 5000 {
+		t.Errorf("expected to be 5000ms behind, got %d", *resp.MillisBehindLatest)
+	}
+
+	resp, _ = k.GetRecords(&kinesis.GetRecordsInput{ShardIterator: resp.NextShardIterator})
+	if *resp.MillisBehindLatest != 0 {
+		t.Errorf("expected to be caught up, got %d", *resp.MillisBehindLatest)
+	}
+}
@@ -0,0 +1,253 @@
+package kinesistest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// The prefix of the X-Amz-Target header on every Kinesis request.
+const targetPrefix = "Kinesis_20131202."
+
+// Operations that change a fake's state.
+var writeOperations = map[string]bool{
+	"CreateStream":         true,
+	"DeleteStream":         true,
+	"PutRecord":            true,
+	"PutRecords":           true,
+	"SplitShard":           true,
+	"MergeShards":          true,
+	"AddTagsToStream":      true,
+	"RemoveTagsFromStream": true,
+}
+
+// A Server serves the Kinesis JSON API from a fake, so that any Kinesis client
+// can use the fake by pointing its endpoint at the server.
+//
+// Requests are authenticated with any credentials at all.
+type Server struct {
+	Kinesis *Kinesis
+
+	// If set, called with the operation name and JSON body of every successful
+	// request that changed the fake's state, in the order they were applied.
+	// Passing the same requests to Call on a new fake recreates its streams.
+	OnWrite func(operation string, body []byte)
+
+	// Writes are applied one at a time so that OnWrite sees them in order.
+	writeLock sync.Mutex
+}
+
+// Create a Server for the given fake.
+func NewServer(k *Kinesis) *Server {
+	return &Server{Kinesis: k}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, Error("InvalidAction", "Kinesis requests must be POSTed"))
+		return
+	}
+
+	target := r.Header.Get("X-Amz-Target")
+	if !strings.HasPrefix(target, targetPrefix) {
+		writeError(w, Error("UnknownOperationException", fmt.Sprintf("Unknown target %q", target)))
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, Error("SerializationException", err.Error()))
+		return
+	}
+
+	output, err := s.Call(strings.TrimPrefix(target, targetPrefix), body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	bs, err := json.Marshal(output)
+	if err != nil {
+		writeError(w, Error(InternalFailure, err.Error()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.Write(bs)
+}
+
+// Call the named operation with a JSON request body, as it would be sent to
+// Kinesis, and return its output.
+func (s *Server) Call(operation string, body []byte) (interface{}, error) {
+	if writeOperations[operation] {
+		s.writeLock.Lock()
+		defer s.writeLock.Unlock()
+	}
+
+	output, err := s.call(operation, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if writeOperations[operation] && s.OnWrite != nil {
+		s.OnWrite(operation, body)
+	}
+	return output, nil
+}
+
+func (s *Server) call(operation string, body []byte) (interface{}, error) {
+	k := s.Kinesis
+
+	switch operation {
+	case "CreateStream":
+		input := &kinesis.CreateStreamInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.CreateStream(input)
+	case "DeleteStream":
+		input := &kinesis.DeleteStreamInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.DeleteStream(input)
+	case "ListStreams":
+		input := &kinesis.ListStreamsInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.ListStreams(input)
+	case "DescribeStream":
+		input := &kinesis.DescribeStreamInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.DescribeStream(input)
+	case "PutRecord":
+		input := &kinesis.PutRecordInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.PutRecord(input)
+	case "PutRecords":
+		input := &kinesis.PutRecordsInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.PutRecords(input)
+	case "GetShardIterator":
+		input := &kinesis.GetShardIteratorInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.GetShardIterator(input)
+	case "GetRecords":
+		input := &kinesis.GetRecordsInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		output, err := k.GetRecords(input)
+		if err != nil {
+			return nil, err
+		}
+		return newGetRecordsResponse(output), nil
+	case "SplitShard":
+		input := &kinesis.SplitShardInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.SplitShard(input)
+	case "MergeShards":
+		input := &kinesis.MergeShardsInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.MergeShards(input)
+	case "AddTagsToStream":
+		input := &kinesis.AddTagsToStreamInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.AddTagsToStream(input)
+	case "RemoveTagsFromStream":
+		input := &kinesis.RemoveTagsFromStreamInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.RemoveTagsFromStream(input)
+	case "ListTagsForStream":
+		input := &kinesis.ListTagsForStreamInput{}
+		if err := decode(body, input); err != nil {
+			return nil, err
+		}
+		return k.ListTagsForStream(input)
+	}
+
+	return nil, Error("UnknownOperationException", fmt.Sprintf("Unknown operation %s", operation))
+}
+
+func decode(body []byte, input interface{}) error {
+	if err := json.Unmarshal(body, input); err != nil {
+		return Error("SerializationException", err.Error())
+	}
+	return nil
+}
+
+// GetRecords output with arrival times as fractional unix seconds, the way
+// the JSON API sends timestamps.
+type getRecordsResponse struct {
+	MillisBehindLatest *int64
+	NextShardIterator  *string
+	Records            []*record
+}
+
+type record struct {
+	ApproximateArrivalTimestamp *float64 `json:",omitempty"`
+	Data                        []byte
+	PartitionKey                *string
+	SequenceNumber              *string
+}
+
+func newGetRecordsResponse(output *kinesis.GetRecordsOutput) *getRecordsResponse {
+	resp := &getRecordsResponse{
+		MillisBehindLatest: output.MillisBehindLatest,
+		NextShardIterator:  output.NextShardIterator,
+		Records:            make([]*record, len(output.Records)),
+	}
+
+	for i, r := range output.Records {
+		resp.Records[i] = &record{
+			Data:           r.Data,
+			PartitionKey:   r.PartitionKey,
+			SequenceNumber: r.SequenceNumber,
+		}
+		if t := r.ApproximateArrivalTimestamp; t != nil {
+			seconds := float64(t.UnixNano()) / 1e9
+			resp.Records[i].ApproximateArrivalTimestamp = &seconds
+		}
+	}
+	return resp
+}
+
+// Write an error the way Kinesis does. Errors that didn't come from the fake
+// are treated as internal failures.
+func writeError(w http.ResponseWriter, err error) {
+	code, message, status := InternalFailure, err.Error(), http.StatusInternalServerError
+	if awsErr, ok := err.(awserr.Error); ok {
+		code, message = awsErr.Code(), awsErr.Message()
+	}
+	if failure, ok := err.(awserr.RequestFailure); ok {
+		status = failure.StatusCode()
+	}
+
+	bs, _ := json.Marshal(map[string]string{"__type": code, "message": message})
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(status)
+	w.Write(bs)
+}
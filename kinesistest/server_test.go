@@ -0,0 +1,132 @@
+package kinesistest
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// Use the SDK's client against a Server so requests and responses go through
+// the SDK's own JSON encoding.
+func withServer(t *testing.T) (*kinesis.Kinesis, *Server, func()) {
+	server := NewServer(New())
+	http := httptest.NewServer(server)
+
+	client := kinesis.New(aws.NewConfig().
+		WithEndpoint(http.URL).
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithMaxRetries(0))
+
+	return client, server, http.Close
+}
+
+func TestServerRoundTrip(t *testing.T) {
+	client, _, done := withServer(t)
+	defer done()
+
+	_, err := client.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(testStream), ShardCount: aws.Int64(2)})
+	if err != nil {
+		t.Fatalf("unexpected error creating stream: %s", err)
+	}
+
+	streams, err := client.ListStreams(&kinesis.ListStreamsInput{})
+	if err != nil || len(streams.StreamNames) != 1 || *streams.StreamNames[0] != testStream {
+		t.Fatalf("expected to list the new stream. got %v (%v)", streams, err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	put, err := client.PutRecords(&kinesis.PutRecordsInput{
+		StreamName: aws.String(testStream),
+		Records: []*kinesis.PutRecordsRequestEntry{
+			{PartitionKey: aws.String("key"), Data: []byte("twinkle")},
+			{PartitionKey: aws.String("key"), Data: []byte{0, 1, 2}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error putting records: %s", err)
+	}
+
+	iter, err := client.GetShardIterator(&kinesis.GetShardIteratorInput{
+		StreamName:        aws.String(testStream),
+		ShardId:           put.Records[0].ShardId,
+		ShardIteratorType: aws.String(kinesis.ShardIteratorTypeTrimHorizon),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error getting an iterator: %s", err)
+	}
+
+	records, err := client.GetRecords(&kinesis.GetRecordsInput{ShardIterator: iter.ShardIterator})
+	if err != nil {
+		t.Fatalf("unexpected error getting records: %s", err)
+	}
+	if len(records.Records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records.Records))
+	}
+
+	r := records.Records[1]
+	if string(r.Data) != string([]byte{0, 1, 2}) || *r.SequenceNumber != *put.Records[1].SequenceNumber {
+		t.Errorf("record didn't survive the round trip: %s", r)
+	}
+	if r.ApproximateArrivalTimestamp == nil || r.ApproximateArrivalTimestamp.Before(before) {
+		t.Errorf("expected a recent arrival time, got %v", r.ApproximateArrivalTimestamp)
+	}
+	if records.NextShardIterator == nil {
+		t.Errorf("expected a next iterator")
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	client, _, done := withServer(t)
+	defer done()
+
+	_, err := client.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String("missing")})
+	if errCode(err) != ResourceNotFound {
+		t.Errorf("expected %s, got %v", ResourceNotFound, err)
+	}
+}
+
+func TestServerReplay(t *testing.T) {
+	client, server, done := withServer(t)
+	defer done()
+
+	type write struct {
+		operation string
+		body      []byte
+	}
+	var writes []write
+	server.OnWrite = func(operation string, body []byte) {
+		writes = append(writes, write{operation, body})
+	}
+
+	client.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(testStream), ShardCount: aws.Int64(1)})
+	client.PutRecord(&kinesis.PutRecordInput{StreamName: aws.String(testStream), PartitionKey: aws.String("key"), Data: []byte("a")})
+	client.SplitShard(&kinesis.SplitShardInput{StreamName: aws.String(testStream), ShardToSplit: aws.String("shardId-000000000000"), NewStartingHashKey: aws.String("100")})
+	client.PutRecord(&kinesis.PutRecordInput{StreamName: aws.String(testStream), PartitionKey: aws.String("key"), Data: []byte("b")})
+	client.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String(testStream)})
+
+	if len(writes) != 4 {
+		t.Fatalf("expected 4 writes, got %d", len(writes))
+	}
+
+	replayed := NewServer(New())
+	for _, w := range writes {
+		if _, err := replayed.Call(w.operation, w.body); err != nil {
+			t.Fatalf("unexpected error replaying %s: %s", w.operation, err)
+		}
+	}
+
+	expected, actual := server.Kinesis.Records(testStream), replayed.Kinesis.Records(testStream)
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d records after replay, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if *actual[i].SequenceNumber != *expected[i].SequenceNumber || string(actual[i].Data) != string(expected[i].Data) {
+			t.Errorf("expected %s, got %s", expected[i], actual[i])
+		}
+	}
+}
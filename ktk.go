@@ -1,15 +1,35 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/blinsay/ktk/stscreds"
 )
 
-const VERBOSE = "KTK_VERBOSE"
+// Environment variables that set defaults for global flags.
+const (
+	VERBOSE      = "KTK_VERBOSE"
+	REGION       = "KTK_REGION"
+	ENDPOINT_URL = "KTK_ENDPOINT_URL"
+	PROFILE      = "KTK_PROFILE"
+	ROLE_ARN     = "KTK_ROLE_ARN"
+	EXTERNAL_ID  = "KTK_EXTERNAL_ID"
+	MFA_SERIAL   = "KTK_MFA_SERIAL"
+	SESSION_NAME = "KTK_SESSION_NAME"
+	STS_ENDPOINT = "KTK_STS_ENDPOINT_URL"
+	DYNAMODB_URL = "KTK_DYNAMODB_ENDPOINT_URL"
+)
 
 // Return true if the given env variable is set to a truthy value. See
 // strconv.ParseBool for truthy values.
@@ -33,6 +53,42 @@ func fatalOnErr(err error) {
 	log.Fatalln("error:", err)
 }
 
+// Parse flags from args, allowing flags to be mixed in with positional
+// arguments (e.g. `ktk tail stream --stats`). Everything after a "--" is
+// treated as positional. Returns the positional arguments in order.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := flags.Args()
+
+		consumed := len(args) - len(rest)
+		if consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// Format a number of bytes for humans.
+func humanBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", n, units[i])
+}
+
 // A ktk sub-command to run. (e.g. cat)
 type Command struct {
 	// The name of the command.
@@ -43,19 +99,80 @@ type Command struct {
 	Short string
 	// A long help-style description of the command.
 	Description string
+	// Flags specific to this command. Flags are parsed before Run is called and
+	// may appear anywhere after the name of the command. May be nil if the
+	// command takes no flags.
+	Flags *flag.FlagSet
 	// The function that should actually run when the command is called. Called
-	// with every command-line arg after the name of the command.
+	// with every positional command-line arg after the name of the command.
 	Run func([]string)
 }
 
+// Print the command's usage line and flags.
+func (c *Command) usage() {
+	log.Printf("usage: ktk %s", c.Usage)
+	if c.hasFlags() {
+		log.Println("\nflags:")
+		c.Flags.PrintDefaults()
+	}
+}
+
+// Print the full help for the command.
+func (c *Command) help() {
+	log.Printf("ktk %s\n%s", c.Usage, c.Description)
+	if c.hasFlags() {
+		log.Println("flags:")
+		c.Flags.PrintDefaults()
+	}
+}
+
+func (c *Command) hasFlags() bool {
+	if c.Flags == nil {
+		return false
+	}
+
+	any := false
+	c.Flags.VisitAll(func(*flag.Flag) { any = true })
+	return any
+}
+
 // Available commands
 var commands = []*Command{
 	catCommand,
+	checkpointsCommand,
+	cpCommand,
+	dumpCommand,
+	genCommand,
+	getCommand,
 	listCommand,
+	loadCommand,
+	pingCommand,
+	runCommand,
+	serveCommand,
+	skewCommand,
+	statsCommand,
 	tailCommand,
 }
 
-const usageHeader = `usage: ktk command [arguments...]
+// Global flags. Must come before the name of the command.
+var (
+	region      string
+	endpointURL string
+	profile     string
+	roleARN     string
+	externalID  string
+	mfaSerial   string
+	sessionName string
+	stsEndpoint string
+	ddbEndpoint string
+	verbose     bool
+)
+
+// The AWS config every Kinesis client should be created with. Set from the
+// global flags before any command runs.
+var awsConfig *aws.Config
+
+const usageHeader = `usage: ktk [flags] command [arguments...]
 
 	help	Show help for an individual command`
 
@@ -65,10 +182,106 @@ func usage() {
 	for _, cmd := range commands {
 		log.Printf("\t%s\t%s\n", cmd.Name, cmd.Short)
 	}
+
+	log.Println("\nflags:")
+	flag.PrintDefaults()
+}
+
+// Build an AWS config from the global flags. Anything that isn't set falls back
+// to the SDK defaults.
+//
+// With --role-arn, the credentials from --profile or the SDK's default chain
+// are only used to assume the role, and every client gets the role's
+// temporary credentials. The role is assumed right away so that any MFA prompt
+// or error happens before a command starts.
+func newAWSConfig() (*aws.Config, error) {
+	config := aws.NewConfig()
+	if region != "" {
+		config = config.WithRegion(region)
+	}
+	if endpointURL != "" {
+		config = config.WithEndpoint(endpointURL)
+	}
+
+	creds := defaults.DefaultChainCredentials
+	if profile != "" {
+		creds = credentials.NewSharedCredentials("", profile)
+		config = config.WithCredentials(creds)
+	}
+
+	if roleARN != "" {
+		provider := &stscreds.AssumeRoleProvider{
+			Credentials:     creds,
+			RoleARN:         roleARN,
+			RoleSessionName: sessionName,
+			ExternalID:      externalID,
+			SerialNumber:    mfaSerial,
+			TokenCode:       readMFACode,
+			Endpoint:        stsEndpoint,
+			CacheDir:        credentialCacheDir(),
+		}
+		if _, err := provider.Retrieve(); err != nil {
+			return nil, err
+		}
+		config = config.WithCredentials(credentials.NewCredentials(provider))
+	}
+
+	return config, nil
+}
+
+// The AWS config DynamoDB clients should be created with. It's awsConfig
+// without the Kinesis endpoint, sending requests to --dynamodb-endpoint-url
+// instead if it's set.
+func dynamoDBConfig() *aws.Config {
+	config := awsConfig.Copy()
+	config.Endpoint = nil
+	if ddbEndpoint != "" {
+		config = config.WithEndpoint(ddbEndpoint)
+	}
+	return config
+}
+
+// The directory assumed role credentials are cached in, or "" if there's no
+// home directory to put it in.
+func credentialCacheDir() string {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".ktk", "cache", "sts")
+}
+
+// Prompt for a code from the --mfa-serial device. Uses the terminal instead of
+// stdin so commands like cat can still read records from stdin.
+func readMFACode() (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("can't prompt for an MFA code: %s", err)
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "MFA code for %s: ", mfaSerial)
+	code, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(code), nil
 }
 
 func init() {
 	log.SetFlags(0)
+
+	flag.StringVar(&region, "region", os.Getenv(REGION), "the AWS region to use. defaults to $"+REGION)
+	flag.StringVar(&endpointURL, "endpoint-url", os.Getenv(ENDPOINT_URL), "send Kinesis requests to this URL, e.g. a local Kinesis emulator. defaults to $"+ENDPOINT_URL)
+	flag.StringVar(&profile, "profile", os.Getenv(PROFILE), "use credentials from this profile in the shared credentials file. defaults to $"+PROFILE)
+	flag.StringVar(&roleARN, "role-arn", os.Getenv(ROLE_ARN), "assume this IAM role. defaults to $"+ROLE_ARN)
+	flag.StringVar(&externalID, "external-id", os.Getenv(EXTERNAL_ID), "the external id to use when assuming --role-arn. defaults to $"+EXTERNAL_ID)
+	flag.StringVar(&mfaSerial, "mfa-serial", os.Getenv(MFA_SERIAL), "prompt for a code from this MFA device when assuming --role-arn. defaults to $"+MFA_SERIAL)
+	flag.StringVar(&sessionName, "session-name", os.Getenv(SESSION_NAME), "the session name to use when assuming --role-arn. defaults to $"+SESSION_NAME)
+	flag.StringVar(&stsEndpoint, "sts-endpoint-url", os.Getenv(STS_ENDPOINT), "send STS requests to this URL. defaults to $"+STS_ENDPOINT)
+	flag.StringVar(&ddbEndpoint, "dynamodb-endpoint-url", os.Getenv(DYNAMODB_URL), "send DynamoDB requests to this URL, e.g. a local DynamoDB. defaults to $"+DYNAMODB_URL)
+	flag.BoolVar(&verbose, "verbose", envBool(VERBOSE), "log extra information. defaults to $"+VERBOSE)
+	flag.Usage = usage
 }
 
 func main() {
@@ -77,16 +290,14 @@ func main() {
 
 	if len(args) < 1 {
 		usage()
-		return
+		os.Exit(2)
 	}
 
 	if args[0] == "help" {
 		if len(args) > 1 {
-			for _, cmd := range commands {
-				if cmd.Name == args[1] {
-					log.Printf("ktk %s\n%s", cmd.Usage, cmd.Description)
-					return
-				}
+			if cmd := findCommand(args[1]); cmd != nil {
+				cmd.help()
+				return
 			}
 		}
 
@@ -94,12 +305,37 @@ func main() {
 		return
 	}
 
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		log.Printf("ktk: unknown command %q\n\n", args[0])
+		usage()
+		os.Exit(2)
+	}
+
+	if cmd.Flags == nil {
+		cmd.Flags = flag.NewFlagSet(cmd.Name, flag.ContinueOnError)
+	}
+	cmd.Flags.Usage = cmd.usage
+
+	positional, err := parseArgs(cmd.Flags, args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+
+	awsConfig, err = newAWSConfig()
+	fatalOnErr(err)
+
+	cmd.Run(positional)
+}
+
+func findCommand(name string) *Command {
 	for _, cmd := range commands {
-		if cmd.Name == args[0] {
-			cmd.Run(args[1:])
-			return
+		if cmd.Name == name {
+			return cmd
 		}
 	}
-
-	usage()
+	return nil
 }
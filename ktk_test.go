@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	testCases := []struct {
+		name       string
+		args       []string
+		positional []string
+		verbose    bool
+		count      int
+		err        error
+	}{
+		{
+			name:       "no args",
+			args:       nil,
+			positional: nil,
+		},
+		{
+			name:       "flags first",
+			args:       []string{"--verbose", "--count=3", "stream", "file"},
+			positional: []string{"stream", "file"},
+			verbose:    true,
+			count:      3,
+		},
+		{
+			name:       "flags last",
+			args:       []string{"stream", "file", "--verbose", "--count", "3"},
+			positional: []string{"stream", "file"},
+			verbose:    true,
+			count:      3,
+		},
+		{
+			name:       "interleaved",
+			args:       []string{"stream", "--count=3", "file", "-verbose", "other"},
+			positional: []string{"stream", "file", "other"},
+			verbose:    true,
+			count:      3,
+		},
+		{
+			name:       "double dash",
+			args:       []string{"stream", "--count=3", "--", "--verbose", "-x"},
+			positional: []string{"stream", "--verbose", "-x"},
+			count:      3,
+		},
+		{
+			name:       "double dash first",
+			args:       []string{"--", "--count=3"},
+			positional: []string{"--count=3"},
+		},
+		{
+			name: "unknown flag",
+			args: []string{"stream", "--nope"},
+			err:  errNotHelp,
+		},
+		{
+			name: "missing value",
+			args: []string{"stream", "--count"},
+			err:  errNotHelp,
+		},
+		{
+			name: "help",
+			args: []string{"stream", "-h"},
+			err:  flag.ErrHelp,
+		},
+		{
+			name: "long help",
+			args: []string{"--help", "stream"},
+			err:  flag.ErrHelp,
+		},
+	}
+
+	for _, tc := range testCases {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags.SetOutput(ioutil.Discard)
+		verbose := flags.Bool("verbose", false, "")
+		count := flags.Int("count", 0, "")
+
+		positional, err := parseArgs(flags, tc.args)
+		switch {
+		case tc.err == flag.ErrHelp && err != flag.ErrHelp:
+			// main exits cleanly on ErrHelp and with a usage error otherwise
+			t.Errorf("%s: expected flag.ErrHelp, got %v", tc.name, err)
+		case tc.err == errNotHelp && (err == nil || err == flag.ErrHelp):
+			t.Errorf("%s: expected a usage error, got %v", tc.name, err)
+		case tc.err == nil && err != nil:
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+		}
+		if tc.err != nil {
+			continue
+		}
+
+		if !reflect.DeepEqual(positional, tc.positional) {
+			t.Errorf("%s: expected args %q, got %q", tc.name, tc.positional, positional)
+		}
+		if *verbose != tc.verbose || *count != tc.count {
+			t.Errorf("%s: expected verbose=%v count=%d, got verbose=%v count=%d", tc.name, tc.verbose, tc.count, *verbose, *count)
+		}
+	}
+}
+
+// Stands in for any error other than flag.ErrHelp in TestParseArgs.
+var errNotHelp = errors.New("not help")
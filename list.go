@@ -22,7 +22,7 @@ var listCommand = &Command{
 func runList(args []string) {
 	// Ignore args
 
-	streams, err := listStreams(kinesis.New(nil))
+	streams, err := listStreams(kinesis.New(awsConfig))
 	fatalOnErr(err)
 
 	for _, stream := range streams {
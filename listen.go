@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/blinsay/ktk/producer"
+)
+
+// The largest record Kinesis accepts, which is also the longest message a
+// listener accepts.
+const maxRecordSize = 1024 * 1024
+
+// A message received by a listener, and the partition key to send it with.
+// done, if it's set, is called once the message has been sent.
+type listenedMessage struct {
+	key  string
+	data string
+	done func(producer.Delivery)
+}
+
+// Receives messages from local processes and passes them on to be sent.
+// Datagram sockets take a message per packet, and stream sockets take a
+// message per line, or syslog's octet counted framing. Sending blocks while the
+// producer is behind, which pushes back on stream senders.
+type listener struct {
+	addr     string
+	syslog   bool
+	keyField string
+	messages chan<- listenedMessage
+
+	packet net.PacketConn
+	stream net.Listener
+}
+
+// Parse a listen address like udp://:514, tcp://:5140, unix:///run/ktk.sock
+// or unixgram:///run/ktk.sock and start listening on it.
+func newListener(addr string, syslog bool, keyField string, messages chan<- listenedMessage) (*listener, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %s", addr, err)
+	}
+
+	l := &listener{addr: addr, syslog: syslog, keyField: keyField, messages: messages}
+	switch u.Scheme {
+	case "udp":
+		l.packet, err = net.ListenPacket("udp", u.Host)
+	case "unixgram":
+		removeStaleSocket(u.Path)
+		l.packet, err = net.ListenPacket("unixgram", u.Path)
+	case "tcp":
+		l.stream, err = net.Listen("tcp", u.Host)
+	case "unix":
+		removeStaleSocket(u.Path)
+		l.stream, err = net.Listen("unix", u.Path)
+	default:
+		return nil, fmt.Errorf("invalid listen address %q: expected udp://, tcp://, unix:// or unixgram://", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Remove a socket file left behind by a listener that didn't exit cleanly.
+// Anything that isn't a socket is left alone.
+func removeStaleSocket(path string) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+// Accept messages until the listener is closed.
+func (l *listener) serve() {
+	if l.packet != nil {
+		l.servePackets()
+		return
+	}
+
+	for {
+		conn, err := l.stream.Accept()
+		if err != nil {
+			return
+		}
+		go l.serveConn(conn)
+	}
+}
+
+func (l *listener) servePackets() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := l.packet.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		l.receive(string(buf[:n]))
+	}
+}
+
+func (l *listener) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, 64*1024)
+	for {
+		msg, err := l.readMessage(reader)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("error: %s: %s: %s", l.addr, conn.RemoteAddr(), err)
+			return
+		}
+		l.receive(msg)
+	}
+}
+
+// Read a line, or with syslog, an octet counted message if the next message
+// starts with its length.
+func (l *listener) readMessage(r *bufio.Reader) (string, error) {
+	if l.syslog {
+		if next, err := r.Peek(1); err == nil && next[0] >= '0' && next[0] <= '9' {
+			return readOctetCounted(r)
+		}
+	}
+
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxRecordSize {
+			return "", fmt.Errorf("message longer than %d bytes", maxRecordSize)
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// Read a message framed as in RFC 6587, e.g. "11 <34>1 hello".
+func readOctetCounted(r *bufio.Reader) (string, error) {
+	prefix, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(prefix, " "))
+	if err != nil || n < 0 || n > maxRecordSize {
+		return "", fmt.Errorf("invalid message length %q", prefix)
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return "", err
+	}
+	return string(msg), nil
+}
+
+func (l *listener) receive(msg string) {
+	msg = strings.TrimRight(msg, "\r\n")
+	if len(msg) == 0 {
+		return
+	}
+	l.messages <- listenedMessage{key: l.key(msg), data: msg}
+}
+
+// The partition key for a message: the syslog hostname or app name if
+// keyField asks for one and the message has it, and otherwise the start of the
+// message, the same way cat picks keys for lines.
+func (l *listener) key(msg string) string {
+	key := msg
+	if l.syslog && l.keyField != "" {
+		header := parseSyslog(msg)
+		switch l.keyField {
+		case "hostname":
+			if header.hostname != "" {
+				key = header.hostname
+			}
+		case "app":
+			if header.app != "" {
+				key = header.app
+			}
+		}
+	}
+
+	return partitionKey(key)
+}
+
+// Turn s into a valid partition key by cutting it down to 256 bytes and
+// replacing every byte that isn't valid UTF-8 with a ?.
+func partitionKey(s string) string {
+	if len(s) > 256 {
+		s = s[:256]
+	}
+	if utf8.ValidString(s) {
+		return s
+	}
+
+	valid := make([]byte, 0, len(s))
+	for len(s) > 0 {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && size == 1 {
+			valid = append(valid, '?')
+		} else {
+			valid = append(valid, s[:size]...)
+		}
+		s = s[size:]
+	}
+	return string(valid)
+}
+
+func (l *listener) close() {
+	if l.packet != nil {
+		l.packet.Close()
+	} else {
+		l.stream.Close()
+	}
+}
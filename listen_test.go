@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// test reading messages off a stream socket, one per line or octet counted.
+func TestReadMessage(t *testing.T) {
+	testCases := []struct {
+		name     string
+		syslog   bool
+		input    string
+		expected []string
+		err      bool
+	}{
+		{
+			name:     "lines",
+			input:    "hello\nthere\r\nfriend",
+			expected: []string{"hello", "there", "friend"},
+		},
+		{
+			name:     "octet counted",
+			syslog:   true,
+			input:    "11 <34>1 hello12 <34>1 there\n",
+			expected: []string{"<34>1 hello", "<34>1 there\n"},
+		},
+		{
+			name:     "octet counted and lines mixed",
+			syslog:   true,
+			input:    "<34>1 hello\n11 <34>1 there",
+			expected: []string{"<34>1 hello", "<34>1 there"},
+		},
+		{
+			name:     "lines starting with digits without syslog",
+			input:    "11 <34>1 hello\n",
+			expected: []string{"11 <34>1 hello"},
+		},
+		{
+			name:     "octet counted message cut short",
+			syslog:   true,
+			input:    "20 <34>1 hello",
+			expected: nil,
+			err:      true,
+		},
+		{
+			name:     "invalid length",
+			syslog:   true,
+			input:    "1x <34>1 hello",
+			expected: nil,
+			err:      true,
+		},
+		{
+			name:     "length too long",
+			syslog:   true,
+			input:    "99999999 <34>1 hello",
+			expected: nil,
+			err:      true,
+		},
+	}
+
+	for _, tc := range testCases {
+		l := &listener{syslog: tc.syslog}
+		r := bufio.NewReader(strings.NewReader(tc.input))
+
+		var messages []string
+		var err error
+		for {
+			var msg string
+			if msg, err = l.readMessage(r); err != nil {
+				break
+			}
+			messages = append(messages, msg)
+		}
+
+		if (err != io.EOF) != tc.err {
+			t.Errorf("%s: expected error to be %v, got %v", tc.name, tc.err, err)
+		}
+		if !reflect.DeepEqual(messages, tc.expected) {
+			t.Errorf("%s: expected messages %q, got %q", tc.name, tc.expected, messages)
+		}
+	}
+}
+
+func TestPartitionKey(t *testing.T) {
+	testCases := []struct {
+		name     string
+		key      string
+		expected string
+	}{
+		{name: "short", key: "hello", expected: "hello"},
+		{name: "unicode", key: "héllo wörld", expected: "héllo wörld"},
+		{name: "too long", key: strings.Repeat("a", 300), expected: strings.Repeat("a", 256)},
+		{name: "invalid bytes", key: "a\xffb\xfe\xfdc", expected: "a?b??c"},
+		{name: "rune cut in half", key: strings.Repeat("a", 255) + "é", expected: strings.Repeat("a", 255) + "?"},
+	}
+
+	for _, tc := range testCases {
+		if actual := partitionKey(tc.key); actual != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestListenerKey(t *testing.T) {
+	msg := "<34>Oct 11 22:14:15 mymachine su[123]: hello"
+
+	testCases := []struct {
+		syslog   bool
+		keyField string
+		msg      string
+		expected string
+	}{
+		{syslog: true, keyField: "hostname", msg: msg, expected: "mymachine"},
+		{syslog: true, keyField: "app", msg: msg, expected: "su"},
+		{syslog: true, keyField: "", msg: msg, expected: msg},
+		{syslog: true, keyField: "hostname", msg: "not syslog", expected: "not syslog"},
+		{syslog: false, keyField: "hostname", msg: msg, expected: msg},
+	}
+
+	for _, tc := range testCases {
+		l := &listener{syslog: tc.syslog, keyField: tc.keyField}
+		if actual := l.key(tc.msg); actual != tc.expected {
+			t.Errorf("%q with key from %q: expected %q, got %q", tc.msg, tc.keyField, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/blinsay/ktk/producer"
+)
+
+// The largest line a dump file may contain. Big enough for a 1MB record once
+// it's been base64 encoded and wrapped in JSON.
+const maxDumpLine = 4 * 1024 * 1024
+
+// Gaps between records shorter than this are sent without waiting, and
+// records that close together are flushed at least this often.
+const minReplayDelay = 10 * time.Millisecond
+
+var loadFlags = flag.NewFlagSet("load", flag.ContinueOnError)
+
+var (
+	loadPreserveKeys = loadFlags.Bool("preserve-keys", false, "send records with their original partition keys")
+	loadSpeed        = loadFlags.String("speed", "max", "how fast to replay records: max or a multiplier like 2x")
+)
+
+var loadCommand = &Command{
+	Name:  "load",
+	Usage: "load stream dir [--preserve-keys] [--speed=max]",
+	Short: "Restore an archive created by dump",
+	Description: `
+	Send every record in a directory created by ktk dump to the given stream.
+	Records from all shards are merged and sent in the order they originally
+	arrived.
+
+	With --preserve-keys, every record is sent with its original partition key.
+	Otherwise records are given random partition keys and spread evenly across
+	the stream's shards.
+
+	--speed controls how fast records are sent. With --speed=max records are
+	sent as fast as possible. With a speed like --speed=1x or --speed=2.5x,
+	records are sent with the same gaps between them as when they originally
+	arrived, sped up by the given factor.
+	`,
+	Flags: loadFlags,
+	Run:   runLoad,
+}
+
+func runLoad(args []string) {
+	if len(args) < 2 {
+		log.Fatalln("error: stream name and directory are both required")
+	}
+
+	speed, err := parseSpeed(*loadSpeed)
+	fatalOnErr(err)
+
+	records, err := openDump(args[1])
+	fatalOnErr(err)
+	defer records.close()
+
+	p := producer.New(args[0], producer.WithConfig(awsConfig))
+	p.Debug = verbose
+	clock := newReplayClock(speed)
+
+	for {
+		r, err := records.next()
+		if err == io.EOF {
+			break
+		}
+		fatalOnErr(err)
+
+		if r.ArrivalTime != nil {
+			fatalOnErr(clock.wait(*r.ArrivalTime, p.Flush))
+		}
+
+		key := r.PartitionKey
+		if !*loadPreserveKeys {
+			key = strconv.FormatInt(rand.Int63(), 10)
+		}
+		fatalOnErr(p.Put(aws.String(key), r.Data))
+	}
+
+	fatalOnErr(p.Flush())
+}
+
+// Parse a replay speed like "2x" or "0.5x". "max" is returned as 0, meaning no
+// delay at all.
+func parseSpeed(s string) (float64, error) {
+	if s == "max" {
+		return 0, nil
+	}
+
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid speed %q. use max or a multiplier like 2x", s)
+	}
+	return speed, nil
+}
+
+// Schedules records relative to the first record seen, so that the gaps between
+// them match the original gaps divided by speed.
+type replayClock struct {
+	speed float64
+
+	start   time.Time
+	first   time.Time
+	flushed time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newReplayClock(speed float64) *replayClock {
+	return &replayClock{speed: speed, now: time.Now, sleep: time.Sleep}
+}
+
+// Wait until a record originally sent at ts is due. Anything already due is
+// sent with flush before waiting. Records less than minReplayDelay apart
+// aren't waited for one at a time, but they're still flushed at least every
+// minReplayDelay so nothing sits in a buffer long past when it was due. Never
+// waits when speed is zero.
+func (c *replayClock) wait(ts time.Time, flush func() error) error {
+	if c.speed <= 0 {
+		return nil
+	}
+
+	now := c.now()
+	if c.first.IsZero() {
+		c.first, c.start, c.flushed = ts, now, now
+		return nil
+	}
+
+	due := c.start.Add(time.Duration(float64(ts.Sub(c.first)) / c.speed))
+	if due.Sub(now) <= minReplayDelay && now.Sub(c.flushed) < minReplayDelay {
+		return nil
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+	if delay := due.Sub(c.now()); delay > 0 {
+		c.sleep(delay)
+	}
+	c.flushed = c.now()
+	return nil
+}
+
+// reading dumps
+
+// Reads the records in a dump directory, merging shards by arrival time.
+type dumpReader struct {
+	shards shardReaders
+}
+
+// Open every file in dir written by dump.
+func openDump(dir string) (*dumpReader, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	files := make(map[string][]string)
+	for _, name := range names {
+		// shard-id.NNNNNN.jsonl
+		base := strings.TrimSuffix(filepath.Base(name), ".jsonl")
+		shard := strings.TrimSuffix(base, filepath.Ext(base))
+		files[shard] = append(files[shard], name)
+	}
+
+	d := &dumpReader{}
+	for _, names := range files {
+		s := &shardReader{names: names}
+		if err := s.advance(); err != nil && err != io.EOF {
+			d.close()
+			return nil, err
+		}
+		if s.current != nil {
+			d.shards = append(d.shards, s)
+		}
+	}
+	heap.Init(&d.shards)
+
+	return d, nil
+}
+
+// Return the next record across all shards, or io.EOF once every shard has
+// been read.
+func (d *dumpReader) next() (*archivedRecord, error) {
+	if len(d.shards) == 0 {
+		return nil, io.EOF
+	}
+
+	s := d.shards[0]
+	r := s.current
+
+	err := s.advance()
+	switch {
+	case err == io.EOF:
+		heap.Pop(&d.shards)
+	case err != nil:
+		return nil, err
+	default:
+		heap.Fix(&d.shards, 0)
+	}
+
+	return r, nil
+}
+
+func (d *dumpReader) close() {
+	for _, s := range d.shards {
+		s.close()
+	}
+}
+
+// Reads records from a single shard's files, in order.
+type shardReader struct {
+	names   []string
+	file    *os.File
+	scanner *bufio.Scanner
+
+	current *archivedRecord
+}
+
+// Read the next record into current, opening the next file if needed. Returns
+// io.EOF after the last record in the last file.
+func (s *shardReader) advance() error {
+	s.current = nil
+
+	for {
+		if s.scanner != nil && s.scanner.Scan() {
+			var r archivedRecord
+			if err := json.Unmarshal(s.scanner.Bytes(), &r); err != nil {
+				return err
+			}
+			s.current = &r
+			return nil
+		}
+
+		if s.scanner != nil {
+			if err := s.scanner.Err(); err != nil {
+				return err
+			}
+		}
+
+		s.close()
+		if len(s.names) == 0 {
+			return io.EOF
+		}
+
+		f, err := os.Open(s.names[0])
+		if err != nil {
+			return err
+		}
+		s.names = s.names[1:]
+
+		s.file = f
+		s.scanner = bufio.NewScanner(f)
+		s.scanner.Buffer(make([]byte, 64*1024), maxDumpLine)
+	}
+}
+
+func (s *shardReader) close() {
+	if s.file != nil {
+		s.file.Close()
+		s.file, s.scanner = nil, nil
+	}
+}
+
+// A heap of shardReaders ordered by the arrival time of their current record.
+// Records without an arrival time sort first.
+type shardReaders []*shardReader
+
+func (s shardReaders) Len() int      { return len(s) }
+func (s shardReaders) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s shardReaders) Less(i, j int) bool {
+	a, b := s[i].current.ArrivalTime, s[j].current.ArrivalTime
+	if a == nil || b == nil {
+		return a == nil && b != nil
+	}
+	return a.Before(*b)
+}
+
+func (s *shardReaders) Push(x interface{}) {
+	*s = append(*s, x.(*shardReader))
+}
+
+func (s *shardReaders) Pop() interface{} {
+	old := *s
+	n := len(old)
+	x := old[n-1]
+	*s = old[:n-1]
+	return x
+}
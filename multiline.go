@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Puts lines back together into the records they were split from, like Java
+// stack traces or pretty-printed JSON. Lines are either grouped with a regexp
+// that matches the first line of every record, or one that matches every line
+// after the first, or are read as a stream of JSON values. An assembler with
+// none of those passes every non-empty line through as its own record.
+//
+// Records are cut short once they'd grow past maxBytes, and a single line
+// longer than maxBytes is split into records of maxBytes. A JSON value can't be
+// cut short and still be JSON, so values longer than maxBytes are dropped.
+type assembler struct {
+	start    *regexp.Regexp
+	cont     *regexp.Regexp
+	json     bool
+	maxBytes int
+
+	lines []string
+	size  int
+
+	// where the JSON value being read is up to
+	depth    int
+	inString bool
+	escaped  bool
+	// the value being read is too long, and is being skipped to its end
+	skipping bool
+}
+
+// Return a new assembler with the same settings and nothing collected yet.
+func (a *assembler) empty() *assembler {
+	return &assembler{start: a.start, cont: a.cont, json: a.json, maxBytes: a.maxBytes}
+}
+
+// Return true if lines are passed through without being assembled.
+func (a *assembler) passthrough() bool {
+	return a.start == nil && a.cont == nil && !a.json
+}
+
+// Return true if some lines are waiting on the rest of their record.
+func (a *assembler) pending() bool {
+	return len(a.lines) > 0 || a.skipping
+}
+
+// Add a line, returning any records it completes.
+func (a *assembler) add(line string) []string {
+	switch {
+	case a.json:
+		return a.addJSON(line)
+	case a.passthrough():
+		if line == "" {
+			return nil
+		}
+		return []string{line}
+	}
+
+	if len(a.lines) == 0 && strings.TrimSpace(line) == "" {
+		return nil
+	}
+
+	var records []string
+	startsRecord := (a.start != nil && a.start.MatchString(line)) || (a.cont != nil && !a.cont.MatchString(line))
+	if startsRecord || a.size+len(line)+1 > a.maxBytes {
+		records = a.flush()
+	}
+	if len(line) > a.maxBytes {
+		return append(records, splitLine(line, a.maxBytes)...)
+	}
+	a.append(line)
+	return records
+}
+
+// Split a line into pieces of at most n bytes, without splitting a UTF-8
+// character if it can help it.
+func splitLine(line string, n int) []string {
+	var pieces []string
+	for len(line) > n {
+		cut := n
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			cut = n
+		}
+		pieces = append(pieces, line[:cut])
+		line = line[cut:]
+	}
+	return append(pieces, line)
+}
+
+// Add a line of a JSON stream, returning any values it completes. Values are
+// compacted onto a single line.
+func (a *assembler) addJSON(line string) []string {
+	var records []string
+
+	start := 0
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if a.inString {
+			switch {
+			case a.escaped:
+				a.escaped = false
+			case c == '\\':
+				a.escaped = true
+			case c == '"':
+				a.inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			a.inString = true
+		case '{', '[':
+			if a.depth == 0 && strings.TrimSpace(line[start:i]) != "" {
+				// a number or the like before the value that's starting
+				a.appendJSON(line[start:i])
+				records = append(records, a.flush()...)
+				start = i
+			}
+			a.depth++
+		case '}', ']':
+			a.depth--
+			if a.depth <= 0 {
+				a.appendJSON(line[start : i+1])
+				records = append(records, a.flush()...)
+				start = i + 1
+			}
+		}
+	}
+
+	rest := line[start:]
+	switch {
+	case a.depth == 0 && !a.inString:
+		// top level numbers, strings and the like are values on their own
+		if strings.TrimSpace(rest) != "" {
+			a.appendJSON(rest)
+			records = append(records, a.flush()...)
+		}
+	default:
+		a.appendJSON(rest)
+	}
+	return records
+}
+
+func (a *assembler) append(line string) {
+	a.lines = append(a.lines, line)
+	a.size += len(line) + 1
+}
+
+// Add part of the JSON value being read. A value that grows past maxBytes is
+// dropped, and the rest of it is skipped until the tokenizer finds its end.
+func (a *assembler) appendJSON(part string) {
+	if a.skipping {
+		return
+	}
+	if a.size+len(part)+1 > a.maxBytes {
+		log.Printf("error: dropping a JSON value longer than %d bytes", a.maxBytes)
+		a.lines, a.size, a.skipping = nil, 0, true
+		return
+	}
+	a.append(part)
+}
+
+// Return whatever has been collected as a record, even if it isn't finished.
+// A JSON value that's being skipped is given up on.
+func (a *assembler) flush() []string {
+	if a.skipping {
+		a.depth, a.inString, a.escaped, a.skipping = 0, false, false, false
+	}
+	if len(a.lines) == 0 {
+		return nil
+	}
+
+	record := strings.TrimRight(strings.Join(a.lines, "\n"), "\r\n")
+	if a.json {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(record)); err == nil {
+			record = compact.String()
+		}
+		record = strings.TrimSpace(record)
+		a.depth, a.inString, a.escaped = 0, false, false
+	}
+
+	a.lines, a.size = nil, 0
+	if record == "" {
+		return nil
+	}
+	return []string{record}
+}
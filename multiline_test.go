@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAssembler(t *testing.T) {
+	startsWithDate := regexp.MustCompile(`^\d{4}-\d{2}-\d{2} `)
+	indented := regexp.MustCompile(`^\s`)
+
+	testCases := []struct {
+		name     string
+		asm      *assembler
+		lines    []string
+		expected []string
+	}{
+		{
+			name:     "passthrough",
+			asm:      &assembler{maxBytes: 1024},
+			lines:    []string{"a", "", "  b"},
+			expected: []string{"a", "  b"},
+		},
+		{
+			name: "start",
+			asm:  &assembler{start: startsWithDate, maxBytes: 1024},
+			lines: []string{
+				"2016-01-02 first",
+				"  more",
+				"2016-01-02 second",
+				"2016-01-02 third",
+				"and more",
+			},
+			expected: []string{"2016-01-02 first\n  more", "2016-01-02 second", "2016-01-02 third\nand more"},
+		},
+		{
+			name:     "start with leading lines",
+			asm:      &assembler{start: startsWithDate, maxBytes: 1024},
+			lines:    []string{"", "orphan", "2016-01-02 first"},
+			expected: []string{"orphan", "2016-01-02 first"},
+		},
+		{
+			name: "continue",
+			asm:  &assembler{cont: indented, maxBytes: 1024},
+			lines: []string{
+				"java.lang.NullPointerException",
+				"\tat Foo.bar(Foo.java:10)",
+				"\tat Foo.main(Foo.java:3)",
+				"next",
+			},
+			expected: []string{"java.lang.NullPointerException\n\tat Foo.bar(Foo.java:10)\n\tat Foo.main(Foo.java:3)", "next"},
+		},
+		{
+			name:     "record cut off at max bytes",
+			asm:      &assembler{cont: indented, maxBytes: 8},
+			lines:    []string{"abc", " de", " fg", " h"},
+			expected: []string{"abc\n de", " fg\n h"},
+		},
+		{
+			name:     "line longer than max bytes",
+			asm:      &assembler{cont: indented, maxBytes: 4},
+			lines:    []string{"ab", "  0123456789", " c"},
+			expected: []string{"ab", "  01", "2345", "6789", " c"},
+		},
+		{
+			name:     "line split between characters",
+			asm:      &assembler{start: startsWithDate, maxBytes: 4},
+			lines:    []string{"aaéé"},
+			expected: []string{"aaé", "é"},
+		},
+	}
+
+	for _, tc := range testCases {
+		if actual := assembleAll(tc.asm, tc.lines); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+func TestAssemblerJSON(t *testing.T) {
+	testCases := []struct {
+		name     string
+		lines    []string
+		maxBytes int
+		expected []string
+	}{
+		{
+			name:     "one per line",
+			lines:    []string{`{"a": 1}`, `[1, 2]`},
+			expected: []string{`{"a":1}`, `[1,2]`},
+		},
+		{
+			name:     "pretty printed",
+			lines:    []string{`{`, `  "a": {`, `    "b": [1, 2]`, `  }`, `}`},
+			expected: []string{`{"a":{"b":[1,2]}}`},
+		},
+		{
+			name:     "several on a line",
+			lines:    []string{`{"a": 1}{"b": 2} [3]`},
+			expected: []string{`{"a":1}`, `{"b":2}`, `[3]`},
+		},
+		{
+			name:     "scalars",
+			lines:    []string{`1`, `"two"`, `{"a": 3}`, `true`},
+			expected: []string{`1`, `"two"`, `{"a":3}`, `true`},
+		},
+		{
+			name:     "brackets in strings",
+			lines:    []string{`{"a": "}{]["}`, `{"b": "[{"}`},
+			expected: []string{`{"a":"}{]["}`, `{"b":"[{"}`},
+		},
+		{
+			name:     "escaped quotes",
+			lines:    []string{`{"a": "say \"}\" and \\"}`, `{"b": "\\\"{"}`},
+			expected: []string{`{"a":"say \"}\" and \\"}`, `{"b":"\\\"{"}`},
+		},
+		{
+			name:     "value too long",
+			lines:    []string{`{"a": 1}`, `{"b": "a long`, `string", "c": "}"}`, `{"d": 4}`},
+			maxBytes: 16,
+			expected: []string{`{"a":1}`, `{"d":4}`},
+		},
+		{
+			name:     "value on one line too long",
+			lines:    []string{`{"a": "a long string"} {"d": 4}`},
+			maxBytes: 16,
+			expected: []string{`{"d":4}`},
+		},
+		{
+			name:     "scalar too long",
+			lines:    []string{`"a long string that goes on"`, `1`},
+			maxBytes: 16,
+			expected: []string{`1`},
+		},
+	}
+
+	for _, tc := range testCases {
+		maxBytes := tc.maxBytes
+		if maxBytes == 0 {
+			maxBytes = 1024
+		}
+		asm := &assembler{json: true, maxBytes: maxBytes}
+		if actual := assembleAll(asm, tc.lines); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+// test that a JSON value that's being skipped keeps the assembler pending, so
+// a followed file isn't resumed from the middle of it.
+func TestAssemblerJSONSkipPending(t *testing.T) {
+	asm := &assembler{json: true, maxBytes: 4}
+	if records := asm.add(`{"a": "too long`); len(records) != 0 {
+		t.Fatalf("expected no records, got %q", records)
+	}
+	if !asm.pending() {
+		t.Error("expected a skipped value to be pending")
+	}
+
+	asm.flush()
+	if asm.pending() {
+		t.Error("expected a flush to give up on the skipped value")
+	}
+	if records := asm.add(`1`); !reflect.DeepEqual(records, []string{"1"}) {
+		t.Errorf("expected the next value after a flush, got %q", records)
+	}
+}
+
+// test that a record is sent once the line after it takes too long to arrive.
+func TestAssembleLinesTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { *catMultilineTimeout = timeout }(*catMultilineTimeout)
+	*catMultilineTimeout = 10 * time.Millisecond
+
+	r, w := io.Pipe()
+	records := make(chan string, 10)
+	done := make(chan struct{})
+	go func() {
+		asm := &assembler{cont: regexp.MustCompile(`^\s`), maxBytes: 1024}
+		assembleLines(bufio.NewScanner(r), asm, func(record string) { records <- record })
+		close(done)
+	}()
+
+	io.WriteString(w, "first\n  more\n")
+	select {
+	case record := <-records:
+		if record != "first\n  more" {
+			t.Errorf("expected the first record, got %q", record)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the record to be sent")
+	}
+
+	io.WriteString(w, "second\n")
+	w.Close()
+	<-done
+	if record := <-records; record != "second" {
+		t.Errorf("expected the last record when input ended, got %q", record)
+	}
+}
+
+// test that lines longer than bufio.Scanner's default limit are read whole and
+// split into records of --multiline-max-bytes.
+func TestAssembleLongLines(t *testing.T) {
+	long := strings.Repeat("a", 100*1024)
+	input := "first\n" + long + "\n  more\n"
+
+	var records []string
+	scanner := newLineScanner(strings.NewReader(input))
+	asm := &assembler{cont: regexp.MustCompile(`^\s`), maxBytes: maxRecordSize}
+	assembleLines(scanner, asm, func(record string) { records = append(records, record) })
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("unexpected error scanning a long line: %s", err)
+	}
+
+	expected := []string{"first", long + "\n  more"}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected %d records, got %d", len(expected), len(records))
+	}
+
+	records = nil
+	scanner = newLineScanner(strings.NewReader(input))
+	asm = &assembler{cont: regexp.MustCompile(`^\s`), maxBytes: 64 * 1024}
+	assembleLines(scanner, asm, func(record string) { records = append(records, record) })
+	expected = []string{"first", long[:64*1024], long[64*1024:], "  more"}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected the long line to be split into %d records, got %d", len(expected), len(records))
+	}
+}
+
+func TestSplitLine(t *testing.T) {
+	testCases := []struct {
+		line     string
+		n        int
+		expected []string
+	}{
+		{line: "abcdef", n: 3, expected: []string{"abc", "def"}},
+		{line: "abcdefg", n: 3, expected: []string{"abc", "def", "g"}},
+		{line: "aé", n: 2, expected: []string{"a", "é"}},
+		{line: strings.Repeat("\xff", 3), n: 2, expected: []string{"\xff\xff", "\xff"}},
+	}
+
+	for _, tc := range testCases {
+		if actual := splitLine(tc.line, tc.n); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("%q in %d: expected %q, got %q", tc.line, tc.n, tc.expected, actual)
+		}
+	}
+}
+
+// Add every line to asm and flush it, returning every record.
+func assembleAll(asm *assembler, lines []string) []string {
+	var records []string
+	for _, line := range lines {
+		records = append(records, asm.add(line)...)
+	}
+	return append(records, asm.flush()...)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+	"github.com/blinsay/ktk/producer"
+)
+
+// Every probe record starts with this prefix.
+const probePrefix = "ktk-ping"
+
+// How often ping polls each shard. Fast enough that polling doesn't dominate
+// the measured latency while staying within Kinesis' 5 reads/s per shard.
+const pingPollInterval = 200 * time.Millisecond
+
+var pingFlags = flag.NewFlagSet("ping", flag.ContinueOnError)
+
+var (
+	pingCount    = pingFlags.Int("count", 0, "the number of probes to send. 0 sends until interrupted")
+	pingInterval = pingFlags.Duration("interval", time.Second, "the time between probes")
+	pingTimeout  = pingFlags.Duration("timeout", 10*time.Second, "how long to wait for the last probes to arrive")
+)
+
+var pingCommand = &Command{
+	Name:  "ping",
+	Usage: "ping stream [--count=N] [--interval=1s] [--timeout=10s]",
+	Short: "Measure write-to-read latency on a stream",
+	Description: `
+	Put a uniquely tagged probe record into the given stream every --interval
+	while tailing the stream from LATEST, and print how long each probe took to
+	put and how long it took to be read back, along with the shard it was read
+	from.
+
+	Ping sends --count probes, or runs until interrupted if --count is 0. It
+	waits up to --timeout for the last probes to arrive, then prints a summary of
+	min/avg/p99/max latencies like ping(1). Probes that never arrive are counted
+	as lost.
+
+	Probes are sent with unique partition keys, so they're spread across all of
+	the stream's shards. Every shard is polled 5 times a second, so end-to-end
+	latencies include up to 200ms of polling delay and ping uses every shard's
+	entire read limit while it runs.
+	`,
+	Flags: pingFlags,
+	Run:   runPing,
+}
+
+// A probe that has been read back from the stream.
+type probeResult struct {
+	seq   int
+	shard string
+	at    time.Time
+}
+
+// A probe that has been sent.
+type probe struct {
+	sentAt     time.Time
+	putLatency time.Duration
+}
+
+func runPing(args []string) {
+	if len(args) < 1 {
+		log.Fatalln("error: no stream name given")
+	}
+	stream := args[0]
+
+	// tag every probe with this run's id so concurrent pings don't get mixed up
+	runId := strconv.FormatInt(time.Now().UnixNano(), 36)
+	tag := probePrefix + " " + runId + " "
+
+	opts := []consumer.Option{
+		consumer.WithConfig(awsConfig),
+		consumer.WithPollInterval(pingPollInterval),
+		consumer.WithMaxIdleInterval(pingPollInterval),
+	}
+
+	results := make(chan probeResult, 100)
+	c, err := consumer.StartShards(stream, consumer.LATEST, verbose, func(shard string, records []*kinesis.Record) {
+		now := time.Now()
+		for _, r := range records {
+			if seq, ok := parseProbe(tag, r.Data); ok {
+				results <- probeResult{seq, shard, now}
+			}
+		}
+	}, opts...)
+	fatalOnErr(err)
+
+	// don't send anything until every shard has an iterator at LATEST, or the
+	// first probes could be written before there's anything to read them
+	for !c.CaughtUp() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p := producer.New(stream, producer.WithConfig(awsConfig))
+	p.Debug = verbose
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	stats := &pingStats{sent: make(map[int]*probe), received: make(map[int]pingResult)}
+	fmt.Printf("PING %s\n", stream)
+
+	send := func() {
+		seq := len(stats.sent)
+		key := fmt.Sprintf("%s-%s-%d", probePrefix, runId, seq)
+
+		start := time.Now()
+		fatalOnErr(p.Put(aws.String(key), []byte(tag+strconv.Itoa(seq))))
+		fatalOnErr(p.Flush())
+		stats.sent[seq] = &probe{sentAt: start, putLatency: time.Since(start)}
+	}
+
+	ticker := time.NewTicker(*pingInterval)
+	defer ticker.Stop()
+
+	var deadline <-chan time.Time
+	send()
+
+	for {
+		if *pingCount > 0 && len(stats.sent) == *pingCount && deadline == nil {
+			ticker.Stop()
+			deadline = time.After(*pingTimeout)
+		}
+
+		select {
+		case <-ticker.C:
+			send()
+		case r := <-results:
+			stats.receive(r)
+			if *pingCount > 0 && len(stats.received) == *pingCount {
+				stats.print(stream)
+				return
+			}
+		case <-deadline:
+			stats.print(stream)
+			return
+		case <-interrupt:
+			stats.print(stream)
+			return
+		}
+	}
+}
+
+// Return the sequence number of the probe in data, or false if data isn't a
+// probe with the given tag.
+func parseProbe(tag string, data []byte) (int, bool) {
+	s := string(data)
+	if !strings.HasPrefix(s, tag) {
+		return 0, false
+	}
+
+	seq, err := strconv.Atoi(strings.TrimPrefix(s, tag))
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+type pingStats struct {
+	sent map[int]*probe
+	// results by probe. a probe can be read more than once, e.g. when a
+	// GetRecords call is retried, but it only counts the first time.
+	received map[int]pingResult
+}
+
+type pingResult struct {
+	put, endToEnd time.Duration
+}
+
+func (p *pingStats) receive(r probeResult) {
+	sent, ok := p.sent[r.seq]
+	if !ok {
+		return
+	}
+	if _, dup := p.received[r.seq]; dup {
+		return
+	}
+
+	result := pingResult{put: sent.putLatency, endToEnd: r.at.Sub(sent.sentAt)}
+	p.received[r.seq] = result
+
+	fmt.Printf("probe %d from %s: put=%s end-to-end=%s\n", r.seq, r.shard, roundMillis(result.put), roundMillis(result.endToEnd))
+}
+
+func (p *pingStats) print(stream string) {
+	sent, received := len(p.sent), len(p.received)
+
+	fmt.Printf("\n--- %s ping statistics ---\n", stream)
+	fmt.Printf("%d probes sent, %d received, %.1f%% lost\n", sent, received, percent(int64(sent-received), int64(sent)))
+
+	if received == 0 {
+		return
+	}
+
+	var puts, endToEnds []time.Duration
+	for _, r := range p.received {
+		puts = append(puts, r.put)
+		endToEnds = append(endToEnds, r.endToEnd)
+	}
+
+	fmt.Printf("put min/avg/p99/max = %s\n", summarize(puts))
+	fmt.Printf("end-to-end min/avg/p99/max = %s\n", summarize(endToEnds))
+}
+
+// Format the min, average, p99 and max of a list of durations.
+func summarize(ds []time.Duration) string {
+	sort.Sort(durations(ds))
+
+	var total time.Duration
+	for _, d := range ds {
+		total += d
+	}
+	avg := total / time.Duration(len(ds))
+
+	return fmt.Sprintf("%s/%s/%s/%s",
+		roundMillis(ds[0]), roundMillis(avg), roundMillis(percentile(ds, 99)), roundMillis(ds[len(ds)-1]))
+}
+
+func roundMillis(d time.Duration) string {
+	return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond))
+}
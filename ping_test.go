@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseProbe(t *testing.T) {
+	tag := probePrefix + " abc "
+
+	testCases := []struct {
+		data     string
+		expected int
+		ok       bool
+	}{
+		{data: "ktk-ping abc 0", expected: 0, ok: true},
+		{data: "ktk-ping abc 42", expected: 42, ok: true},
+		{data: "ktk-ping xyz 42", ok: false},
+		{data: "ktk-ping abc ", ok: false},
+		{data: "ktk-ping abc 4x", ok: false},
+		{data: "hello", ok: false},
+	}
+
+	for _, tc := range testCases {
+		seq, ok := parseProbe(tag, []byte(tc.data))
+		if ok != tc.ok || seq != tc.expected {
+			t.Errorf("%q: expected %d, %v, got %d, %v", tc.data, tc.expected, tc.ok, seq, ok)
+		}
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	testCases := []struct {
+		durations []time.Duration
+		expected  string
+	}{
+		{
+			durations: []time.Duration{5 * time.Millisecond},
+			expected:  "5.0ms/5.0ms/5.0ms/5.0ms",
+		},
+		{
+			durations: []time.Duration{30 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond},
+			expected:  "10.0ms/20.0ms/20.0ms/30.0ms",
+		},
+		{
+			durations: []time.Duration{1500 * time.Microsecond, 2 * time.Millisecond},
+			expected:  "1.5ms/1.8ms/1.5ms/2.0ms",
+		},
+	}
+
+	for _, tc := range testCases {
+		if actual := summarize(tc.durations); actual != tc.expected {
+			t.Errorf("%v: expected %s, got %s", tc.durations, tc.expected, actual)
+		}
+	}
+}
+
+// test that a probe that's read more than once only counts once.
+func TestPingStatsDuplicates(t *testing.T) {
+	sentAt := time.Unix(1000, 0)
+	stats := &pingStats{sent: make(map[int]*probe), received: make(map[int]pingResult)}
+	stats.sent[0] = &probe{sentAt: sentAt, putLatency: time.Millisecond}
+	stats.sent[1] = &probe{sentAt: sentAt, putLatency: time.Millisecond}
+
+	stats.receive(probeResult{seq: 0, shard: "shard-01", at: sentAt.Add(10 * time.Millisecond)})
+	stats.receive(probeResult{seq: 0, shard: "shard-01", at: sentAt.Add(20 * time.Millisecond)})
+	stats.receive(probeResult{seq: 7, shard: "shard-01", at: sentAt.Add(20 * time.Millisecond)})
+
+	if len(stats.received) != 1 {
+		t.Fatalf("expected 1 probe received, got %d", len(stats.received))
+	}
+	if actual := stats.received[0].endToEnd; actual != 10*time.Millisecond {
+		t.Errorf("expected the first read to count, got an end-to-end latency of %s", actual)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+// A sink that POSTs records to a URL, either a batch at a time as a JSON array
+// of records in the same format ktk dump uses, or one request per record with
+// the record's data as the body. A shard's records are sent in order, one
+// request at a time, so requests only run in parallel across shards.
+//
+// Requests that fail with a 5xx or a 429, or that don't get a response at all
+// before the timeout, fail the batch so it's retried. Any other response is
+// final, and records the endpoint rejects are logged and dropped.
+type postSink struct {
+	url     string
+	raw     bool
+	headers http.Header
+	client  *http.Client
+
+	// limits the number of requests in flight across every shard
+	slots chan struct{}
+}
+
+func newPostSink(url string, raw bool, headers []string, concurrency int, timeout time.Duration) (*postSink, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	h := make(http.Header)
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid header %q: expected Name: value", header)
+		}
+		h.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	return &postSink{
+		url:     url,
+		raw:     raw,
+		headers: h,
+		client:  &http.Client{Timeout: timeout},
+		slots:   make(chan struct{}, concurrency),
+	}, nil
+}
+
+func (p *postSink) send(shard string, records []*kinesis.Record) error {
+	if !p.raw {
+		archived := make([]*archivedRecord, len(records))
+		for i, r := range records {
+			archived[i] = &archivedRecord{
+				ShardId:        shard,
+				SequenceNumber: aws.StringValue(r.SequenceNumber),
+				PartitionKey:   aws.StringValue(r.PartitionKey),
+				ArrivalTime:    r.ApproximateArrivalTimestamp,
+				Data:           r.Data,
+			}
+		}
+		body, err := json.Marshal(archived)
+		if err != nil {
+			return err
+		}
+		return p.post(shard, len(records), "application/json", bytes.NewReader(body), nil)
+	}
+
+	for _, r := range records {
+		headers := http.Header{
+			"X-Ktk-Shard-Id":        {shard},
+			"X-Ktk-Sequence-Number": {aws.StringValue(r.SequenceNumber)},
+			"X-Ktk-Partition-Key":   {aws.StringValue(r.PartitionKey)},
+		}
+		if err := p.post(shard, 1, "application/octet-stream", bytes.NewReader(r.Data), headers); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Make a single request, waiting for a free slot first.
+func (p *postSink) post(shard string, n int, contentType string, body io.Reader, headers http.Header) error {
+	p.slots <- struct{}{}
+	defer func() { <-p.slots }()
+
+	req, err := http.NewRequest("POST", p.url, body)
+	if err != nil {
+		return err
+	}
+	for name, values := range p.headers {
+		req.Header[name] = values
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %s", shard, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("%s: %s returned %s", shard, p.url, resp.Status)
+	default:
+		log.Printf("error: %s: %s returned %s, dropping %d records", shard, p.url, resp.Status, n)
+		return nil
+	}
+}
+
+func (p *postSink) stop(shard string) {}
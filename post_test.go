@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A server that keeps every request it gets and responds with status.
+type postServer struct {
+	*httptest.Server
+
+	sync.Mutex
+	status   func(body string) int
+	bodies   []string
+	requests []*http.Request
+}
+
+func newPostServer(status func(body string) int) *postServer {
+	s := &postServer{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		s.Lock()
+		s.bodies = append(s.bodies, string(body))
+		s.requests = append(s.requests, r)
+		s.Unlock()
+
+		w.WriteHeader(s.status(string(body)))
+	}))
+	return s
+}
+
+func respondWith(status int) func(string) int {
+	return func(string) int { return status }
+}
+
+// test that batches are POSTed as JSON arrays of dumped records, with extra
+// headers added.
+func TestPostSinkJSON(t *testing.T) {
+	server := newPostServer(respondWith(http.StatusOK))
+	defer server.Close()
+
+	p, err := newPostSink(server.URL, false, []string{"Authorization: Bearer hunter2"}, 1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.send("shard-01", numberedRecords(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(server.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(server.requests))
+	}
+	req := server.requests[0]
+	if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %q", ct)
+	}
+	if auth := req.Header.Get("Authorization"); auth != "Bearer hunter2" {
+		t.Errorf("expected the Authorization header to be passed through, got %q", auth)
+	}
+
+	var records []*archivedRecord
+	if err := json.Unmarshal([]byte(server.bodies[0]), &records); err != nil {
+		t.Fatal(err)
+	}
+	var seqs []string
+	for _, r := range records {
+		if r.ShardId != "shard-01" {
+			t.Errorf("expected records from shard-01, got %s", r.ShardId)
+		}
+		seqs = append(seqs, r.SequenceNumber)
+	}
+	if expected := []string{"1", "2"}; !reflect.DeepEqual(seqs, expected) {
+		t.Errorf("expected records %v, got %v", expected, seqs)
+	}
+}
+
+// test that raw records are POSTed one at a time, in order, with their
+// metadata in headers, and that a shard stops at the first failure.
+func TestPostSinkRaw(t *testing.T) {
+	server := newPostServer(func(body string) int {
+		if body == "3" {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	defer server.Close()
+
+	p, err := newPostSink(server.URL, true, nil, 4, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.send("shard-01", numberedRecords(1, 2, 3, 4)); err == nil {
+		t.Error("expected an error from a failed record")
+	}
+
+	if expected := []string{"1", "2", "3"}; !reflect.DeepEqual(server.bodies, expected) {
+		t.Errorf("expected requests for %v, got %v", expected, server.bodies)
+	}
+
+	expected := http.Header{
+		"Content-Type":          {"application/octet-stream"},
+		"X-Ktk-Shard-Id":        {"shard-01"},
+		"X-Ktk-Sequence-Number": {"2"},
+		"X-Ktk-Partition-Key":   {"2"},
+	}
+	for name, values := range expected {
+		if actual := server.requests[1].Header[name]; !reflect.DeepEqual(actual, values) {
+			t.Errorf("%s: expected %v, got %v", name, values, actual)
+		}
+	}
+}
+
+// test which responses fail a batch so it's retried, and which drop it.
+func TestPostSinkResponses(t *testing.T) {
+	testCases := []struct {
+		status int
+		retry  bool
+	}{
+		{status: http.StatusOK, retry: false},
+		{status: http.StatusAccepted, retry: false},
+		{status: http.StatusInternalServerError, retry: true},
+		{status: http.StatusBadGateway, retry: true},
+		{status: http.StatusTooManyRequests, retry: true},
+		{status: http.StatusBadRequest, retry: false},
+		{status: http.StatusNotFound, retry: false},
+	}
+
+	for _, tc := range testCases {
+		server := newPostServer(respondWith(tc.status))
+
+		p, err := newPostSink(server.URL, false, nil, 1, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.send("shard-01", numberedRecords(1))
+		if retry := err != nil; retry != tc.retry {
+			t.Errorf("%d: expected retry to be %v, got error %v", tc.status, tc.retry, err)
+		}
+
+		server.Close()
+	}
+}
+
+// test that a request that takes too long fails the batch.
+func TestPostSinkTimeout(t *testing.T) {
+	server := newPostServer(func(string) int {
+		time.Sleep(100 * time.Millisecond)
+		return http.StatusOK
+	})
+	defer server.Close()
+
+	p, err := newPostSink(server.URL, false, nil, 1, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.send("shard-01", numberedRecords(1)); err == nil {
+		t.Error("expected a request that timed out to fail the batch")
+	}
+}
+
+func TestPostSinkInvalidHeader(t *testing.T) {
+	for _, header := range []string{"Authorization", ": value"} {
+		if _, err := newPostSink("http://localhost", false, []string{header}, 1, time.Second); err == nil {
+			t.Errorf("%q: expected an error", header)
+		}
+	}
+}
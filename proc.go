@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// Start child processes in their own process group.
+func childProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
@@ -0,0 +1,9 @@
+package main
+
+import "syscall"
+
+// Windows doesn't send console interrupts to child processes started without a
+// console of their own, so there's nothing to do.
+func childProcAttr() *syscall.SysProcAttr {
+	return nil
+}
@@ -21,11 +21,34 @@ var (
 )
 
 // An interface that covers the way the producer uses kinesis.Kinesis so that
-// the client can be stubbed out for tests.
-type kinesisClient interface {
+// the client can be stubbed out for tests. Satisfied by *kinesistest.Kinesis.
+type KinesisClient interface {
 	PutRecords(*kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error)
 }
 
+// The outcome of a single PutRecords request, passed to Producer.OnPut.
+type PutResult struct {
+	// The number of records in the request.
+	Records int
+	// The number of records that failed and will be retried.
+	Failed int
+	// The number of failed records that failed because the stream's
+	// throughput limit was exceeded.
+	Throttled int
+	// How long the request took.
+	Latency time.Duration
+	// Non-nil if the request failed entirely.
+	Err error
+}
+
+// Where a record put with PutCallback ended up. Err is set instead if the
+// record couldn't be sent.
+type Delivery struct {
+	ShardId        string
+	SequenceNumber string
+	Err            error
+}
+
 // A pair type for buffering input.
 type message struct {
 	PartitionKey *string
@@ -49,9 +72,15 @@ type Producer struct {
 	Throttle func() Throttle
 	Debug    bool
 
-	client   kinesisClient
+	// If set, called after every PutRecords request, including retries.
+	OnPut func(PutResult)
+
+	config   *aws.Config
+	client   KinesisClient
 	current  int
 	messages []message
+	// callbacks for buffered messages, by index. nil until a message has one.
+	callbacks []func(Delivery)
 }
 
 // Create a new Producer with the max Kinesis send size and the default AWS
@@ -59,14 +88,13 @@ type Producer struct {
 // ProvisionedThroughputExceededExceptions will be retried automatically until
 // they succeed, using an exponential backoff.
 //
-// To configure a client more fully, set SendSize and Client before usage. They
-// *must* be set before the first call to Put, otherwise behavior is undefined.
-// SendSize must be >= 0 and <= MaxSendSize.
-func New(stream string) *Producer {
-	return &Producer{
+// To configure a client more fully, pass options or set SendSize before usage.
+// It *must* be set before the first call to Put, otherwise behavior is
+// undefined. SendSize must be >= 0 and <= MaxSendSize.
+func New(stream string, opts ...Option) *Producer {
+	p := &Producer{
 		StreamName: stream,
 		SendSize:   MaxSendSize,
-		client:     kinesis.New(nil),
 		messages:   make([]message, MaxSendSize),
 		Throttle: func() Throttle {
 			return &exponentialThrottle{
@@ -76,6 +104,34 @@ func New(stream string) *Producer {
 			}
 		},
 	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if p.client == nil {
+		p.client = kinesis.New(p.config)
+	}
+	return p
+}
+
+// An Option configures a Producer.
+type Option func(*Producer)
+
+// Create the Producer's Kinesis client with the given AWS config instead of the
+// SDK defaults.
+func WithConfig(config *aws.Config) Option {
+	return func(p *Producer) {
+		p.config = config
+	}
+}
+
+// Use the given Kinesis client instead of creating one. Takes precedence over
+// WithConfig.
+func WithClient(client KinesisClient) Option {
+	return func(p *Producer) {
+		p.client = client
+	}
 }
 
 // Send the given string to Kinesis. The first 256 bytes of the string will be
@@ -97,10 +153,24 @@ func intMin(x, y int) int {
 //
 // TODO: what happens if we just let Kinesis error on bad records?
 func (p *Producer) Put(key *string, value []byte) error {
-	if err := validate(key, value); err != nil {
+	return p.PutCallback(key, value, nil)
+}
+
+// Like Put, but calls done once the record has been written with the shard
+// and sequence number Kinesis gave it. If the request sending the record
+// fails, done is called with the error instead. done is called from whichever
+// call to Put or Flush sends the record.
+func (p *Producer) PutCallback(key *string, value []byte, done func(Delivery)) error {
+	if err := Validate(key, value); err != nil {
 		return err
 	}
 
+	if done != nil {
+		if p.callbacks == nil {
+			p.callbacks = make([]func(Delivery), len(p.messages))
+		}
+		p.callbacks[p.current] = done
+	}
 	p.messages[p.current] = message{key, value}
 	p.current++
 
@@ -111,7 +181,8 @@ func (p *Producer) Put(key *string, value []byte) error {
 	return nil
 }
 
-func validate(key *string, value []byte) error {
+// Check that a record can be sent. Put returns the same errors.
+func Validate(key *string, value []byte) error {
 	var err *multierror.Error
 
 	if len(*key) == 0 {
@@ -138,22 +209,38 @@ func (p *Producer) Flush() error {
 func (p *Producer) reset() {
 	p.current = 0
 	p.messages = make([]message, p.SendSize)
+	p.callbacks = nil
 }
 
 func (p *Producer) send() error {
-	if len(p.messages) == 0 {
+	if p.current == 0 {
 		return nil
 	}
 
 	defer p.reset()
 
 	stream, messages := aws.String(p.StreamName), p.messages[0:p.current]
+	var callbacks []func(Delivery)
+	if p.callbacks != nil {
+		callbacks = p.callbacks[0:p.current]
+	}
+
 	for {
+		start := time.Now()
 		res, err := p.client.PutRecords(putRecordsInput(stream, messages))
+		p.report(len(messages), res, err, time.Since(start))
 
 		if err != nil {
+			for _, done := range callbacks {
+				if done != nil {
+					done(Delivery{Err: err})
+				}
+			}
 			return err
 		}
+		if callbacks != nil {
+			callbacks = deliver(callbacks, res.Records)
+		}
 
 		if *res.FailedRecordCount == 0 {
 			if p.Debug {
@@ -168,7 +255,26 @@ func (p *Producer) send() error {
 		}
 		p.Throttle().Await()
 	}
-	return nil
+}
+
+func (p *Producer) report(records int, res *kinesis.PutRecordsOutput, err error, latency time.Duration) {
+	if p.OnPut == nil {
+		return
+	}
+
+	result := PutResult{Records: records, Latency: latency, Err: err}
+	if res != nil {
+		for _, e := range res.Records {
+			if aws.StringValue(e.ErrorCode) == "" {
+				continue
+			}
+			result.Failed++
+			if *e.ErrorCode == "ProvisionedThroughputExceededException" {
+				result.Throttled++
+			}
+		}
+	}
+	p.OnPut(result)
 }
 
 func putRecordsInput(stream *string, messages []message) *kinesis.PutRecordsInput {
@@ -186,10 +292,26 @@ func putRecordsInput(stream *string, messages []message) *kinesis.PutRecordsInpu
 	}
 }
 
+// Call the callbacks of every record that was written, and return the
+// callbacks of the records that failed.
+func deliver(callbacks []func(Delivery), records []*kinesis.PutRecordsResultEntry) []func(Delivery) {
+	var failed []func(Delivery)
+	for i, e := range records {
+		if aws.StringValue(e.ErrorCode) != "" {
+			failed = append(failed, callbacks[i])
+			continue
+		}
+		if callbacks[i] != nil {
+			callbacks[i](Delivery{ShardId: aws.StringValue(e.ShardId), SequenceNumber: aws.StringValue(e.SequenceNumber)})
+		}
+	}
+	return failed
+}
+
 func failedMessages(messages []message, records []*kinesis.PutRecordsResultEntry) []message {
 	var resend []message
 	for i, e := range records {
-		if e.ErrorCode != nil {
+		if aws.StringValue(e.ErrorCode) != "" {
 			resend = append(resend, messages[i])
 		}
 	}
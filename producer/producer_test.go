@@ -8,6 +8,7 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/kinesistest"
 	"github.com/hashicorp/go-multierror"
 )
 
@@ -102,6 +103,30 @@ func TestPutSends(t *testing.T) {
 	}
 }
 
+func TestNewWithConfig(t *testing.T) {
+	producer := New(TestStream, WithConfig(aws.NewConfig().WithRegion("ap-southeast-2")))
+
+	client, ok := producer.client.(*kinesis.Kinesis)
+	if !ok {
+		t.Fatalf("expected a Kinesis client, got %T", producer.client)
+	}
+	if region := aws.StringValue(client.Config.Region); region != "ap-southeast-2" {
+		t.Errorf("expected the client to use the configured region, got %q", region)
+	}
+}
+
+func TestFlushEmpty(t *testing.T) {
+	producer := producerWithStubClient(MaxSendSize)
+	client := producer.client.(*StubClient)
+
+	if err := producer.Flush(); err != nil {
+		t.Fatalf("expected no Flush errors. got '%s'", err)
+	}
+	if client.puts != 0 {
+		t.Errorf("expected flushing an empty producer not to send anything, got %d sends", client.puts)
+	}
+}
+
 func TestPutRetriesFailedRecords(t *testing.T) {
 	testCases := []struct {
 		name      string
@@ -158,6 +183,151 @@ func TestPutRetriesFailedRecords(t *testing.T) {
 	}
 }
 
+func TestOnPutReportsFailures(t *testing.T) {
+	producer := producerRespondingWith(MaxSendSize,
+		clientResponse{outputWithErrors("", "ProvisionedThroughputExceededException", "InternalFailure"), nil},
+	)
+
+	var results []PutResult
+	producer.OnPut = func(r PutResult) {
+		r.Latency = 0
+		results = append(results, r)
+	}
+
+	for _, m := range []string{"twinkle", "twinkle", "little"} {
+		if err := producer.PutString(m); err != nil {
+			t.Fatalf("unexpected producer error! %s", err)
+		}
+	}
+	producer.Flush()
+
+	expected := []PutResult{
+		{Records: 3, Failed: 2, Throttled: 1},
+		{Records: 2},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("expected results %+v, got %+v", expected, results)
+	}
+}
+
+func TestPutWithThrottledShards(t *testing.T) {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(TestStream), ShardCount: aws.Int64(4)})
+
+	// throttle every other record
+	calls := 0
+	fake.PutFault = func(stream, shard string) string {
+		calls++
+		if calls%2 == 0 {
+			return kinesistest.ProvisionedThroughputExceeded
+		}
+		return ""
+	}
+
+	producer := New(TestStream, WithClient(fake))
+	producer.Throttle = func() Throttle { return &noOpThrottle{} }
+
+	throttled := 0
+	producer.OnPut = func(r PutResult) { throttled += r.Throttled }
+
+	expected := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		m := fmt.Sprintf("record-%d", i)
+		expected[m] = true
+		if err := producer.PutString(m); err != nil {
+			t.Fatalf("unexpected producer error! %s", err)
+		}
+	}
+	if err := producer.Flush(); err != nil {
+		t.Fatalf("unexpected flush error! %s", err)
+	}
+
+	records := fake.Records(TestStream)
+	if len(records) != len(expected) {
+		t.Errorf("expected every record to be written exactly once, got %d records", len(records))
+	}
+	for _, r := range records {
+		delete(expected, string(r.Data))
+	}
+	if len(expected) > 0 {
+		t.Errorf("records were never written: %v", expected)
+	}
+	if throttled == 0 {
+		t.Errorf("expected OnPut to report throttled records")
+	}
+}
+
+// test that every record put with a callback is reported exactly once, with
+// the shard and sequence number it was written with, even when it's retried.
+func TestPutCallback(t *testing.T) {
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(TestStream), ShardCount: aws.Int64(4)})
+
+	calls := 0
+	fake.PutFault = func(stream, shard string) string {
+		calls++
+		if calls%3 == 0 {
+			return kinesistest.ProvisionedThroughputExceeded
+		}
+		return ""
+	}
+
+	producer := New(TestStream, WithClient(fake))
+	producer.SendSize = 10
+	producer.Throttle = func() Throttle { return &noOpThrottle{} }
+
+	deliveries := make(map[string][]Delivery)
+	for i := 0; i < 25; i++ {
+		m := fmt.Sprintf("record-%d", i)
+		err := producer.PutCallback(aws.String(m), []byte(m), func(d Delivery) {
+			deliveries[m] = append(deliveries[m], d)
+		})
+		if err != nil {
+			t.Fatalf("unexpected producer error! %s", err)
+		}
+		// a record without a callback mixed in
+		if err := producer.PutString("no-callback"); err != nil {
+			t.Fatalf("unexpected producer error! %s", err)
+		}
+	}
+	if err := producer.Flush(); err != nil {
+		t.Fatalf("unexpected flush error! %s", err)
+	}
+
+	if len(deliveries) != 25 {
+		t.Errorf("expected 25 records to be delivered, got %d", len(deliveries))
+	}
+	for _, r := range fake.Records(TestStream) {
+		if string(r.Data) == "no-callback" {
+			continue
+		}
+		d := deliveries[string(r.Data)]
+		if len(d) != 1 {
+			t.Errorf("expected %s to be delivered once, got %+v", r.Data, d)
+			continue
+		}
+		if d[0].Err != nil || d[0].SequenceNumber != *r.SequenceNumber || d[0].ShardId == "" {
+			t.Errorf("expected %s to be delivered with sequence number %s, got %+v", r.Data, *r.SequenceNumber, d[0])
+		}
+	}
+}
+
+func TestPutCallbackError(t *testing.T) {
+	producer := New("missing", WithClient(kinesistest.New()))
+
+	var delivered Delivery
+	if err := producer.PutCallback(aws.String("key"), []byte("value"), func(d Delivery) { delivered = d }); err != nil {
+		t.Fatalf("unexpected producer error! %s", err)
+	}
+	err := producer.Flush()
+	if err == nil {
+		t.Fatalf("expected an error putting to a missing stream")
+	}
+	if delivered.Err != err {
+		t.Errorf("expected the callback to get the flush error, got %+v", delivered)
+	}
+}
+
 func assertSentMessages(t *testing.T, testName string, expected []message, actual []*kinesis.PutRecordsRequestEntry) {
 	var sent []message
 	for _, record := range actual {
@@ -193,7 +363,7 @@ func errContains(e error, checkForErrors ...error) bool {
 	return true
 }
 
-// The return values from kinesisClient.PutRecords
+// The return values from KinesisClient.PutRecords
 type clientResponse struct {
 	output *kinesis.PutRecordsOutput
 	err    error
@@ -224,7 +394,7 @@ func (s *StubClient) PutRecords(input *kinesis.PutRecordsInput) (*kinesis.PutRec
 	}
 
 	for i, record := range input.Records {
-		if response.Records[i].ErrorCode == nil {
+		if aws.StringValue(response.Records[i].ErrorCode) == "" {
 			s.sent = append(s.sent, record)
 		}
 	}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+)
+
+// The most a rateLimiter will let callers burst after being idle.
+const maxBurst = time.Second
+
+// Limits the rate of records and bytes sent to Kinesis. A zero limit means
+// unlimited. Not safe for use from multiple goroutines.
+type rateLimiter struct {
+	recordsPerSecond float64
+	bytesPerSecond   float64
+
+	start          time.Time
+	records, bytes float64
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newRateLimiter(recordsPerSecond, bytesPerSecond float64) *rateLimiter {
+	return &rateLimiter{
+		recordsPerSecond: recordsPerSecond,
+		bytesPerSecond:   bytesPerSecond,
+		start:            time.Now(),
+		now:              time.Now,
+		sleep:            time.Sleep,
+	}
+}
+
+// Block until sending another record of the given size would stay under the
+// limit.
+func (r *rateLimiter) wait(size int) {
+	if r.recordsPerSecond <= 0 && r.bytesPerSecond <= 0 {
+		return
+	}
+
+	r.records++
+	r.bytes += float64(size)
+
+	var seconds float64
+	if r.recordsPerSecond > 0 {
+		seconds = r.records / r.recordsPerSecond
+	}
+	if r.bytesPerSecond > 0 && r.bytes/r.bytesPerSecond > seconds {
+		seconds = r.bytes / r.bytesPerSecond
+	}
+
+	sendAt := r.start.Add(time.Duration(seconds * float64(time.Second)))
+	now := r.now()
+
+	// don't let a long idle period turn into an unbounded burst
+	if now.Sub(sendAt) > maxBurst {
+		r.start = r.start.Add(now.Sub(sendAt) - maxBurst)
+		return
+	}
+
+	if sendAt.After(now) {
+		r.sleep(sendAt.Sub(now))
+	}
+}
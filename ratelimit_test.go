@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A clock that only moves when something sleeps.
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.slept += d
+	c.now = c.now.Add(d)
+}
+
+func fakeRateLimiter(recordsPerSecond, bytesPerSecond float64) (*rateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+
+	r := newRateLimiter(recordsPerSecond, bytesPerSecond)
+	r.start = clock.now
+	r.now = func() time.Time { return clock.now }
+	r.sleep = clock.sleep
+	return r, clock
+}
+
+func TestRateLimiter(t *testing.T) {
+	testCases := []struct {
+		name             string
+		recordsPerSecond float64
+		bytesPerSecond   float64
+		sizes            []int
+		expected         time.Duration
+	}{
+		{
+			name:     "unlimited",
+			sizes:    []int{100, 100, 100},
+			expected: 0,
+		},
+		{
+			name:             "records",
+			recordsPerSecond: 10,
+			sizes:            []int{1, 1, 1, 1, 1},
+			expected:         500 * time.Millisecond,
+		},
+		{
+			name:           "bytes",
+			bytesPerSecond: 100,
+			sizes:          []int{50, 50, 100},
+			expected:       2 * time.Second,
+		},
+		{
+			name:             "bytes are the tighter limit",
+			recordsPerSecond: 100,
+			bytesPerSecond:   100,
+			sizes:            []int{100, 100},
+			expected:         2 * time.Second,
+		},
+		{
+			name:             "records are the tighter limit",
+			recordsPerSecond: 1,
+			bytesPerSecond:   1000,
+			sizes:            []int{1, 1},
+			expected:         2 * time.Second,
+		},
+	}
+
+	for _, tc := range testCases {
+		r, clock := fakeRateLimiter(tc.recordsPerSecond, tc.bytesPerSecond)
+		for _, size := range tc.sizes {
+			r.wait(size)
+		}
+		if clock.slept != tc.expected {
+			t.Errorf("%s: expected to sleep for %s, slept for %s", tc.name, tc.expected, clock.slept)
+		}
+	}
+}
+
+// test that a limiter that's been idle only lets about a second's worth of
+// records through before limiting again.
+func TestRateLimiterBurst(t *testing.T) {
+	r, clock := fakeRateLimiter(10, 0)
+	clock.now = clock.now.Add(time.Minute)
+
+	for i := 0; i < 10; i++ {
+		r.wait(1)
+	}
+	if clock.slept != 0 {
+		t.Errorf("expected a burst of 10 records without sleeping, slept for %s", clock.slept)
+	}
+
+	for i := 0; i < 10; i++ {
+		r.wait(1)
+	}
+	if clock.slept < 800*time.Millisecond || clock.slept > time.Second {
+		t.Errorf("expected to sleep for about a second after the burst, slept for %s", clock.slept)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+	"github.com/blinsay/ktk/kcl"
+)
+
+var runFlags = flag.NewFlagSet("run", flag.ContinueOnError)
+
+var (
+	runApp          = runFlags.String("app", "", "the KCL application name, which is also the name of its lease table")
+	runFrom         = runFlags.String("from", "latest", "where to start shards without a checkpoint: latest or trim-horizon")
+	runWorkerId     = runFlags.String("worker-id", defaultWorkerId(), "this worker's name in the lease table")
+	runLeaseTimeout = runFlags.Duration("lease-timeout", consumer.DefaultLeaseTimeout, "how long before taking over a lease that isn't being renewed")
+)
+
+var runCommand = &Command{
+	Name:  "run",
+	Usage: "run stream --app=name [--from=latest] [--worker-id=id] [--lease-timeout=10s] -- command [args...]",
+	Short: "Run KCL MultiLangDaemon record processors",
+	Description: `
+	Consume a stream with record processors written for the Kinesis Client
+	Library's MultiLangDaemon. A copy of command is started for every shard this
+	worker holds a lease on, and is sent the shard's records as JSON on stdin.
+	Processors reply on stdout, and anything they write to stderr is passed
+	through.
+
+	Processors get initialize, processRecords, shardEnded and shutdown
+	messages, and can checkpoint at any time. Nothing is checkpointed unless a
+	processor asks for it. Processors for shards whose leases are lost, or that
+	are running when ktk is interrupted, are sent shutdown with reason ZOMBIE.
+
+	A processor that exits or breaks the protocol only stops its own shard. It's
+	killed, and its shard's lease is released so the shard starts over from its
+	last checkpoint with a new processor.
+
+	Leases and checkpoints are kept in the same DynamoDB table the KCL uses for
+	--app, which is created if it doesn't exist. ktk workers and KCL workers
+	can share an application. --from only applies the first time the lease
+	table is filled in.
+	`,
+	Flags: runFlags,
+	Run:   runRun,
+}
+
+func runRun(args []string) {
+	if len(args) < 2 {
+		log.Fatalln("error: a stream name and a command are required")
+	}
+	if *runApp == "" {
+		log.Fatalln("error: --app is required")
+	}
+
+	var from *string
+	switch *runFrom {
+	case "latest":
+		from = consumer.LATEST
+	case "trim-horizon":
+		from = consumer.TRIM_HORIZON
+	default:
+		log.Fatalf("error: --from must be latest or trim-horizon, got %q", *runFrom)
+	}
+
+	table := kcl.New(*runApp, dynamoDBConfig())
+	fatalOnErr(table.Create())
+
+	c, err := startMultiLang(args[0], from, args[1:],
+		consumer.WithConfig(awsConfig),
+		consumer.WithLeases(table, *runWorkerId),
+		consumer.WithLeaseTimeout(*runLeaseTimeout),
+	)
+	fatalOnErr(err)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	signal.Stop(interrupt)
+
+	fatalOnErr(c.Close())
+}
+
+// Start a Consumer that runs command as a MultiLangDaemon record processor for
+// every shard it reads. Checkpoints are left to the processors.
+func startMultiLang(stream string, from *string, command []string, opts ...consumer.Option) (*consumer.Consumer, error) {
+	r := &multiLangRunner{
+		command:    command,
+		ready:      make(chan struct{}),
+		processors: make(map[string]*multiLangProcessor),
+	}
+
+	opts = append(opts,
+		consumer.WithManualCheckpoints(),
+		consumer.WithShardHooks(consumer.ShardHooks{Start: r.start, Stop: r.stop}),
+	)
+	c, err := consumer.StartBatches(stream, from, verbose, r.processRecords, opts...)
+	if err != nil {
+		return nil, err
+	}
+	r.consumer = c
+	close(r.ready)
+	return c, nil
+}
+
+// The parts of a Consumer record processors use.
+type multiLangConsumer interface {
+	Checkpoint(shard, seq string) error
+	Release(shard string)
+}
+
+// Runs a MultiLangDaemon record processor for every shard a Consumer reads.
+//
+// A processor that can't be started, exits, or breaks the protocol only stops
+// its own shard. The processor is killed and the shard's lease is released, so
+// the shard starts over from its last checkpoint with a new processor.
+type multiLangRunner struct {
+	command []string
+
+	// Shards can start before the Consumer has been returned, so hooks wait
+	// for ready before using it.
+	consumer multiLangConsumer
+	ready    chan struct{}
+
+	sync.Mutex
+	processors map[string]*multiLangProcessor
+}
+
+var errProcessorFailed = errors.New("record processor failed")
+
+func (r *multiLangRunner) start(shard, from string) {
+	<-r.ready
+
+	p, err := startMultiLangProcessor(r.command, shard, r.consumer)
+	if err != nil {
+		r.fail(shard, fmt.Errorf("%s: starting record processor: %s", shard, err))
+		return
+	}
+
+	r.Lock()
+	r.processors[shard] = p
+	r.Unlock()
+
+	if err := p.initialize(from); err != nil {
+		p.failed = true
+		r.fail(shard, err)
+	}
+}
+
+func (r *multiLangRunner) processRecords(_ context.Context, shard string, records []*kinesis.Record) error {
+	p := r.processor(shard)
+	if p == nil || p.failed {
+		return errProcessorFailed
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	if err := p.processRecords(records); err != nil {
+		p.failed = true
+		r.fail(shard, err)
+		return err
+	}
+	return nil
+}
+
+func (r *multiLangRunner) stop(shard string, ended bool) {
+	p := r.processor(shard)
+	if p == nil {
+		return
+	}
+
+	r.Lock()
+	delete(r.processors, shard)
+	r.Unlock()
+
+	if p.failed {
+		p.kill()
+		return
+	}
+	if err := p.shutdown(ended); err != nil {
+		log.Printf("error: %s", err)
+		p.kill()
+	}
+}
+
+// Stop a shard whose processor has failed.
+func (r *multiLangRunner) fail(shard string, err error) {
+	log.Printf("error: %s. stopping %s", err, shard)
+	r.consumer.Release(shard)
+}
+
+func (r *multiLangRunner) processor(shard string) *multiLangProcessor {
+	r.Lock()
+	defer r.Unlock()
+	return r.processors[shard]
+}
+
+// A single record processor child process, talking the MultiLangDaemon
+// protocol: every message is a line of JSON, and the child answers each one
+// with a status message once it's done with it. While it works on a message,
+// the child may ask to checkpoint.
+type multiLangProcessor struct {
+	shard    string
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   *bufio.Scanner
+	consumer multiLangConsumer
+
+	// The last sequence number sent to the child, and whether the shard has
+	// ended. A checkpoint without a sequence number is a checkpoint at the
+	// last record sent, or at SHARD_END once the shard has ended.
+	lastSeq string
+	ended   bool
+
+	// Set once the child has exited or broken the protocol. It's killed
+	// instead of being sent anything else.
+	failed bool
+}
+
+type multiLangMessage struct {
+	Action string `json:"action"`
+
+	// initialize
+	ShardId           string `json:"shardId,omitempty"`
+	SequenceNumber    string `json:"sequenceNumber,omitempty"`
+	SubSequenceNumber *int64 `json:"subSequenceNumber,omitempty"`
+
+	// processRecords
+	Records []*multiLangRecord `json:"records,omitempty"`
+
+	// shutdown
+	Reason string `json:"reason,omitempty"`
+
+	// checkpoint replies
+	Checkpoint *string `json:"checkpoint,omitempty"`
+	Error      *string `json:"error,omitempty"`
+}
+
+type multiLangRecord struct {
+	Data                        string `json:"data"`
+	PartitionKey                string `json:"partitionKey"`
+	SequenceNumber              string `json:"sequenceNumber"`
+	SubSequenceNumber           int64  `json:"subSequenceNumber"`
+	ApproximateArrivalTimestamp int64  `json:"approximateArrivalTimestamp,omitempty"`
+}
+
+// A message from the child. Checkpoints have a null sequence number to
+// checkpoint at the most recent record.
+type multiLangReply struct {
+	Action         string  `json:"action"`
+	ResponseFor    string  `json:"responseFor"`
+	SequenceNumber *string `json:"sequenceNumber"`
+}
+
+func startMultiLangProcessor(command []string, shard string, c multiLangConsumer) (*multiLangProcessor, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stderr = os.Stderr
+	// keep the child out of ktk's process group, so an interrupt from the
+	// terminal reaches ktk and the child is shut down cleanly instead of dying
+	cmd.SysProcAttr = childProcAttr()
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, 64*1024*1024)
+	return &multiLangProcessor{shard: shard, cmd: cmd, stdin: stdin, stdout: scanner, consumer: c}, nil
+}
+
+func (p *multiLangProcessor) initialize(from string) error {
+	return p.send(&multiLangMessage{Action: "initialize", ShardId: p.shard, SequenceNumber: from, SubSequenceNumber: aws.Int64(0)})
+}
+
+func (p *multiLangProcessor) processRecords(records []*kinesis.Record) error {
+	msg := &multiLangMessage{Action: "processRecords", Records: make([]*multiLangRecord, len(records))}
+	for i, r := range records {
+		msg.Records[i] = &multiLangRecord{
+			Data:           base64.StdEncoding.EncodeToString(r.Data),
+			PartitionKey:   aws.StringValue(r.PartitionKey),
+			SequenceNumber: aws.StringValue(r.SequenceNumber),
+		}
+		if r.ApproximateArrivalTimestamp != nil {
+			msg.Records[i].ApproximateArrivalTimestamp = r.ApproximateArrivalTimestamp.UnixNano() / 1e6
+		}
+	}
+
+	p.lastSeq = aws.StringValue(records[len(records)-1].SequenceNumber)
+	return p.send(msg)
+}
+
+// Tell the child its shard has ended, or that it's a zombie that no longer
+// owns its shard, and wait for it to exit.
+func (p *multiLangProcessor) shutdown(ended bool) error {
+	msg := &multiLangMessage{Action: "shutdown", Reason: "ZOMBIE"}
+	if ended {
+		p.ended = true
+		msg = &multiLangMessage{Action: "shardEnded"}
+	}
+
+	if err := p.send(msg); err != nil {
+		return err
+	}
+	p.stdin.Close()
+	if err := p.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: record processor exited: %s", p.shard, err)
+	}
+	return nil
+}
+
+// Kill the child without waiting for it to finish what it's doing.
+func (p *multiLangProcessor) kill() {
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+}
+
+// Send a message and handle the child's replies until it says it's done.
+func (p *multiLangProcessor) send(msg *multiLangMessage) error {
+	if err := p.write(msg); err != nil {
+		return err
+	}
+
+	for p.stdout.Scan() {
+		var reply multiLangReply
+		if err := json.Unmarshal(p.stdout.Bytes(), &reply); err != nil {
+			return fmt.Errorf("%s: record processor wrote invalid JSON: %q", p.shard, p.stdout.Text())
+		}
+
+		switch reply.Action {
+		case "status":
+			if reply.ResponseFor != msg.Action {
+				return fmt.Errorf("%s: record processor sent a status for %q while handling %q", p.shard, reply.ResponseFor, msg.Action)
+			}
+			return nil
+		case "checkpoint":
+			if err := p.checkpoint(reply.SequenceNumber); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: record processor sent an unknown action %q", p.shard, reply.Action)
+		}
+	}
+
+	if err := p.stdout.Err(); err != nil {
+		return fmt.Errorf("%s: reading from record processor: %s", p.shard, err)
+	}
+	return fmt.Errorf("%s: record processor exited while handling %s", p.shard, msg.Action)
+}
+
+// Checkpoint for the child and tell it how it went. Failures are reported to
+// the child with the names of the KCL's exceptions.
+func (p *multiLangProcessor) checkpoint(seq *string) error {
+	checkpoint := p.lastSeq
+	switch {
+	case seq != nil:
+		checkpoint = *seq
+	case p.ended:
+		checkpoint = consumer.SHARD_END
+	}
+
+	reply := &multiLangMessage{Action: "checkpoint", Checkpoint: aws.String(checkpoint)}
+	if checkpoint == "" {
+		reply.Error = aws.String("InvalidStateException")
+		return p.write(reply)
+	}
+
+	switch err := p.consumer.Checkpoint(p.shard, checkpoint); err {
+	case nil:
+	case consumer.ErrLeaseLost:
+		reply.Error = aws.String("ShutdownException")
+	default:
+		log.Printf("error: %s: checkpointing at %s: %s", p.shard, checkpoint, err)
+		reply.Error = aws.String("KinesisClientLibDependencyException")
+	}
+	return p.write(reply)
+}
+
+func (p *multiLangProcessor) write(msg *multiLangMessage) error {
+	bs, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := p.stdin.Write(append(bs, '\n')); err != nil {
+		return fmt.Errorf("%s: writing to record processor: %s", p.shard, err)
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+	"github.com/blinsay/ktk/kinesistest"
+)
+
+// Not a real test. Run as a child process, it's a record processor that
+// checkpoints after every batch and at the end of its shard, and exits as soon
+// as it sees a record containing "crash".
+func TestMultiLangHelper(t *testing.T) {
+	if os.Getenv("KTK_TEST_MULTILANG") != "1" {
+		return
+	}
+	defer os.Exit(0)
+
+	in := bufio.NewScanner(os.Stdin)
+	out := json.NewEncoder(os.Stdout)
+
+	checkpoint := func() {
+		out.Encode(&multiLangReply{Action: "checkpoint"})
+		in.Scan()
+	}
+
+	for in.Scan() {
+		var msg multiLangMessage
+		if err := json.Unmarshal(in.Bytes(), &msg); err != nil {
+			os.Exit(2)
+		}
+
+		switch msg.Action {
+		case "processRecords":
+			for _, r := range msg.Records {
+				if data, _ := base64.StdEncoding.DecodeString(r.Data); string(data) == "crash" {
+					os.Exit(3)
+				}
+			}
+			checkpoint()
+		case "shardEnded":
+			checkpoint()
+		}
+		out.Encode(&multiLangReply{Action: "status", ResponseFor: msg.Action})
+	}
+}
+
+var multiLangHelper = []string{os.Args[0], "-test.run=TestMultiLangHelper"}
+
+// Records checkpoints and released shards instead of passing them on to a
+// Consumer.
+type fakeMultiLangConsumer struct {
+	sync.Mutex
+	checkpoints []string
+	released    []string
+}
+
+func (f *fakeMultiLangConsumer) Checkpoint(shard, seq string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.checkpoints = append(f.checkpoints, seq)
+	return nil
+}
+
+func (f *fakeMultiLangConsumer) Release(shard string) {
+	f.Lock()
+	defer f.Unlock()
+	f.released = append(f.released, shard)
+}
+
+// test a processor's whole life: initialize, a couple of batches, and the end
+// of its shard, checkpointing along the way.
+func TestMultiLangProcessor(t *testing.T) {
+	os.Setenv("KTK_TEST_MULTILANG", "1")
+	defer os.Unsetenv("KTK_TEST_MULTILANG")
+
+	c := &fakeMultiLangConsumer{}
+	p, err := startMultiLangProcessor(multiLangHelper, "shard-01", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.initialize(*consumer.TRIM_HORIZON); err != nil {
+		t.Fatalf("unexpected error initializing: %s", err)
+	}
+	if err := p.processRecords(numberedRecords(1, 2)); err != nil {
+		t.Fatalf("unexpected error processing records: %s", err)
+	}
+	if err := p.processRecords(numberedRecords(3)); err != nil {
+		t.Fatalf("unexpected error processing records: %s", err)
+	}
+	if err := p.shutdown(true); err != nil {
+		t.Fatalf("unexpected error ending the shard: %s", err)
+	}
+
+	if expected := []string{"2", "3", consumer.SHARD_END}; !reflect.DeepEqual(c.checkpoints, expected) {
+		t.Errorf("expected checkpoints %v, got %v", expected, c.checkpoints)
+	}
+}
+
+// test that a processor that exits fails the batch it was sent.
+func TestMultiLangProcessorExits(t *testing.T) {
+	os.Setenv("KTK_TEST_MULTILANG", "1")
+	defer os.Unsetenv("KTK_TEST_MULTILANG")
+
+	p, err := startMultiLangProcessor(multiLangHelper, "shard-01", &fakeMultiLangConsumer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.kill()
+
+	if err := p.initialize(*consumer.TRIM_HORIZON); err != nil {
+		t.Fatalf("unexpected error initializing: %s", err)
+	}
+	if err := p.processRecords([]*kinesis.Record{{Data: []byte("crash"), SequenceNumber: aws.String("1")}}); err == nil {
+		t.Error("expected an error from a processor that exited")
+	}
+}
+
+// test that a processor that exits only stops its own shard, and that the
+// rest of the stream keeps being processed and checkpointed.
+func TestMultiLangFailureStopsOneShard(t *testing.T) {
+	os.Setenv("KTK_TEST_MULTILANG", "1")
+	defer os.Unsetenv("KTK_TEST_MULTILANG")
+
+	fake := kinesistest.New()
+	fake.CreateStream(&kinesis.CreateStreamInput{StreamName: aws.String(testStream), ShardCount: aws.Int64(2)})
+	put := func(data, hashKey string) string {
+		out, _ := fake.PutRecord(&kinesis.PutRecordInput{
+			StreamName:      aws.String(testStream),
+			PartitionKey:    aws.String(data),
+			ExplicitHashKey: aws.String(hashKey),
+			Data:            []byte(data),
+		})
+		return aws.StringValue(out.SequenceNumber)
+	}
+
+	put("crash", "0")
+	var last string
+	for _, data := range []string{"a", "b", "c"} {
+		last = put(data, kinesistest.MaxHashKey.String())
+	}
+
+	store := consumer.NewMemoryLeaseStore()
+	c, err := startMultiLang(testStream, consumer.TRIM_HORIZON, multiLangHelper,
+		consumer.WithClient(fake),
+		consumer.WithLeases(store, "worker"),
+		consumer.WithLeaseTimeout(100*time.Millisecond),
+		consumer.WithPollInterval(5*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	checkpoints := func() map[string]string {
+		leases, _ := store.Leases()
+		cps := make(map[string]string)
+		for _, l := range leases {
+			cps[l.ShardId] = l.Checkpoint
+		}
+		return cps
+	}
+
+	expected := map[string]string{
+		"shardId-000000000000": *consumer.TRIM_HORIZON,
+		"shardId-000000000001": last,
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && !reflect.DeepEqual(checkpoints(), expected) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if actual := checkpoints(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected checkpoints %v, got %v", expected, actual)
+	}
+}
+
+// Records with the given sequence numbers, and the sequence numbers as data.
+func numberedRecords(seqs ...int) []*kinesis.Record {
+	var records []*kinesis.Record
+	for _, seq := range seqs {
+		s := aws.String(strconv.Itoa(seq))
+		records = append(records, &kinesis.Record{Data: []byte(*s), PartitionKey: s, SequenceNumber: s})
+	}
+	return records
+}
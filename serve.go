@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/kinesistest"
+)
+
+// The file in --data-dir that every write is appended to.
+const journalFile = "journal.jsonl"
+
+var serveFlags = flag.NewFlagSet("serve", flag.ContinueOnError)
+
+var (
+	servePort    = serveFlags.Int("port", 4567, "the port to listen on")
+	serveShards  = serveFlags.Int64("shards", 1, "the number of shards to create each stream named on the command line with")
+	serveDataDir = serveFlags.String("data-dir", "", "keep streams in this directory instead of in memory")
+)
+
+var serveCommand = &Command{
+	Name:  "serve",
+	Usage: "serve [stream...] [--port=4567] [--shards=1] [--data-dir=dir]",
+	Short: "Run a local Kinesis-compatible server",
+	Description: `
+	Serve the Kinesis API on localhost:--port, for integration tests and offline
+	development. Point ktk at it with --endpoint-url=http://localhost:4567, or
+	point any other Kinesis client's endpoint at it.
+
+	The server speaks the JSON protocol (X-Amz-Target: Kinesis_20131202.*) and
+	supports CreateStream, DeleteStream, ListStreams, DescribeStream, PutRecord,
+	PutRecords, GetShardIterator, GetRecords, SplitShard, MergeShards,
+	AddTagsToStream, RemoveTagsFromStream and ListTagsForStream. Streams are
+	ACTIVE as soon as they're created, records are never trimmed, and requests
+	are accepted with any credentials.
+
+	Any streams named on the command line are created with --shards shards if
+	they don't already exist.
+
+	Streams are kept in memory and lost when the server exits. With --data-dir,
+	every write is also appended to a journal in that directory, and the
+	journal is replayed when the server starts.
+	`,
+	Flags: serveFlags,
+	Run:   runServe,
+}
+
+// A write to the server, as saved in the journal.
+type journalEntry struct {
+	Time      time.Time       `json:"time"`
+	Operation string          `json:"operation"`
+	Input     json.RawMessage `json:"input"`
+}
+
+func runServe(args []string) {
+	fake := kinesistest.New()
+	server := kinesistest.NewServer(fake)
+
+	if *serveDataDir != "" {
+		fatalOnErr(os.MkdirAll(*serveDataDir, 0755))
+
+		path := filepath.Join(*serveDataDir, journalFile)
+		n, err := replayJournal(server, path)
+		fatalOnErr(err)
+		if n > 0 {
+			log.Printf("replayed %d writes from %s", n, path)
+		}
+
+		j, err := openJournal(path)
+		fatalOnErr(err)
+		server.OnWrite = j.write
+	}
+
+	for _, stream := range args {
+		fatalOnErr(createStream(server, stream, *serveShards))
+	}
+
+	handler := http.Handler(server)
+	if verbose {
+		handler = logRequests(server)
+	}
+
+	addr := fmt.Sprintf("localhost:%d", *servePort)
+	log.Printf("serving Kinesis on http://%s", addr)
+	fatalOnErr(http.ListenAndServe(addr, handler))
+}
+
+// Create a stream unless it already exists.
+func createStream(server *kinesistest.Server, stream string, shards int64) error {
+	if _, err := server.Kinesis.DescribeStream(&kinesis.DescribeStreamInput{StreamName: aws.String(stream)}); err == nil {
+		return nil
+	}
+
+	body, err := json.Marshal(&kinesis.CreateStreamInput{StreamName: aws.String(stream), ShardCount: aws.Int64(shards)})
+	if err != nil {
+		return err
+	}
+	_, err = server.Call("CreateStream", body)
+	return err
+}
+
+// Replay every write in the journal at path, with records arriving at the
+// times they originally arrived. A missing journal has nothing to replay.
+func replayJournal(server *kinesistest.Server, path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var now time.Time
+	server.Kinesis.Now = func() time.Time { return now }
+	defer func() { server.Kinesis.Now = time.Now }()
+
+	n := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return n, fmt.Errorf("%s:%d: %s", path, n+1, err)
+		}
+
+		now = entry.Time
+		if _, err := server.Call(entry.Operation, entry.Input); err != nil {
+			return n, fmt.Errorf("%s:%d: replaying %s: %s", path, n+1, entry.Operation, err)
+		}
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// An append-only log of writes.
+type journal struct {
+	sync.Mutex
+	f *os.File
+}
+
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &journal{f: f}, nil
+}
+
+// Append a write to the journal. Writes that can't be saved would be lost on
+// restart, so any error is fatal.
+func (j *journal) write(operation string, body []byte) {
+	j.Lock()
+	defer j.Unlock()
+
+	bs, err := json.Marshal(&journalEntry{Time: time.Now(), Operation: operation, Input: body})
+	fatalOnErr(err)
+	_, err = j.f.Write(append(bs, '\n'))
+	fatalOnErr(err)
+}
+
+func logRequests(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		handler.ServeHTTP(w, r)
+		log.Printf("%s %s", r.Header.Get("X-Amz-Target"), time.Since(start))
+	})
+}
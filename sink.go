@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+)
+
+// Somewhere tail can send records instead of printing them. send is called
+// concurrently for different shards, but never for the same shard at once, and
+// returns an error if the records weren't delivered and should be sent again.
+type sink interface {
+	send(shard string, records []*kinesis.Record) error
+	// Called once a shard consumer stops, after its last batch has been sent.
+	stop(shard string)
+}
+
+// Collects each shard's records into batches for a sink. A batch is sent once
+// size records have arrived, or once the oldest record in it has waited for
+// timeout, and the shard is checkpointed after every batch is sent.
+//
+// A batch that fails to send fails the consumer's BatchProcessor, which
+// retries it with backoff. Records are only checkpointed once they've been
+// sent, so they're delivered at least once.
+type batcher struct {
+	sink       sink
+	size       int
+	timeout    time.Duration
+	checkpoint bool
+
+	// Shards can start before the Consumer has been returned, so batches wait
+	// for ready before checkpointing with it.
+	consumer *consumer.Consumer
+	ready    chan struct{}
+
+	sync.Mutex
+	shards map[string]*pendingBatch
+}
+
+// The records a shard has read but not sent yet.
+type pendingBatch struct {
+	records []*kinesis.Record
+	since   time.Time
+	// The last sequence number added to the batch, so records aren't added
+	// again when the consumer retries a batch that failed.
+	lastSeq string
+}
+
+func newBatcher(s sink, size int, timeout time.Duration, checkpoint bool) *batcher {
+	if size < 1 {
+		size = 1
+	}
+	return &batcher{
+		sink:       s,
+		size:       size,
+		timeout:    timeout,
+		checkpoint: checkpoint,
+		ready:      make(chan struct{}),
+		shards:     make(map[string]*pendingBatch),
+	}
+}
+
+// Start a consumer that sends stream to the batcher's sink.
+func (b *batcher) start(stream string, opts ...consumer.Option) (*consumer.Consumer, error) {
+	if b.checkpoint {
+		opts = append(opts, consumer.WithManualCheckpoints())
+	}
+	opts = append(opts, consumer.WithShardHooks(consumer.ShardHooks{Stop: b.stop}))
+
+	c, err := consumer.StartBatches(stream, consumer.LATEST, verbose, b.process, opts...)
+	if err != nil {
+		return nil, err
+	}
+	b.consumer = c
+	close(b.ready)
+	return c, nil
+}
+
+func (b *batcher) process(ctx context.Context, shard string, records []*kinesis.Record) error {
+	p := b.pending(shard)
+	for _, r := range records {
+		seq := aws.StringValue(r.SequenceNumber)
+		if p.lastSeq != "" && !seqAfter(seq, p.lastSeq) {
+			continue
+		}
+		if len(p.records) == 0 {
+			p.since = time.Now()
+		}
+		p.records = append(p.records, r)
+		p.lastSeq = seq
+	}
+
+	for len(p.records) >= b.size || (len(p.records) > 0 && time.Since(p.since) >= b.timeout) {
+		if err := b.flush(shard, p, b.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send up to n of a shard's pending records and checkpoint them.
+func (b *batcher) flush(shard string, p *pendingBatch, n int) error {
+	if n > len(p.records) {
+		n = len(p.records)
+	}
+
+	if err := b.sink.send(shard, p.records[:n]); err != nil {
+		return err
+	}
+	seq := aws.StringValue(p.records[n-1].SequenceNumber)
+	p.records = p.records[n:]
+
+	if !b.checkpoint {
+		return nil
+	}
+	<-b.ready
+	// a lost lease stops the shard, and whoever takes it over sends anything
+	// since the last checkpoint again
+	if err := b.consumer.Checkpoint(shard, seq); err != nil && err != consumer.ErrLeaseLost {
+		return err
+	}
+	return nil
+}
+
+// Send whatever a stopped shard has left. A shard that was read to the end is
+// checkpointed at SHARD_END once this returns, so its last records are retried
+// until they're sent. A shard that was stopped early gets one try, since its
+// records are read again from the last checkpoint anyway.
+func (b *batcher) stop(shard string, ended bool) {
+	p := b.pending(shard)
+
+	backoff := consumer.DefaultRetryBackoff
+	for len(p.records) > 0 {
+		err := b.flush(shard, p, len(p.records))
+		if err == nil {
+			break
+		}
+		log.Printf("error: %s: sending last %d records: %s", shard, len(p.records), err)
+		if !ended {
+			break
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > consumer.DefaultMaxRetryBackoff {
+			backoff = consumer.DefaultMaxRetryBackoff
+		}
+	}
+
+	b.Lock()
+	delete(b.shards, shard)
+	b.Unlock()
+	b.sink.stop(shard)
+}
+
+func (b *batcher) pending(shard string) *pendingBatch {
+	b.Lock()
+	defer b.Unlock()
+
+	p := b.shards[shard]
+	if p == nil {
+		p = &pendingBatch{}
+		b.shards[shard] = p
+	}
+	return p
+}
+
+// Return true if sequence number a comes after b. Sequence numbers are
+// arbitrarily large decimal numbers.
+func seqAfter(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
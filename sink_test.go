@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+)
+
+// A sink that keeps the data of every batch it's sent, and fails the first
+// failures sends.
+type fakeSink struct {
+	sync.Mutex
+	failures int
+	batches  [][]string
+	stopped  []string
+
+	// called with every batch before it's sent
+	sending func(shard string)
+}
+
+func (f *fakeSink) send(shard string, records []*kinesis.Record) error {
+	if f.sending != nil {
+		f.sending(shard)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("downstream unavailable")
+	}
+
+	var batch []string
+	for _, r := range records {
+		batch = append(batch, string(r.Data))
+	}
+	f.batches = append(f.batches, batch)
+	return nil
+}
+
+func (f *fakeSink) stop(shard string) {
+	f.Lock()
+	defer f.Unlock()
+	f.stopped = append(f.stopped, shard)
+}
+
+func (f *fakeSink) sent() [][]string {
+	f.Lock()
+	defer f.Unlock()
+	return append([][]string(nil), f.batches...)
+}
+
+// test that batches are cut once they're full, and that a stopped shard sends
+// whatever it has left.
+func TestBatcherSize(t *testing.T) {
+	sink := &fakeSink{}
+	b := newBatcher(sink, 2, time.Hour, false)
+
+	if err := b.process(context.Background(), "shard-01", numberedRecords(1, 2, 3, 4, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]string{{"1", "2"}, {"3", "4"}}; !reflect.DeepEqual(sink.sent(), expected) {
+		t.Errorf("expected batches %v, got %v", expected, sink.sent())
+	}
+
+	b.stop("shard-01", true)
+	if expected := [][]string{{"1", "2"}, {"3", "4"}, {"5"}}; !reflect.DeepEqual(sink.sent(), expected) {
+		t.Errorf("expected batches %v after stopping, got %v", expected, sink.sent())
+	}
+	if expected := []string{"shard-01"}; !reflect.DeepEqual(sink.stopped, expected) {
+		t.Errorf("expected the sink to stop %v, got %v", expected, sink.stopped)
+	}
+}
+
+// test that a batch that isn't full is sent once its oldest record has waited
+// for the timeout.
+func TestBatcherTimeout(t *testing.T) {
+	sink := &fakeSink{}
+	b := newBatcher(sink, 10, 20*time.Millisecond, false)
+
+	if err := b.process(context.Background(), "shard-01", numberedRecords(1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if sent := sink.sent(); len(sent) != 0 {
+		t.Fatalf("expected nothing to be sent before the timeout, got %v", sent)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if err := b.process(context.Background(), "shard-01", numberedRecords(3)); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]string{{"1", "2", "3"}}; !reflect.DeepEqual(sink.sent(), expected) {
+		t.Errorf("expected batches %v, got %v", expected, sink.sent())
+	}
+}
+
+// test that records from a retried batch aren't added to the pending batch
+// twice.
+func TestBatcherRetry(t *testing.T) {
+	sink := &fakeSink{failures: 1}
+	b := newBatcher(sink, 2, time.Hour, false)
+
+	if err := b.process(context.Background(), "shard-01", numberedRecords(1, 2, 3)); err == nil {
+		t.Fatal("expected the failed send to fail the batch")
+	}
+	if err := b.process(context.Background(), "shard-01", numberedRecords(1, 2, 3)); err != nil {
+		t.Fatal(err)
+	}
+	b.stop("shard-01", true)
+
+	if expected := [][]string{{"1", "2"}, {"3"}}; !reflect.DeepEqual(sink.sent(), expected) {
+		t.Errorf("expected batches %v, got %v", expected, sink.sent())
+	}
+}
+
+// test that a shard is only checkpointed once a batch has been sent, and that
+// a batch that fails to send is retried.
+func TestBatcherCheckpoints(t *testing.T) {
+	shard := "shardId-000000000000"
+	fake := fakeWithRecords(5)
+	first, err := getRecords(fake, trimHorizon(t, fake), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// start after the first record instead of at LATEST
+	checkpointer := consumer.NewMemoryCheckpointer()
+	checkpointer.SetCheckpoint(shard, *first[0].SequenceNumber)
+
+	var checkpoints []string
+	sink := &fakeSink{failures: 2}
+	sink.sending = func(shard string) {
+		seq, _ := checkpointer.Checkpoint(shard)
+		checkpoints = append(checkpoints, seq)
+	}
+
+	b := newBatcher(sink, 2, time.Hour, true)
+	c, err := b.start(testStream,
+		consumer.WithClient(fake),
+		consumer.WithCheckpointer(checkpointer),
+		consumer.WithPollInterval(time.Millisecond),
+		consumer.WithRetryBackoff(time.Millisecond, 2*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && len(sink.sent()) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	c.Close()
+
+	if expected := [][]string{{"1", "2"}, {"3", "4"}}; !reflect.DeepEqual(sink.sent(), expected) {
+		t.Fatalf("expected batches %v, got %v", expected, sink.sent())
+	}
+
+	records, _ := getRecords(fake, trimHorizon(t, fake), 5)
+	seqs := make([]string, len(records))
+	for i, r := range records {
+		seqs[i] = aws.StringValue(r.SequenceNumber)
+	}
+
+	expected := []string{seqs[0], seqs[0], seqs[0], seqs[2]}
+	if !reflect.DeepEqual(checkpoints, expected) {
+		t.Errorf(`expected checkpoints before each send not equal to actual checkpoints
+
+		actual:   %v
+		expected: %v`, checkpoints, expected)
+	}
+	if seq, _ := checkpointer.Checkpoint(shard); seq != seqs[4] {
+		t.Errorf("expected a checkpoint at %s after the last batch, got %s", seqs[4], seq)
+	}
+}
+
+func TestSeqAfter(t *testing.T) {
+	testCases := []struct {
+		a, b     string
+		expected bool
+	}{
+		{a: "2", b: "1", expected: true},
+		{a: "1", b: "2", expected: false},
+		{a: "1", b: "1", expected: false},
+		{a: "10", b: "9", expected: true},
+		{a: "9", b: "10", expected: false},
+	}
+
+	for _, tc := range testCases {
+		if actual := seqAfter(tc.a, tc.b); actual != tc.expected {
+			t.Errorf("%s after %s: expected %v, got %v", tc.a, tc.b, tc.expected, actual)
+		}
+	}
+}
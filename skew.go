@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+)
+
+var skewFlags = flag.NewFlagSet("skew", flag.ContinueOnError)
+
+var (
+	skewSampleSize = skewFlags.Int("sample", 100000, "the number of records to sample")
+	skewFrom       = skewFlags.String("from", "trim-horizon", "where to start reading: trim-horizon or latest")
+	skewDuration   = skewFlags.Duration("duration", time.Minute, "the longest to spend sampling")
+	skewTop        = skewFlags.Int("top", 10, "the number of partition keys to show")
+)
+
+var skewCommand = &Command{
+	Name:  "skew",
+	Usage: "skew stream [--sample=100000] [--from=trim-horizon] [--duration=1m] [--top=10]",
+	Short: "Analyze partition key skew in a stream",
+	Description: `
+	Read a sample of records from the given stream and report how they're
+	distributed across the stream's open shards. Partition keys are hashed into
+	shard hash key ranges the same way Kinesis does, so the report describes
+	where data would land today even if the sample was written before a reshard.
+
+	Sampling stops after --sample records, after --duration, or once every shard
+	has been read up to the tip of the stream when starting from trim-horizon.
+	--from may be either trim-horizon or latest.
+
+	The report lists records and bytes per shard, the --top partition keys by
+	count and by bytes, and a suggested split point for every shard carrying
+	more than its share of the load.
+	`,
+	Flags: skewFlags,
+	Run:   runSkew,
+}
+
+func runSkew(args []string) {
+	if len(args) < 1 {
+		log.Fatalln("error: no stream name given")
+	}
+
+	start := consumer.TRIM_HORIZON
+	switch *skewFrom {
+	case "trim-horizon":
+	case "latest":
+		start = consumer.LATEST
+	default:
+		log.Fatalf("error: unknown starting position %q", *skewFrom)
+	}
+
+	sample := newSampler(*skewSampleSize)
+	c, err := consumer.Start(args[0], start, verbose, sample.add, consumer.WithConfig(awsConfig))
+	fatalOnErr(err)
+
+	timeout := time.After(*skewDuration)
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+
+wait:
+	for {
+		select {
+		case <-sample.full:
+			break wait
+		case <-timeout:
+			break wait
+		case <-poll.C:
+			if start == consumer.TRIM_HORIZON && c.CaughtUp() {
+				break wait
+			}
+		}
+	}
+
+	shards, err := c.Shards()
+	fatalOnErr(err)
+
+	printSkewReport(openShardRanges(shards), sample.snapshot(), *skewTop)
+}
+
+// Collects partition key counts until a fixed number of records has been seen.
+type sampler struct {
+	sync.Mutex
+
+	size   int
+	seen   int
+	counts map[string]*keyCount
+	full   chan struct{}
+}
+
+func newSampler(size int) *sampler {
+	return &sampler{
+		size:   size,
+		counts: make(map[string]*keyCount),
+		full:   make(chan struct{}),
+	}
+}
+
+func (s *sampler) add(records []*kinesis.Record) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, r := range records {
+		if s.seen >= s.size {
+			return
+		}
+
+		kc, ok := s.counts[*r.PartitionKey]
+		if !ok {
+			kc = &keyCount{key: *r.PartitionKey}
+			s.counts[*r.PartitionKey] = kc
+		}
+		kc.count++
+		kc.bytes += int64(len(r.Data))
+
+		s.seen++
+		if s.seen == s.size {
+			close(s.full)
+		}
+	}
+}
+
+func (s *sampler) snapshot() map[string]*keyCount {
+	s.Lock()
+	defer s.Unlock()
+
+	counts := make(map[string]*keyCount, len(s.counts))
+	for k, v := range s.counts {
+		kc := *v
+		counts[k] = &kc
+	}
+	return counts
+}
+
+// hash key ranges
+
+// The range of hash keys an open shard is responsible for, inclusive.
+type shardRange struct {
+	id         string
+	start, end *big.Int
+}
+
+// Return the hash key ranges of every open shard, sorted by starting hash key.
+func openShardRanges(shards []*kinesis.Shard) []shardRange {
+	var ranges []shardRange
+	for _, s := range shards {
+		if s.SequenceNumberRange != nil && s.SequenceNumberRange.EndingSequenceNumber != nil {
+			continue
+		}
+
+		start, ok := new(big.Int).SetString(*s.HashKeyRange.StartingHashKey, 10)
+		if !ok {
+			log.Fatalf("error: invalid hash key range for %s", *s.ShardId)
+		}
+		end, ok := new(big.Int).SetString(*s.HashKeyRange.EndingHashKey, 10)
+		if !ok {
+			log.Fatalf("error: invalid hash key range for %s", *s.ShardId)
+		}
+
+		ranges = append(ranges, shardRange{*s.ShardId, start, end})
+	}
+
+	sort.Sort(byStartingHashKey(ranges))
+	return ranges
+}
+
+type byStartingHashKey []shardRange
+
+func (b byStartingHashKey) Len() int           { return len(b) }
+func (b byStartingHashKey) Less(i, j int) bool { return b[i].start.Cmp(b[j].start) < 0 }
+func (b byStartingHashKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Hash a partition key the way Kinesis does: the MD5 of the key, as an
+// unsigned 128-bit integer.
+func hashKey(partitionKey string) *big.Int {
+	sum := md5.Sum([]byte(partitionKey))
+	return new(big.Int).SetBytes(sum[:])
+}
+
+// Return the index of the range containing hash, or -1 if no range does.
+func findShard(ranges []shardRange, hash *big.Int) int {
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].end.Cmp(hash) >= 0
+	})
+	if i < len(ranges) && ranges[i].start.Cmp(hash) <= 0 {
+		return i
+	}
+	return -1
+}
+
+// reporting
+
+// A partition key and its hash.
+type hashedKey struct {
+	keyCount
+	hash *big.Int
+}
+
+type byHash []hashedKey
+
+func (b byHash) Len() int           { return len(b) }
+func (b byHash) Less(i, j int) bool { return b[i].hash.Cmp(b[j].hash) < 0 }
+func (b byHash) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// The load on an individual shard.
+type shardLoad struct {
+	shardRange
+	records, bytes int64
+	keys           []hashedKey
+}
+
+func printSkewReport(ranges []shardRange, counts map[string]*keyCount, top int) {
+	loads := make([]shardLoad, len(ranges))
+	for i, r := range ranges {
+		loads[i].shardRange = r
+	}
+
+	var totalRecords, totalBytes int64
+	for _, kc := range counts {
+		hash := hashKey(kc.key)
+		i := findShard(ranges, hash)
+		if i < 0 {
+			log.Printf("warning: no open shard for key %q", kc.key)
+			continue
+		}
+
+		loads[i].records += kc.count
+		loads[i].bytes += kc.bytes
+		loads[i].keys = append(loads[i].keys, hashedKey{*kc, hash})
+		totalRecords += kc.count
+		totalBytes += kc.bytes
+	}
+
+	fmt.Printf("sampled %d records (%s) with %d distinct partition keys\n\n", totalRecords, humanBytes(float64(totalBytes)), len(counts))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "shard\trecords\t%%\tbytes\t%%\tkeys\t\n")
+	for _, l := range loads {
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%s\t%.1f\t%d\t\n",
+			l.id, l.records, percent(l.records, totalRecords),
+			humanBytes(float64(l.bytes)), percent(l.bytes, totalBytes), len(l.keys))
+	}
+	w.Flush()
+
+	fmt.Printf("\ntop partition keys by count:\n")
+	byCount := topKeyCounts(counts, top, func(a, b keyCount) bool { return a.count > b.count })
+	printKeyCounts(byCount, totalRecords, totalBytes)
+
+	fmt.Printf("\ntop partition keys by bytes:\n")
+	byBytes := topKeyCounts(counts, top, func(a, b keyCount) bool { return a.bytes > b.bytes })
+	printKeyCounts(byBytes, totalRecords, totalBytes)
+
+	fmt.Printf("\nsuggested splits:\n")
+	printSplitSuggestions(os.Stdout, loads, totalBytes)
+}
+
+func printKeyCounts(counts []keyCount, totalRecords, totalBytes int64) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, kc := range counts {
+		fmt.Fprintf(w, "  %s\t%d (%.1f%%)\t%s (%.1f%%)\n",
+			kc.key, kc.count, percent(kc.count, totalRecords),
+			humanBytes(float64(kc.bytes)), percent(kc.bytes, totalBytes))
+	}
+	w.Flush()
+}
+
+// Suggest a split for every shard carrying more than its share of bytes. Each
+// split point divides the sampled bytes on that shard as evenly as possible
+// while staying inside the shard's hash key range.
+func printSplitSuggestions(w io.Writer, loads []shardLoad, totalBytes int64) {
+	if len(loads) == 0 || totalBytes == 0 {
+		fmt.Fprintln(w, "  none. not enough data")
+		return
+	}
+
+	fairShare := totalBytes / int64(len(loads))
+	suggested := false
+	for _, l := range loads {
+		if l.bytes <= fairShare || len(l.keys) == 0 {
+			continue
+		}
+		suggested = true
+
+		sort.Sort(byHash(l.keys))
+
+		var lower int64
+		var splitAt *big.Int
+		for _, k := range l.keys {
+			if k.bytes*2 > l.bytes {
+				fmt.Fprintf(w, "  %s: %.1f%% of its bytes are from key %q. splitting won't help\n",
+					l.id, percent(k.bytes, l.bytes), k.key)
+				splitAt = nil
+				break
+			}
+			lower += k.bytes
+			if lower*2 >= l.bytes {
+				// keys with a hash >= the new starting hash key go to the upper
+				// child. a key at the end of the range can't be split off, so it
+				// goes to the upper child along with the shard's last hash key.
+				splitAt = new(big.Int).Add(k.hash, big.NewInt(1))
+				if splitAt.Cmp(l.end) > 0 {
+					splitAt = new(big.Int).Set(l.end)
+					lower -= k.bytes
+				}
+				break
+			}
+		}
+
+		if splitAt != nil {
+			fmt.Fprintf(w, "  %s: split at hash key %s (%.1f%% / %.1f%% of its bytes)\n",
+				l.id, splitAt, percent(lower, l.bytes), percent(l.bytes-lower, l.bytes))
+		}
+	}
+
+	if !suggested {
+		fmt.Fprintln(w, "  none. load is even across shards")
+	}
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
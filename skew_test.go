@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+)
+
+func TestHashKey(t *testing.T) {
+	testCases := []struct {
+		key      string
+		expected string
+	}{
+		{key: "", expected: "281949768489412648962353822266799178366"},
+		{key: "a", expected: "16955237001963240173058271559858726497"},
+		{key: "partition_key", expected: "124900383314680506556880818432367814127"},
+	}
+
+	for _, tc := range testCases {
+		if actual := hashKey(tc.key).String(); actual != tc.expected {
+			t.Errorf("%q: expected %s, got %s", tc.key, tc.expected, actual)
+		}
+	}
+}
+
+func TestFindShard(t *testing.T) {
+	ranges := []shardRange{
+		{id: "shard-01", start: big.NewInt(0), end: big.NewInt(99)},
+		{id: "shard-02", start: big.NewInt(100), end: big.NewInt(199)},
+		{id: "shard-03", start: big.NewInt(300), end: big.NewInt(399)},
+	}
+
+	testCases := []struct {
+		hash     int64
+		expected int
+	}{
+		{hash: 0, expected: 0},
+		{hash: 50, expected: 0},
+		{hash: 99, expected: 0},
+		{hash: 100, expected: 1},
+		{hash: 199, expected: 1},
+		{hash: 200, expected: -1},
+		{hash: 300, expected: 2},
+		{hash: 399, expected: 2},
+		{hash: 400, expected: -1},
+	}
+
+	for _, tc := range testCases {
+		if actual := findShard(ranges, big.NewInt(tc.hash)); actual != tc.expected {
+			t.Errorf("%d: expected %d, got %d", tc.hash, tc.expected, actual)
+		}
+	}
+
+	if actual := findShard(nil, big.NewInt(0)); actual != -1 {
+		t.Errorf("no ranges: expected -1, got %d", actual)
+	}
+}
+
+func TestPrintSplitSuggestions(t *testing.T) {
+	hot := func(keys ...hashedKey) []shardLoad {
+		loads := []shardLoad{
+			{shardRange: shardRange{id: "shard-01", start: big.NewInt(0), end: big.NewInt(99)}, keys: keys},
+			{shardRange: shardRange{id: "shard-02", start: big.NewInt(100), end: big.NewInt(199)}},
+		}
+		for _, k := range keys {
+			loads[0].records += k.count
+			loads[0].bytes += k.bytes
+		}
+		return loads
+	}
+	totalBytes := func(loads []shardLoad) int64 {
+		var total int64
+		for _, l := range loads {
+			total += l.bytes
+		}
+		return total
+	}
+
+	testCases := []struct {
+		name     string
+		loads    []shardLoad
+		expected string
+	}{
+		{
+			name:     "no data",
+			loads:    hot(),
+			expected: "  none. not enough data\n",
+		},
+		{
+			name: "even",
+			loads: []shardLoad{
+				{shardRange: shardRange{id: "shard-01", start: big.NewInt(0), end: big.NewInt(99)}, bytes: 10, keys: []hashedKey{testKey("a", 10, 10)}},
+				{shardRange: shardRange{id: "shard-02", start: big.NewInt(100), end: big.NewInt(199)}, bytes: 10, keys: []hashedKey{testKey("b", 110, 10)}},
+			},
+			expected: "  none. load is even across shards\n",
+		},
+		{
+			name:     "split between keys",
+			loads:    hot(testKey("c", 30, 10), testKey("a", 10, 10), testKey("b", 20, 20)),
+			expected: "  shard-01: split at hash key 21 (75.0% / 25.0% of its bytes)\n",
+		},
+		{
+			name:     "keys at both ends of the range",
+			loads:    hot(testKey("a", 0, 10), testKey("b", 99, 10)),
+			expected: "  shard-01: split at hash key 1 (50.0% / 50.0% of its bytes)\n",
+		},
+		{
+			name:     "one hot key",
+			loads:    hot(testKey("a", 10, 10), testKey("b", 99, 30)),
+			expected: "  shard-01: 75.0% of its bytes are from key \"b\". splitting won't help\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		var out bytes.Buffer
+		printSplitSuggestions(&out, tc.loads, totalBytes(tc.loads))
+		if actual := out.String(); actual != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, actual)
+		}
+	}
+}
+
+// test that a split point never lands past the end of the shard's hash key
+// range, even when the key that balances the split is the last hash key.
+func TestPrintSplitSuggestionsClamped(t *testing.T) {
+	loads := []shardLoad{
+		{
+			shardRange: shardRange{id: "shard-01", start: big.NewInt(0), end: big.NewInt(99)},
+			bytes:      30,
+			keys:       []hashedKey{testKey("a", 10, 10), testKey("b", 99, 10)},
+		},
+		{shardRange: shardRange{id: "shard-02", start: big.NewInt(100), end: big.NewInt(199)}},
+	}
+
+	var out bytes.Buffer
+	printSplitSuggestions(&out, loads, 30)
+	expected := "  shard-01: split at hash key 99 (33.3% / 66.7% of its bytes)\n"
+	if actual := out.String(); actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func testKey(key string, hash, bytes int64) hashedKey {
+	return hashedKey{keyCount{key: key, count: 1, bytes: bytes}, big.NewInt(hash)}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/blinsay/ktk/consumer"
+)
+
+// Per-shard Kinesis throughput limits.
+const (
+	shardReadLimit  = 2 * 1024 * 1024
+	shardWriteLimit = 1 * 1024 * 1024
+)
+
+// The number of partition keys to show in the stats table.
+const topKeys = 10
+
+var statsFlags = flag.NewFlagSet("stats", flag.ContinueOnError)
+
+var statsInterval = statsFlags.Duration("interval", 5*time.Second, "how often to refresh the table")
+
+var statsCommand = &Command{
+	Name:  "stats",
+	Usage: "stats stream [--interval=5s]",
+	Short: "Show live throughput for a stream",
+	Description: `
+	Tail every shard of the given stream from LATEST without printing any data,
+	and show a table of throughput that refreshes every --interval.
+
+	The table shows records/s, bytes/s and average record size for every shard,
+	along with how much of each shard's read (2MB/s) and write (1MB/s) limit is
+	being used. Both are worked out from the bytes stats reads, so write % is
+	only an estimate of write load: writes that were throttled never show up.
+	The most frequently seen partition keys since the last refresh are listed
+	below the table.
+	`,
+	Flags: statsFlags,
+	Run:   runStats,
+}
+
+func runStats(args []string) {
+	if len(args) < 1 {
+		log.Fatalln("error: no stream name given")
+	}
+
+	keys := newKeyCounter()
+	c, err := consumer.Tail(args[0], verbose, func(records []*kinesis.Record) {
+		keys.add(records)
+	}, consumer.WithConfig(awsConfig))
+	fatalOnErr(err)
+
+	for range time.Tick(*statsInterval) {
+		// clear the screen and home the cursor before redrawing
+		fmt.Print("\033[H\033[2J")
+		printStatsTable(args[0], c.Stats(), keys.top(topKeys))
+	}
+}
+
+func printStatsTable(stream string, stats []consumer.ShardStats, keys []keyCount) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "shard\trecords/s\tbytes/s\tavg size\tread %%\twrite %%\t\n")
+
+	var open int
+	var total consumer.ShardStats
+	for _, s := range stats {
+		if s.Closed {
+			continue
+		}
+		fmt.Fprintln(w, formatStatsRow(s.ShardId, s.RecordsPerSecond, s.BytesPerSecond, 1))
+
+		open++
+		total.RecordsPerSecond += s.RecordsPerSecond
+		total.BytesPerSecond += s.BytesPerSecond
+	}
+	fmt.Fprintln(w, formatStatsRow("total", total.RecordsPerSecond, total.BytesPerSecond, open))
+	w.Flush()
+
+	fmt.Printf("\ntop partition keys (%s):\n", stream)
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, k := range keys {
+		fmt.Fprintf(w, "  %s\t%d\t%s\n", k.key, k.count, humanBytes(float64(k.bytes)))
+	}
+	w.Flush()
+}
+
+// Format a row of the stats table. Utilization is computed against the limits
+// for the given number of shards.
+func formatStatsRow(name string, recordsPerSecond, bytesPerSecond float64, shards int) string {
+	var avgSize float64
+	if recordsPerSecond > 0 {
+		avgSize = bytesPerSecond / recordsPerSecond
+	}
+
+	readPct, writePct := 0.0, 0.0
+	if shards > 0 {
+		readPct = 100 * bytesPerSecond / float64(shards*shardReadLimit)
+		writePct = 100 * bytesPerSecond / float64(shards*shardWriteLimit)
+	}
+
+	return fmt.Sprintf("%s\t%.1f\t%s\t%s\t%.1f\t%.1f\t",
+		name, recordsPerSecond, humanBytes(bytesPerSecond), humanBytes(avgSize), readPct, writePct)
+}
+
+// Partition key counts, safe for use from multiple goroutines.
+type keyCounter struct {
+	sync.Mutex
+	counts map[string]*keyCount
+}
+
+type keyCount struct {
+	key   string
+	count int64
+	bytes int64
+}
+
+func newKeyCounter() *keyCounter {
+	return &keyCounter{counts: make(map[string]*keyCount)}
+}
+
+func (k *keyCounter) add(records []*kinesis.Record) {
+	k.Lock()
+	defer k.Unlock()
+
+	for _, r := range records {
+		kc, ok := k.counts[*r.PartitionKey]
+		if !ok {
+			kc = &keyCount{key: *r.PartitionKey}
+			k.counts[*r.PartitionKey] = kc
+		}
+		kc.count++
+		kc.bytes += int64(len(r.Data))
+	}
+}
+
+// Return the n keys with the highest counts and reset all counts.
+func (k *keyCounter) top(n int) []keyCount {
+	k.Lock()
+	counts := k.counts
+	k.counts = make(map[string]*keyCount)
+	k.Unlock()
+
+	return topKeyCounts(counts, n, func(a, b keyCount) bool { return a.count > b.count })
+}
+
+func topKeyCounts(counts map[string]*keyCount, n int, greater func(a, b keyCount) bool) []keyCount {
+	sorted := byKeyCount{greater: greater}
+	for _, kc := range counts {
+		sorted.counts = append(sorted.counts, *kc)
+	}
+	sort.Sort(sorted)
+
+	if len(sorted.counts) > n {
+		return sorted.counts[:n]
+	}
+	return sorted.counts
+}
+
+// Sorts keyCounts in descending order, breaking ties by key.
+type byKeyCount struct {
+	counts  []keyCount
+	greater func(a, b keyCount) bool
+}
+
+func (b byKeyCount) Len() int      { return len(b.counts) }
+func (b byKeyCount) Swap(i, j int) { b.counts[i], b.counts[j] = b.counts[j], b.counts[i] }
+func (b byKeyCount) Less(i, j int) bool {
+	x, y := b.counts[i], b.counts[j]
+	if b.greater(x, y) == b.greater(y, x) {
+		return x.key < y.key
+	}
+	return b.greater(x, y)
+}
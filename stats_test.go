@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+func TestFormatStatsRow(t *testing.T) {
+	testCases := []struct {
+		name             string
+		recordsPerSecond float64
+		bytesPerSecond   float64
+		shards           int
+		expected         string
+	}{
+		{
+			name:     "idle",
+			shards:   1,
+			expected: "shard-01\t0.0\t0.0B\t0.0B\t0.0\t0.0\t",
+		},
+		{
+			name:             "half the write limit",
+			recordsPerSecond: 512,
+			bytesPerSecond:   512 * 1024,
+			shards:           1,
+			expected:         "shard-01\t512.0\t512.0KB\t1.0KB\t25.0\t50.0\t",
+		},
+		{
+			name:             "spread over shards",
+			recordsPerSecond: 100,
+			bytesPerSecond:   2 * 1024 * 1024,
+			shards:           4,
+			expected:         "shard-01\t100.0\t2.0MB\t20.5KB\t25.0\t50.0\t",
+		},
+		{
+			name:             "no open shards",
+			recordsPerSecond: 10,
+			bytesPerSecond:   100,
+			expected:         "shard-01\t10.0\t100.0B\t10.0B\t0.0\t0.0\t",
+		},
+	}
+
+	for _, tc := range testCases {
+		row := formatStatsRow("shard-01", tc.recordsPerSecond, tc.bytesPerSecond, tc.shards)
+		if row != tc.expected {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.expected, row)
+		}
+	}
+}
+
+// test that the top keys are the most common since the last call, with ties
+// broken by key.
+func TestKeyCounterTop(t *testing.T) {
+	keys := newKeyCounter()
+	keys.add(recordsWithKeys("b", "a", "c", "c", "a", "c", "d"))
+
+	expected := []keyCount{
+		{key: "c", count: 3, bytes: 3},
+		{key: "a", count: 2, bytes: 2},
+		{key: "b", count: 1, bytes: 1},
+	}
+	if top := keys.top(3); !reflect.DeepEqual(top, expected) {
+		t.Errorf(`expected top keys not equal to actual top keys
+
+		actual:   %+v
+		expected: %+v`, top, expected)
+	}
+
+	keys.add(recordsWithKeys("d"))
+	expected = []keyCount{{key: "d", count: 1, bytes: 1}}
+	if top := keys.top(3); !reflect.DeepEqual(top, expected) {
+		t.Errorf("expected counts to be reset, got %+v", top)
+	}
+}
+
+// Make a record for every key, with a single byte of data.
+func recordsWithKeys(keys ...string) []*kinesis.Record {
+	var records []*kinesis.Record
+	for _, key := range keys {
+		records = append(records, &kinesis.Record{PartitionKey: aws.String(key), Data: []byte("x")})
+	}
+	return records
+}
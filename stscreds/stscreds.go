@@ -0,0 +1,240 @@
+// Package stscreds provides credentials from an STS AssumeRole call.
+//
+// Roles are assumed with the SDK's STS client and AssumeRoleProvider. This
+// package adds prompting for MFA codes and caching assumed credentials on disk
+// so they can be shared between runs.
+package stscreds
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/blinsay/ktk/consumer"
+)
+
+const (
+	// The region STS requests are signed for. The global STS endpoint only
+	// accepts requests signed for us-east-1.
+	DefaultRegion = "us-east-1"
+
+	// The default lifetime of assumed role credentials.
+	DefaultDuration = 15 * time.Minute
+
+	// Credentials are treated as expired this long before they actually
+	// expire.
+	DefaultExpiryWindow = time.Minute
+)
+
+// An AssumeRoleProvider is a credentials.Provider that assumes a role with
+// STS, using another set of credentials to make the AssumeRole call.
+//
+// When CacheDir is set, credentials are saved there until they expire, so that
+// separate runs of ktk can share them and an MFA code only has to be entered
+// once per session.
+type AssumeRoleProvider struct {
+	// The credentials used to call AssumeRole. Required unless Client is set.
+	Credentials *credentials.Credentials
+
+	// The ARN of the role to assume. Required.
+	RoleARN string
+	// The session name to use. Defaults to a unique name for every session.
+	RoleSessionName string
+	// The external id the role's trust policy requires, if any.
+	ExternalID string
+	// The serial number or ARN of an MFA device, if the role requires MFA.
+	// TokenCode must be set as well.
+	SerialNumber string
+	// Called to get a code from the MFA device when new credentials are needed.
+	TokenCode func() (string, error)
+	// How long assumed credentials should last. Defaults to DefaultDuration.
+	Duration time.Duration
+	// How long before expiry credentials should be refreshed. Defaults to
+	// DefaultExpiryWindow.
+	ExpiryWindow time.Duration
+
+	// The STS endpoint to send requests to and the region to sign them for.
+	// Default to the SDK's global STS endpoint and DefaultRegion.
+	Endpoint string
+	Region   string
+	// The STS client to use. Defaults to one built from Credentials, Endpoint
+	// and Region.
+	Client stscreds.AssumeRoler
+
+	// The directory to cache credentials in. Caching is disabled if empty.
+	CacheDir string
+
+	provider *stscreds.AssumeRoleProvider
+	value    credentials.Value
+}
+
+// Retrieve the last credentials retrieved or cached credentials if there are
+// any that haven't expired, or assume the role to get new ones.
+func (p *AssumeRoleProvider) Retrieve() (credentials.Value, error) {
+	if p.RoleARN == "" {
+		return credentials.Value{}, awserr.New("AssumeRoleError", "no role ARN given", nil)
+	}
+
+	if p.provider == nil {
+		sessionName := p.RoleSessionName
+		if sessionName == "" {
+			sessionName = "ktk-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		}
+		var externalID *string
+		if p.ExternalID != "" {
+			externalID = aws.String(p.ExternalID)
+		}
+
+		p.provider = &stscreds.AssumeRoleProvider{
+			Client:          &cachingRoler{p: p, client: p.client()},
+			RoleARN:         p.RoleARN,
+			RoleSessionName: sessionName,
+			ExternalID:      externalID,
+			Duration:        p.duration(),
+			ExpiryWindow:    p.expiryWindow(),
+		}
+	} else if !p.provider.IsExpired() {
+		return p.value, nil
+	}
+
+	value, err := p.provider.Retrieve()
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	p.value = value
+	return value, nil
+}
+
+// Return true if the last credentials retrieved are about to expire.
+func (p *AssumeRoleProvider) IsExpired() bool {
+	return p.provider == nil || p.provider.IsExpired()
+}
+
+func (p *AssumeRoleProvider) client() stscreds.AssumeRoler {
+	if p.Client != nil {
+		return p.Client
+	}
+
+	region := p.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+	config := aws.NewConfig().WithCredentials(p.Credentials).WithRegion(region)
+	if p.Endpoint != "" {
+		config = config.WithEndpoint(p.Endpoint)
+	}
+	return sts.New(config)
+}
+
+func (p *AssumeRoleProvider) duration() time.Duration {
+	if p.Duration == 0 {
+		return DefaultDuration
+	}
+	return p.Duration
+}
+
+func (p *AssumeRoleProvider) expiryWindow() time.Duration {
+	if p.ExpiryWindow == 0 {
+		return DefaultExpiryWindow
+	}
+	return p.ExpiryWindow
+}
+
+func (p *AssumeRoleProvider) valid(expiration *time.Time) bool {
+	return expiration != nil && time.Now().Add(p.expiryWindow()).Before(*expiration)
+}
+
+// An AssumeRoler that adds MFA codes to AssumeRole calls and serves them from
+// the provider's cache when it can.
+type cachingRoler struct {
+	p      *AssumeRoleProvider
+	client stscreds.AssumeRoler
+}
+
+func (c *cachingRoler) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	if creds, ok := c.p.loadCache(); ok {
+		return &sts.AssumeRoleOutput{Credentials: creds}, nil
+	}
+
+	if c.p.SerialNumber != "" {
+		if c.p.TokenCode == nil {
+			return nil, awserr.New("AssumeRoleError", "an MFA serial number was given without a way to read token codes", nil)
+		}
+		code, err := c.p.TokenCode()
+		if err != nil {
+			return nil, err
+		}
+		input.SerialNumber = aws.String(c.p.SerialNumber)
+		input.TokenCode = aws.String(code)
+	}
+
+	output, err := c.client.AssumeRole(input)
+	if err != nil {
+		return nil, err
+	}
+	if output.Credentials == nil || output.Credentials.AccessKeyId == nil || output.Credentials.Expiration == nil {
+		return nil, awserr.New("AssumeRoleError", "AssumeRole returned no credentials", nil)
+	}
+	if err := c.p.saveCache(output.Credentials); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// The cache file for this provider. Every setting that changes which
+// credentials STS returns is part of the name.
+func (p *AssumeRoleProvider) cachePath() string {
+	h := sha1.New()
+	for _, s := range []string{p.Endpoint, p.RoleARN, p.RoleSessionName, p.ExternalID, p.SerialNumber} {
+		fmt.Fprintf(h, "%s\x00", s)
+	}
+	return filepath.Join(p.CacheDir, hex.EncodeToString(h.Sum(nil))+".json")
+}
+
+// Load unexpired credentials from the cache. Any error reading the cache is
+// treated as a miss.
+func (p *AssumeRoleProvider) loadCache() (*sts.Credentials, bool) {
+	if p.CacheDir == "" {
+		return nil, false
+	}
+
+	bs, err := ioutil.ReadFile(p.cachePath())
+	if err != nil {
+		return nil, false
+	}
+
+	var creds sts.Credentials
+	if err := json.Unmarshal(bs, &creds); err != nil || creds.AccessKeyId == nil || !p.valid(creds.Expiration) {
+		return nil, false
+	}
+	return &creds, true
+}
+
+// Save credentials to the cache. The file is only readable by the current user
+// and is replaced atomically.
+func (p *AssumeRoleProvider) saveCache(creds *sts.Credentials) error {
+	if p.CacheDir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(p.CacheDir, 0700); err != nil {
+		return err
+	}
+
+	bs, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	return consumer.WriteFileAtomic(p.cachePath(), bs)
+}
@@ -0,0 +1,220 @@
+package stscreds
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+const assumeRoleResponseXML = `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASSUMED-KEY</AccessKeyId>
+      <SecretAccessKey>assumed-secret</SecretAccessKey>
+      <SessionToken>assumed-token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`
+
+const errorResponseXML = `<ErrorResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <Error>
+    <Type>Sender</Type>
+    <Code>AccessDenied</Code>
+    <Message>not allowed</Message>
+  </Error>
+  <RequestId>request-id</RequestId>
+</ErrorResponse>`
+
+// A stand-in for STS that records every request it gets and returns
+// credentials that expire after expiresIn.
+type fakeSTS struct {
+	*httptest.Server
+	expiresIn time.Duration
+	requests  []url.Values
+}
+
+func newFakeSTS(expiresIn time.Duration) *fakeSTS {
+	f := &fakeSTS{expiresIn: expiresIn}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=SOURCE-KEY/") {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, errorResponseXML)
+			return
+		}
+
+		r.ParseForm()
+		f.requests = append(f.requests, r.PostForm)
+
+		expiration := time.Now().Add(f.expiresIn).UTC().Format(time.RFC3339)
+		fmt.Fprintf(w, assumeRoleResponseXML, expiration)
+	}))
+	return f
+}
+
+func testProvider(endpoint string) *AssumeRoleProvider {
+	return &AssumeRoleProvider{
+		Credentials: credentials.NewStaticCredentials("SOURCE-KEY", "source-secret", ""),
+		RoleARN:     "arn:aws:iam::123456789012:role/test",
+		Endpoint:    endpoint,
+	}
+}
+
+func TestAssumeRole(t *testing.T) {
+	sts := newFakeSTS(time.Hour)
+	defer sts.Close()
+
+	p := testProvider(sts.URL)
+	p.RoleSessionName = "test-session"
+	p.ExternalID = "external"
+	p.SerialNumber = "arn:aws:iam::123456789012:mfa/user"
+	p.TokenCode = func() (string, error) { return "123456", nil }
+
+	value, err := p.Retrieve()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := credentials.Value{AccessKeyID: "ASSUMED-KEY", SecretAccessKey: "assumed-secret", SessionToken: "assumed-token"}
+	if value != expected {
+		t.Errorf("expected %+v, got %+v", expected, value)
+	}
+	if p.IsExpired() {
+		t.Errorf("expected fresh credentials not to be expired")
+	}
+
+	if len(sts.requests) != 1 {
+		t.Fatalf("expected exactly one AssumeRole call, got %d", len(sts.requests))
+	}
+	params := sts.requests[0]
+	for name, expected := range map[string]string{
+		"Action":          "AssumeRole",
+		"RoleArn":         p.RoleARN,
+		"RoleSessionName": "test-session",
+		"ExternalId":      "external",
+		"SerialNumber":    p.SerialNumber,
+		"TokenCode":       "123456",
+		"DurationSeconds": "900",
+	} {
+		if actual := params.Get(name); actual != expected {
+			t.Errorf("expected %s=%q, got %q", name, expected, actual)
+		}
+	}
+
+	// a second retrieve reuses the same credentials
+	if _, err := p.Retrieve(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sts.requests) != 1 {
+		t.Errorf("expected credentials to be reused. got %d AssumeRole calls", len(sts.requests))
+	}
+}
+
+func TestAssumeRoleCache(t *testing.T) {
+	sts := newFakeSTS(time.Hour)
+	defer sts.Close()
+
+	dir, err := ioutil.TempDir("", "stscreds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := testProvider(sts.URL)
+	first.CacheDir = dir
+	if _, err := first.Retrieve(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	second := testProvider(sts.URL)
+	second.CacheDir = dir
+	value, err := second.Retrieve()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if value.AccessKeyID != "ASSUMED-KEY" {
+		t.Errorf("expected cached credentials, got %+v", value)
+	}
+	if len(sts.requests) != 1 {
+		t.Errorf("expected cached credentials to be used. got %d AssumeRole calls", len(sts.requests))
+	}
+
+	// a different role doesn't share the cache
+	other := testProvider(sts.URL)
+	other.RoleARN = "arn:aws:iam::123456789012:role/other"
+	other.CacheDir = dir
+	if _, err := other.Retrieve(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sts.requests) != 2 {
+		t.Errorf("expected a new AssumeRole call for a different role. got %d calls", len(sts.requests))
+	}
+}
+
+func TestAssumeRoleExpiredCache(t *testing.T) {
+	// credentials that expire inside the expiry window are never reused
+	sts := newFakeSTS(30 * time.Second)
+	defer sts.Close()
+
+	dir, err := ioutil.TempDir("", "stscreds")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 2; i++ {
+		p := testProvider(sts.URL)
+		p.CacheDir = dir
+		if _, err := p.Retrieve(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if !p.IsExpired() {
+			t.Errorf("expected credentials inside the expiry window to be expired")
+		}
+	}
+
+	if len(sts.requests) != 2 {
+		t.Errorf("expected expired credentials to be refreshed. got %d AssumeRole calls", len(sts.requests))
+	}
+}
+
+func TestAssumeRoleError(t *testing.T) {
+	sts := newFakeSTS(time.Hour)
+	defer sts.Close()
+
+	p := testProvider(sts.URL)
+	p.Credentials = credentials.NewStaticCredentials("WRONG-KEY", "secret", "")
+
+	_, err := p.Retrieve()
+	awsErr, ok := err.(awserr.RequestFailure)
+	if !ok {
+		t.Fatalf("expected a request failure, got %#v", err)
+	}
+	if awsErr.Code() != "AccessDenied" || awsErr.StatusCode() != http.StatusForbidden || awsErr.RequestID() != "request-id" {
+		t.Errorf("unexpected error: %s", awsErr)
+	}
+}
+
+func TestMFAWithoutTokenCode(t *testing.T) {
+	sts := newFakeSTS(time.Hour)
+	defer sts.Close()
+
+	p := testProvider(sts.URL)
+	p.SerialNumber = "arn:aws:iam::123456789012:mfa/user"
+
+	if _, err := p.Retrieve(); err == nil {
+		t.Errorf("expected an error without a TokenCode func")
+	}
+	if len(sts.requests) != 0 {
+		t.Errorf("expected no AssumeRole calls, got %d", len(sts.requests))
+	}
+}
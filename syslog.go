@@ -0,0 +1,83 @@
+package main
+
+import "strings"
+
+// The parts of a syslog message's header that can be used as a partition key.
+type syslogHeader struct {
+	hostname string
+	app      string
+}
+
+// Parse the hostname and app name out of an RFC 5424 or RFC 3164 message.
+// Anything that can't be found is left empty.
+//
+// RFC 5424 messages look like:
+//
+//	<165>1 2003-10-11T22:14:15.003Z host.example.com evntslog - ID47 - msg
+//
+// and RFC 3164 messages look like:
+//
+//	<34>Oct 11 22:14:15 mymachine su[123]: msg
+//
+// Messages sent to a local socket often leave out the RFC 3164 hostname.
+func parseSyslog(msg string) syslogHeader {
+	if !strings.HasPrefix(msg, "<") {
+		return syslogHeader{}
+	}
+	end := strings.IndexByte(msg, '>')
+	if end < 0 {
+		return syslogHeader{}
+	}
+	msg = msg[end+1:]
+
+	// RFC 5424 starts with a version number
+	if sp := strings.IndexByte(msg, ' '); sp > 0 && isDigits(msg[:sp]) {
+		fields := strings.SplitN(msg, " ", 5)
+		if len(fields) < 4 {
+			return syslogHeader{}
+		}
+		return syslogHeader{hostname: nilValue(fields[2]), app: nilValue(fields[3])}
+	}
+
+	// RFC 3164 starts with a fixed width timestamp like "Oct 11 22:14:15 "
+	if len(msg) < 16 || msg[15] != ' ' {
+		return syslogHeader{}
+	}
+	fields := strings.SplitN(msg[16:], " ", 3)
+
+	var header syslogHeader
+	if !isTag(fields[0]) && len(fields) > 1 {
+		header.hostname = fields[0]
+		fields = fields[1:]
+	}
+	if isTag(fields[0]) {
+		tag := fields[0]
+		if i := strings.IndexAny(tag, "[:"); i >= 0 {
+			tag = tag[:i]
+		}
+		header.app = tag
+	}
+	return header
+}
+
+// RFC 5424 uses - for values that aren't there.
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// A 3164 tag is an app name followed by a pid in brackets or a colon.
+func isTag(s string) bool {
+	return strings.HasSuffix(s, ":") || strings.HasSuffix(s, "]")
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
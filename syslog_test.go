@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestParseSyslog(t *testing.T) {
+	testCases := []struct {
+		name     string
+		msg      string
+		expected syslogHeader
+	}{
+		{
+			name:     "rfc 5424",
+			msg:      "<165>1 2003-10-11T22:14:15.003Z host.example.com evntslog - ID47 - hello",
+			expected: syslogHeader{hostname: "host.example.com", app: "evntslog"},
+		},
+		{
+			name:     "rfc 5424 with nil values",
+			msg:      "<165>1 2003-10-11T22:14:15.003Z - - - - - hello",
+			expected: syslogHeader{},
+		},
+		{
+			name:     "rfc 5424 header cut short",
+			msg:      "<165>1 2003-10-11T22:14:15.003Z host",
+			expected: syslogHeader{},
+		},
+		{
+			name:     "rfc 3164",
+			msg:      "<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed",
+			expected: syslogHeader{hostname: "mymachine", app: "su"},
+		},
+		{
+			name:     "rfc 3164 tag without a pid",
+			msg:      "<34>Oct 11 22:14:15 mymachine su: 'su root' failed",
+			expected: syslogHeader{hostname: "mymachine", app: "su"},
+		},
+		{
+			name:     "rfc 3164 without a hostname",
+			msg:      "<34>Oct  1 22:14:15 su[123]: 'su root' failed",
+			expected: syslogHeader{app: "su"},
+		},
+		{
+			name:     "rfc 3164 without a tag",
+			msg:      "<34>Oct 11 22:14:15 mymachine hello there",
+			expected: syslogHeader{hostname: "mymachine"},
+		},
+		{
+			name:     "rfc 3164 timestamp cut short",
+			msg:      "<34>Oct 11 22:14",
+			expected: syslogHeader{},
+		},
+		{
+			name:     "no priority",
+			msg:      "Oct 11 22:14:15 mymachine su[123]: hello",
+			expected: syslogHeader{},
+		},
+		{
+			name:     "unterminated priority",
+			msg:      "<34 hello",
+			expected: syslogHeader{},
+		},
+	}
+
+	for _, tc := range testCases {
+		if actual := parseSyslog(tc.msg); actual != tc.expected {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expected, actual)
+		}
+	}
+}
@@ -1,16 +1,48 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"time"
 
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/blinsay/ktk/consumer"
 )
 
+var tailFlags = flag.NewFlagSet("tail", flag.ContinueOnError)
+
+var (
+	tailStats         = tailFlags.Bool("stats", false, "periodically print per-shard stats to stderr")
+	tailStatsInterval = tailFlags.Duration("stats-interval", 5*time.Second, "how often to print stats")
+	tailPollInterval  = tailFlags.Duration("poll-interval", consumer.DefaultPollInterval, "how often to poll shards that are caught up")
+	tailMaxIdle       = tailFlags.Duration("max-idle-interval", consumer.DefaultMaxIdleInterval, "the longest time to wait between polls of an idle shard")
+	tailLimit         = tailFlags.Int64("limit", 0, "the max records to get per GetRecords call. 0 is the Kinesis default")
+	tailCatchUp       = tailFlags.Bool("catch-up", true, "poll back-to-back while a shard is behind")
+	tailLeases        = tailFlags.String("leases", "", "divide shards with every other tail using this lease file")
+	tailWorkerId      = tailFlags.String("worker-id", defaultWorkerId(), "this tail's name in the lease file")
+	tailLeaseTimeout  = tailFlags.Duration("lease-timeout", consumer.DefaultLeaseTimeout, "how long before taking over a lease that isn't being renewed")
+	tailExec          = tailFlags.String("exec", "", "pipe records to this shell command instead of printing them")
+	tailExecPerShard  = tailFlags.Bool("exec-per-shard", false, "keep one --exec command running for each shard instead of running it for every batch")
+	tailPost          = tailFlags.String("post", "", "POST records to this URL instead of printing them. records are delivered at least once")
+	tailPostFormat    = tailFlags.String("post-format", "json", "how to --post records: json for a JSON array per batch, or raw for a request per record")
+	tailConcurrency   = tailFlags.Int("post-concurrency", 4, "the most --post requests to have in flight at once")
+	tailPostTimeout   = tailFlags.Duration("post-timeout", 30*time.Second, "how long to wait for a --post request before retrying it")
+	tailBatchSize     = tailFlags.Int("batch-size", 1, "the number of records to send to --exec or --post at a time")
+	tailBatchTimeout  = tailFlags.Duration("batch-timeout", time.Second, "the longest to hold records while waiting for a full batch")
+)
+
+var tailHeaders stringsFlag
+
+func init() {
+	tailFlags.Var(&tailHeaders, "header", "add a header to every --post request, as Name: value. may be repeated")
+}
+
 var tailCommand = &Command{
 	Name:  "tail",
-	Usage: "tail stream-name",
+	Usage: "tail stream-name [flags]",
 	Short: "Print data from the given stream",
 	Description: `
 	Tail the given Kinesis stream and print data to stdout. Functions like a
@@ -18,8 +50,52 @@ var tailCommand = &Command{
 
 	Tail follows a stream from the LATEST record. It handles reading through a
 	stream split or merge.
+
+	With --stats, a status line for every shard is printed to stderr every
+	--stats-interval showing how far behind the tip of the stream each shard
+	is and how much data is being read.
+
+	Each shard is polled every --poll-interval once it has caught up to the tip
+	of the stream, and back-to-back while it's behind unless --catch-up=false.
+	While a shard is idle the time between polls doubles, up to
+	--max-idle-interval. Every consumer of a stream shares a limit of 5 reads
+	per second per shard, so polling less often leaves room for others.
+
+	With --leases, shards are divided between every tail sharing the same lease
+	file, so several processes on a host or a shared filesystem can split a
+	wide stream. Each tail must have a unique --worker-id. Shards owned by a tail
+	that stops renewing its leases are taken over after --lease-timeout, and
+	leases double as checkpoints so the new owner picks up where the old one
+	left off. Leases are released on interrupt.
+
+	With --exec, records are piped to a shell command instead of being printed,
+	one record per line on its stdin. The command runs once for every
+	--batch-size records, or with whatever has arrived once the oldest record
+	has waited --batch-timeout, and has KTK_SHARD_ID set in its environment. A
+	command that exits non-zero is run again with the same records, backing
+	off between tries. With --exec-per-shard, one copy of the command runs for
+	each shard and is sent batches as they fill up.
+
+	With --post, records are sent to a URL instead. Each batch is POSTed as a
+	JSON array of records in the same format ktk dump writes, or with
+	--post-format=raw every record is POSTed on its own with its data as the
+	body and its shard, sequence number and partition key in X-Ktk-Shard-Id,
+	X-Ktk-Sequence-Number and X-Ktk-Partition-Key headers. Each shard sends
+	one request at a time, in order, and at most --post-concurrency requests
+	are in flight across every shard. --header adds headers to every request.
+	Batches that get a 5xx or 429 response, or no response within
+	--post-timeout, are retried the same way as a failed --exec command. Any
+	other error response drops the batch. Delivery is at-least-once: a retried
+	batch is sent again from the start, so with --post-format=raw a 5xx partway
+	through a batch re-sends records the endpoint already accepted.
+
+	Combined with --leases, a shard is only checkpointed once its records have
+	been sent, so every record is sent at least once. Partial batches are only
+	sent when a shard is polled, so --batch-timeout is only as precise as
+	--poll-interval and --max-idle-interval.
 	`,
-	Run: doTail,
+	Flags: tailFlags,
+	Run:   doTail,
 }
 
 func doTail(args []string) {
@@ -30,14 +106,97 @@ func doTail(args []string) {
 	stream := args[0]
 	lines := make(chan string)
 
-	err := consumer.Tail(stream, envBool(VERBOSE), func(records []*kinesis.Record) {
-		for _, record := range records {
-			lines <- string(record.Data)
+	opts := []consumer.Option{
+		consumer.WithConfig(awsConfig),
+		consumer.WithPollInterval(*tailPollInterval),
+		consumer.WithMaxIdleInterval(*tailMaxIdle),
+		consumer.WithLimit(*tailLimit),
+		consumer.WithCatchUp(*tailCatchUp),
+	}
+	if *tailLeases != "" {
+		opts = append(opts,
+			consumer.WithLeases(consumer.NewFileLeaseStore(*tailLeases), *tailWorkerId),
+			consumer.WithLeaseTimeout(*tailLeaseTimeout),
+		)
+	}
+
+	var s sink
+	switch {
+	case *tailExec != "" && *tailPost != "":
+		log.Fatalln("error: only one of --exec and --post can be used")
+	case *tailExec != "":
+		s = newExecSink(*tailExec, *tailExecPerShard)
+	case *tailPost != "":
+		if *tailPostFormat != "json" && *tailPostFormat != "raw" {
+			log.Fatalf("error: --post-format must be json or raw, got %q", *tailPostFormat)
 		}
-	})
+		post, err := newPostSink(*tailPost, *tailPostFormat == "raw", tailHeaders, *tailConcurrency, *tailPostTimeout)
+		fatalOnErr(err)
+		s = post
+	}
+
+	var c *consumer.Consumer
+	var err error
+	if s != nil {
+		b := newBatcher(s, *tailBatchSize, *tailBatchTimeout, *tailLeases != "")
+		c, err = b.start(stream, opts...)
+	} else {
+		c, err = consumer.Tail(stream, verbose, func(records []*kinesis.Record) {
+			for _, record := range records {
+				lines <- string(record.Data)
+			}
+		}, opts...)
+	}
 	fatalOnErr(err)
 
+	if *tailStats {
+		go printStats(c, *tailStatsInterval)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	// keep printing while the consumer closes, so shards can finish the batch
+	// they're on and checkpoint it.
+	closed := make(chan error)
 	for {
-		fmt.Println(<-lines)
+		select {
+		case line := <-lines:
+			fmt.Println(line)
+		case <-interrupt:
+			signal.Stop(interrupt)
+			go func() { closed <- c.Close() }()
+		case err := <-closed:
+			fatalOnErr(err)
+			return
+		}
+	}
+}
+
+// The hostname and pid, which is unique enough to tell tails apart.
+func defaultWorkerId() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
 	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Print a status line for every shard c is consuming every interval.
+func printStats(c *consumer.Consumer, interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, s := range c.Stats() {
+			log.Println(formatShardStats(s))
+		}
+	}
+}
+
+func formatShardStats(s consumer.ShardStats) string {
+	if s.Closed {
+		return fmt.Sprintf("%s: closed, %d records (%s) read", s.ShardId, s.Records, humanBytes(float64(s.Bytes)))
+	}
+
+	behind := time.Duration(s.MillisBehindLatest) * time.Millisecond
+	return fmt.Sprintf("%s: %s behind, last record age %s, %.1f records/s, %s/s",
+		s.ShardId, behind, s.LastRecordAge, s.RecordsPerSecond, humanBytes(s.BytesPerSecond))
 }
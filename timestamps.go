@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Unix timestamps bigger than this are assumed to be in milliseconds. In
+// seconds, it's sometime in the year 5138.
+const maxUnixSeconds = 1e11
+
+// Pulls a timestamp out of a line of input. Returns false if the line doesn't
+// have a valid timestamp.
+type timestampExtractor func(line string) (time.Time, bool)
+
+// Create a timestampExtractor from a spec. Specs starting with $ are paths
+// into a JSON object, like $.meta.timestamp or $.events[0].ts. Any other spec
+// must be a whitespace separated field number, starting from 1.
+func newTimestampExtractor(spec string) (timestampExtractor, error) {
+	if strings.HasPrefix(spec, "$") {
+		path, err := parseJSONPath(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(line string) (time.Time, bool) {
+			var v interface{}
+			if err := json.Unmarshal([]byte(line), &v); err != nil {
+				return time.Time{}, false
+			}
+
+			v, ok := path.lookup(v)
+			if !ok {
+				return time.Time{}, false
+			}
+			return parseTimestamp(v)
+		}, nil
+	}
+
+	field, err := strconv.Atoi(spec)
+	if err != nil || field < 1 {
+		return nil, fmt.Errorf("invalid timestamp field %q. use a field number or a JSON path like $.ts", spec)
+	}
+
+	return func(line string) (time.Time, bool) {
+		fields := strings.Fields(line)
+		if len(fields) < field {
+			return time.Time{}, false
+		}
+		return parseTimestamp(fields[field-1])
+	}, nil
+}
+
+// Parse a timestamp from a decoded JSON value or a string field. Strings may be
+// RFC3339 timestamps or unix times.
+func parseTimestamp(v interface{}) (time.Time, bool) {
+	switch v := v.(type) {
+	case float64:
+		return unixTime(v), true
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return t, true
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return unixTime(f), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Convert a unix time in seconds or milliseconds to a time.Time.
+func unixTime(f float64) time.Time {
+	if f > maxUnixSeconds {
+		f /= 1000
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+// A parsed JSON path. Each element is either an object key (string) or an
+// array index (int).
+type jsonPath []interface{}
+
+// Parse a minimal JSON path: dot separated keys, each optionally followed by
+// one or more [N] array indexes.
+func parseJSONPath(spec string) (jsonPath, error) {
+	var path jsonPath
+
+	rest := strings.TrimPrefix(spec, "$")
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("invalid JSON path %q: empty key", spec)
+			}
+			path = append(path, key)
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: unclosed [", spec)
+			}
+			i, err := strconv.Atoi(rest[1:end])
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid JSON path %q: bad index %q", spec, rest[1:end])
+			}
+			path = append(path, i)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid JSON path %q", spec)
+		}
+	}
+
+	return path, nil
+}
+
+// Find the value at this path in a decoded JSON value.
+func (p jsonPath) lookup(v interface{}) (interface{}, bool) {
+	for _, elem := range p {
+		switch elem := elem.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if v, ok = obj[elem]; !ok {
+				return nil, false
+			}
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok || elem >= len(arr) {
+				return nil, false
+			}
+			v = arr[elem]
+		}
+	}
+	return v, true
+}
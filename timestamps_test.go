@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimestampExtractor(t *testing.T) {
+	ts := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	testCases := []struct {
+		spec     string
+		line     string
+		expected time.Time
+		ok       bool
+	}{
+		{spec: "1", line: "2016-01-02T15:04:05Z hello", expected: ts, ok: true},
+		{spec: "2", line: "hello 1451747045 there", expected: ts, ok: true},
+		{spec: "2", line: "hello 1451747045000", expected: ts, ok: true},
+		{spec: "2", line: "hello 1451747045.5", expected: ts.Add(500 * time.Millisecond), ok: true},
+		{spec: "3", line: "too short", ok: false},
+		{spec: "1", line: "yesterday", ok: false},
+		{spec: "$.ts", line: `{"ts": "2016-01-02T15:04:05Z"}`, expected: ts, ok: true},
+		{spec: "$.ts", line: `{"ts": 1451747045}`, expected: ts, ok: true},
+		{spec: "$.ts", line: `{"ts": "1451747045"}`, expected: ts, ok: true},
+		{spec: "$.meta.events[1].ts", line: `{"meta": {"events": [{}, {"ts": 1451747045}]}}`, expected: ts, ok: true},
+		{spec: "$.meta.events[2].ts", line: `{"meta": {"events": [{}, {"ts": 1451747045}]}}`, ok: false},
+		{spec: "$.ts", line: `{"ts": true}`, ok: false},
+		{spec: "$.ts", line: `not json`, ok: false},
+		{spec: "$.ts", line: `[1451747045]`, ok: false},
+	}
+
+	for _, tc := range testCases {
+		extract, err := newTimestampExtractor(tc.spec)
+		if err != nil {
+			t.Errorf("%s: %s", tc.spec, err)
+			continue
+		}
+
+		actual, ok := extract(tc.line)
+		if ok != tc.ok {
+			t.Errorf("%s: %q: expected ok to be %v", tc.spec, tc.line, tc.ok)
+			continue
+		}
+		if ok && !actual.Equal(tc.expected) {
+			t.Errorf("%s: %q: expected %s, got %s", tc.spec, tc.line, tc.expected, actual)
+		}
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	testCases := []struct {
+		spec     string
+		expected jsonPath
+		err      bool
+	}{
+		{spec: "$", expected: nil},
+		{spec: "$.ts", expected: jsonPath{"ts"}},
+		{spec: "$.meta.ts", expected: jsonPath{"meta", "ts"}},
+		{spec: "$.events[0][2].ts", expected: jsonPath{"events", 0, 2, "ts"}},
+		{spec: "$..ts", err: true},
+		{spec: "$.events[", err: true},
+		{spec: "$.events[-1]", err: true},
+		{spec: "$ts", err: true},
+	}
+
+	for _, tc := range testCases {
+		path, err := parseJSONPath(tc.spec)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: expected error to be %v, got %v", tc.spec, tc.err, err)
+			continue
+		}
+		if !reflect.DeepEqual(path, tc.expected) {
+			t.Errorf("%s: expected %#v, got %#v", tc.spec, tc.expected, path)
+		}
+	}
+}
+
+func TestTimestampExtractorInvalid(t *testing.T) {
+	for _, spec := range []string{"0", "-1", "ts", "$.ts[x]"} {
+		if _, err := newTimestampExtractor(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func fakeReplayClock(speed float64) (*replayClock, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+
+	c := newReplayClock(speed)
+	c.now = func() time.Time { return clock.now }
+	c.sleep = clock.sleep
+	return c, clock
+}
+
+// test that records are sent with the gaps between them divided by speed.
+func TestReplayClockSpeed(t *testing.T) {
+	c, clock := fakeReplayClock(2)
+	flushes := 0
+	flush := func() error { flushes++; return nil }
+
+	start := time.Unix(5000, 0)
+	for _, ts := range []time.Time{start, start.Add(time.Second), start.Add(3 * time.Second)} {
+		if err := c.wait(ts, flush); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if clock.slept != 1500*time.Millisecond {
+		t.Errorf("expected to sleep for 1.5s, slept for %s", clock.slept)
+	}
+	if flushes != 2 {
+		t.Errorf("expected a flush before every gap, got %d flushes", flushes)
+	}
+}
+
+// test that records that are close together are still flushed as they come
+// due instead of waiting to fill a buffer.
+func TestReplayClockSmallGaps(t *testing.T) {
+	c, clock := fakeReplayClock(1)
+	flushes := 0
+	flush := func() error { flushes++; return nil }
+
+	start := time.Unix(5000, 0)
+	for i := 0; i < 100; i++ {
+		if err := c.wait(start.Add(time.Duration(i)*time.Millisecond), flush); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if clock.slept < 90*time.Millisecond || clock.slept > 100*time.Millisecond {
+		t.Errorf("expected to sleep for about 100ms, slept for %s", clock.slept)
+	}
+	if flushes < 8 {
+		t.Errorf("expected a flush about every %s, got %d flushes", minReplayDelay, flushes)
+	}
+}
+
+// test that records are flushed on schedule even when replay has fallen behind
+// and nothing needs waiting for.
+func TestReplayClockBehind(t *testing.T) {
+	c, clock := fakeReplayClock(1)
+	flushes := 0
+	flush := func() error { flushes++; return nil }
+
+	start := time.Unix(5000, 0)
+	c.wait(start, flush)
+	clock.now = clock.now.Add(time.Minute)
+
+	for i := 0; i < 100; i++ {
+		c.wait(start.Add(time.Duration(i)*time.Millisecond), flush)
+		clock.now = clock.now.Add(time.Millisecond)
+	}
+
+	if clock.slept != 0 {
+		t.Errorf("expected not to sleep, slept for %s", clock.slept)
+	}
+	if flushes < 9 {
+		t.Errorf("expected a flush about every %s, got %d flushes", minReplayDelay, flushes)
+	}
+}
+
+// test that max speed never waits or flushes.
+func TestReplayClockMax(t *testing.T) {
+	c, clock := fakeReplayClock(0)
+	flushes := 0
+	flush := func() error { flushes++; return nil }
+
+	start := time.Unix(5000, 0)
+	c.wait(start, flush)
+	c.wait(start.Add(time.Hour), flush)
+
+	if clock.slept != 0 || flushes != 0 {
+		t.Errorf("expected no waiting, slept for %s and flushed %d times", clock.slept, flushes)
+	}
+}